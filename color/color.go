@@ -6,7 +6,10 @@ import (
 	"strings"
 )
 
-var ColorRegex = regexp.MustCompile("([@#][0-6]|@@|##)")
+var ColorRegex = regexp.MustCompile(`(@\(` + extendedValue + `\)|@\[` + extendedValue + `\]|[@#][0-6]|@@|##)`)
+
+// extendedValue matches an xterm-256 index or a 24-bit color, see extended.go
+const extendedValue = `(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d|#[0-9a-fA-F]{6})`
 
 type ColorMode int
 
@@ -142,8 +145,19 @@ var Lookup = map[Color]bool{
 	Normal:      true,
 }
 
-// Strips MUD color codes and replaces them with ansi color codes
+// Strips MUD color codes and replaces them with ansi color codes, any MXP
+// markup is removed. Extended colors are reduced to the 16 basic ones.
 func ProcessColors(text string, cm ColorMode) string {
+	return ProcessColorsDepth(text, cm, Depth16)
+}
+
+// ProcessColorsDepth is ProcessColors for a client that can show the given
+// number of colors
+func ProcessColorsDepth(text string, cm ColorMode, depth ColorDepth) string {
+	return processColors(StripMXP(text), cm, depth)
+}
+
+func processColors(text string, cm ColorMode, depth ColorDepth) string {
 	replace := func(match string) string {
 		found := Lookup[Color(match)]
 
@@ -151,6 +165,10 @@ func ProcessColors(text string, cm ColorMode) string {
 			return getAnsiCode(cm, Color(match))
 		}
 
+		if code, ok := getExtendedAnsiCode(cm, depth, match); ok {
+			return code
+		}
+
 		return match
 	}
 
@@ -159,5 +177,5 @@ func ProcessColors(text string, cm ColorMode) string {
 }
 
 func StripColors(text string) string {
-	return ColorRegex.ReplaceAllString(text, "")
+	return ColorRegex.ReplaceAllString(StripMXP(text), "")
 }
@@ -0,0 +1,204 @@
+package color
+
+/*
+Extended colors
+
+Besides the 16 colors above, text can be marked up with any of the xterm-256
+colors or a 24-bit color, in the foreground or the background:
+
+	@(n)        foreground xterm color n, 0-255
+	@(#rrggbb)  foreground 24-bit color
+	@[n]        background xterm color n, 0-255
+	@[#rrggbb]  background 24-bit color
+
+The codes are rendered for the color depth of the client, colors it can't show
+are replaced with the nearest one it can.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ColorDepth is the number of colors a client can show
+type ColorDepth int
+
+const (
+	DepthAuto      ColorDepth = iota // Whatever the client's terminal reports
+	Depth16        ColorDepth = iota
+	Depth256       ColorDepth = iota
+	DepthTrueColor ColorDepth = iota
+)
+
+func (d ColorDepth) String() string {
+	switch d {
+	case Depth16:
+		return "16 colors"
+	case Depth256:
+		return "256 colors"
+	case DepthTrueColor:
+		return "Truecolor"
+	}
+	return "Auto"
+}
+
+// Xterm returns the xterm-256 color with the given index
+func Xterm(index uint8) Color {
+	return Color(fmt.Sprintf("@(%d)", index))
+}
+
+// RGB returns the 24-bit color with the given components
+func RGB(r, g, b uint8) Color {
+	return Color(fmt.Sprintf("@(#%02x%02x%02x)", r, g, b))
+}
+
+// Background returns the background version of a color made by Xterm or RGB
+func Background(color Color) Color {
+	code := string(color)
+	if strings.HasPrefix(code, "@(") && strings.HasSuffix(code, ")") {
+		return Color("@[" + code[2:len(code)-1] + "]")
+	}
+	return color
+}
+
+type rgb struct {
+	r, g, b int
+}
+
+// ansiColors are the 16 standard colors as xterm shows them, the index of each
+// is its xterm-256 index
+var ansiColors = []rgb{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+var cubeLevels = []int{0, 95, 135, 175, 215, 255}
+
+// xtermToRGB returns the color xterm shows for the given index
+func xtermToRGB(index int) rgb {
+	switch {
+	case index < 16:
+		return ansiColors[index]
+	case index < 232:
+		index -= 16
+		return rgb{cubeLevels[index/36], cubeLevels[(index/6)%6], cubeLevels[index%6]}
+	default:
+		level := 8 + (index-232)*10
+		return rgb{level, level, level}
+	}
+}
+
+func (c rgb) distance(other rgb) int {
+	dr, dg, db := c.r-other.r, c.g-other.g, c.b-other.b
+	return dr*dr + dg*dg + db*db
+}
+
+// nearestXterm returns the index of the xterm color closest to c, out of the
+// first count colors of the palette
+func nearestXterm(c rgb, count int) int {
+	best := 0
+	bestDistance := -1
+	for i := 0; i < count; i++ {
+		if distance := c.distance(xtermToRGB(i)); bestDistance == -1 || distance < bestDistance {
+			best = i
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// parseExtended returns the color and whether it is a background color for an
+// extended code, ok is false if the code isn't one
+func parseExtended(code string) (c rgb, index int, background bool, ok bool) {
+	if len(code) < 4 || code[0] != '@' {
+		return rgb{}, 0, false, false
+	}
+
+	switch {
+	case code[1] == '(' && code[len(code)-1] == ')':
+	case code[1] == '[' && code[len(code)-1] == ']':
+		background = true
+	default:
+		return rgb{}, 0, false, false
+	}
+
+	value := code[2 : len(code)-1]
+	if strings.HasPrefix(value, "#") {
+		components, err := strconv.ParseUint(value[1:], 16, 32)
+		if err != nil || len(value) != 7 {
+			return rgb{}, 0, false, false
+		}
+		return rgb{int(components >> 16 & 0xff), int(components >> 8 & 0xff), int(components & 0xff)}, -1, background, true
+	}
+
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 || index > 255 {
+		return rgb{}, 0, false, false
+	}
+	return xtermToRGB(index), index, background, true
+}
+
+// getExtendedAnsiCode renders an extended color code for the given depth
+func getExtendedAnsiCode(mode ColorMode, depth ColorDepth, code string) (string, bool) {
+	c, index, background, ok := parseExtended(code)
+	if !ok {
+		return "", false
+	}
+
+	if mode == ModeNone {
+		return "", true
+	}
+
+	layer := 38
+	if background {
+		layer = 48
+	}
+
+	switch depth {
+	case DepthTrueColor:
+		return fmt.Sprintf("\033[%d;2;%d;%d;%dm", layer, c.r, c.g, c.b), true
+	case Depth256:
+		if index == -1 {
+			index = nearestXterm(c, 256)
+		}
+		return fmt.Sprintf("\033[%d;5;%dm", layer, index), true
+	}
+
+	if index == -1 || index >= 16 {
+		index = nearestXterm(c, 16)
+	}
+
+	if background {
+		if index < 8 {
+			return fmt.Sprintf("\033[%dm", 40+index), true
+		}
+		return fmt.Sprintf("\033[%dm", 100+index-8), true
+	}
+
+	if index < 8 {
+		return fmt.Sprintf("\033[22;%dm", 30+index), true
+	}
+	return fmt.Sprintf("\033[01;%dm", 30+index-8), true
+}
+
+// DepthForTerminal guesses the color depth of a terminal from its terminal type
+func DepthForTerminal(terminalType string) ColorDepth {
+	terminalType = strings.ToLower(terminalType)
+
+	switch {
+	case strings.Contains(terminalType, "truecolor"),
+		strings.Contains(terminalType, "24bit"),
+		strings.HasSuffix(terminalType, "-direct"),
+		strings.Contains(terminalType, "mudlet"):
+		return DepthTrueColor
+	case strings.Contains(terminalType, "256"),
+		strings.Contains(terminalType, "tintin"),
+		strings.Contains(terminalType, "mushclient"),
+		strings.Contains(terminalType, "cmud"):
+		return Depth256
+	}
+	return Depth16
+}
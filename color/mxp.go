@@ -0,0 +1,79 @@
+package color
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MXP tags are embedded in text behind a marker so that they pass through the
+// same pipeline as the color codes. ProcessMXP turns the marker into the MXP
+// "temp secure" escape for clients that negotiated MXP, every other output path
+// strips the tags. The marker is a control character, which player input never
+// contains (see utils.GetRawUserInput), so players can't forge tags of their own.
+const mxpMarker = "\x00"
+const mxpTempSecure = "\033[4z"
+
+var MXPRegex = regexp.MustCompile("\x00<[^>]*>")
+
+// mxpModeRegex matches the MXP mode changing escapes, which are only ever sent
+// by ProcessMXP
+var mxpModeRegex = regexp.MustCompile("\033\\[[0-9]*z")
+
+var mxpEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+var mxpTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Link wraps the given text in a link that sends command to the server when
+// clicked, hint is shown as a tooltip. Without MXP only the text is shown.
+func Link(text string, command string, hint string) string {
+	return Menu(text, hint, command)
+}
+
+// Menu is like Link but offers each of the given commands in a popup menu,
+// the first command is the one sent by a plain click
+func Menu(text string, hint string, commands ...string) string {
+	href := mxpEscaper.Replace(strings.Join(commands, "|"))
+
+	tag := "<send href=\"" + href + "\""
+	if hint != "" {
+		hints := []string{hint}
+		if len(commands) > 1 {
+			hints = append(hints, commands...)
+		}
+		tag += " hint=\"" + mxpEscaper.Replace(strings.Join(hints, "|")) + "\""
+	}
+	tag += ">"
+
+	return mxpMarker + tag + text + mxpMarker + "</send>"
+}
+
+// StripMXP removes any MXP tags from the given text
+func StripMXP(text string) string {
+	return MXPRegex.ReplaceAllString(text, "")
+}
+
+// ProcessMXP is ProcessColors for clients that negotiated MXP, the tags are
+// kept and any other text that MXP would interpret is escaped
+func ProcessMXP(text string, cm ColorMode) string {
+	return ProcessMXPDepth(text, cm, Depth16)
+}
+
+// ProcessMXPDepth is ProcessMXP for a client that can show the given number
+// of colors
+func ProcessMXPDepth(text string, cm ColorMode, depth ColorDepth) string {
+	text = processColors(text, cm, depth)
+
+	var result strings.Builder
+	last := 0
+	for _, match := range MXPRegex.FindAllStringIndex(text, -1) {
+		result.WriteString(escapeMXP(text[last:match[0]]))
+		result.WriteString(mxpTempSecure + text[match[0]+len(mxpMarker):match[1]])
+		last = match[1]
+	}
+	result.WriteString(escapeMXP(text[last:]))
+
+	return result.String()
+}
+
+func escapeMXP(text string) string {
+	return mxpTextEscaper.Replace(mxpModeRegex.ReplaceAllString(text, ""))
+}
@@ -16,6 +16,7 @@ type Config struct {
 	Frontend frontendConfig `toml:"frontend"`
 	Cluster  clusterConfig  `toml:"cluster"`
 	Game     gameConfig     `toml:"game"`
+	Security securityConfig `toml:"security"`
 }
 
 var configquerylocker sync.Mutex
@@ -67,11 +68,66 @@ type serverConfig struct {
 	Interface    string `toml:"interface"`
 	Debug        bool   `toml:"debug"`
 	LoggingLevel string `toml:"verbosity"`
+
+	// TLS is only served when a port is set
+	TLSPort string `toml:"tls_port"`
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// The WebSocket gateway is only served when a port is set, it uses TLS
+	// if a certificate is configured
+	WebSocketPort string `toml:"websocket_port"`
+	WebSocketPath string `toml:"websocket_path"`
+
+	// SSH is only served when a port is set. The host key is generated the
+	// first time the server starts if the file doesn't exist yet.
+	SSHPort    string `toml:"ssh_port"`
+	SSHHostKey string `toml:"ssh_host_key"`
+
+	// Connections from the trusted proxies, addresses or CIDR ranges, must
+	// start with a PROXY protocol header giving the client's address
+	ProxyProtocol  bool     `toml:"proxy_protocol"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Idle connections are warned and then disconnected, with separate limits
+	// for the login menu and once logged in. Durations are written the way
+	// time.ParseDuration reads them ("15m"), unset turns each off.
+	LoginIdleTimeout  string `toml:"login_idle_timeout"`
+	GameIdleTimeout   string `toml:"game_idle_timeout"`
+	IdleWarning       string `toml:"idle_warning"`
+	KeepaliveInterval string `toml:"keepalive_interval"`
+	KeepaliveCommand  string `toml:"keepalive_command"` // "nop" (default) or "ayt"
+
+	// Players can record their sessions to ttyrec files in this directory
+	// with /record, unset turns recording off. A recording stops once it
+	// reaches recording_max_size, in KiB (10240 by default).
+	RecordingDir     string `toml:"recording_dir"`
+	RecordingMaxSize int    `toml:"recording_max_size"`
+
+	// On SIGINT or SIGTERM players are warned for shutdown_countdown (30s by
+	// default) before being disconnected, then the server waits up to
+	// shutdown_drain (10s by default) for their accounts and players to be
+	// logged out
+	ShutdownCountdown string `toml:"shutdown_countdown"`
+	ShutdownDrain     string `toml:"shutdown_drain"`
 }
 
 type cryptConfig struct {
 	AccountManagerSecret string `toml:"account_manager_secret"`
 	FrontendCommsSecret  string `toml:"frontend_comms_secret"`
+
+	// How the accountmanager hashes passwords, "argon2id" (the default) or
+	// "bcrypt", and how much work each hash takes. Unset costs are defaults.
+	PasswordHash  string `toml:"password_hash"`
+	Argon2Time    int    `toml:"argon2_time"`
+	Argon2Memory  int    `toml:"argon2_memory"` // KiB
+	Argon2Threads int    `toml:"argon2_threads"`
+	BcryptCost    int    `toml:"bcrypt_cost"`
+
+	// Auth tokens stop working token_lifetime after login (168h by default),
+	// or once unused for token_idle_timeout (24h by default)
+	TokenLifetime    string `toml:"token_lifetime"`
+	TokenIdleTimeout string `toml:"token_idle_timeout"`
 }
 
 type frontendConfig struct {
@@ -83,6 +139,29 @@ type clusterConfig struct {
 	FrontendHostname       string `toml:"frontend_hostname"`
 }
 
+// securityConfig limits who may connect and how often logins may fail.
+// Limits left at zero are off, durations are written the way
+// time.ParseDuration reads them.
+type securityConfig struct {
+	MaxConnectionsPerIP  int `toml:"max_connections_per_ip"`
+	ConnectionsPerMinute int `toml:"connections_per_minute"`
+
+	// Addresses or CIDR ranges, when there are any allowed only they may connect
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+
+	LoginAttempts     int    `toml:"login_attempts"`      // Per connection, 3 by default
+	LoginBackoff      string `toml:"login_backoff"`       // First wait after a failure, doubled each time, 2s by default
+	MaxLoginBackoff   string `toml:"max_login_backoff"`   // 5m by default
+	LoginFailureReset string `toml:"login_failure_reset"` // When failures are forgotten, 1h by default
+
+	// Where rules added at runtime and login failures are kept across restarts
+	StateFile string `toml:"state_file"`
+
+	// Accounts that may use the frontend's admin menu
+	Admins []string `toml:"admins"`
+}
+
 type gameConfig struct {
 	ServerName string `toml:"server_name"`
 }
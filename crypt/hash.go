@@ -0,0 +1,204 @@
+package crypt
+
+/*
+Password hashes, as the accountmanager stores them
+
+	argon2id - $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>, the salt and key in
+	           unpadded base64 as in the PHC string format
+	bcrypt   - $2a$10$... as golang.org/x/crypto/bcrypt writes it
+	legacy   - the hex of the password as the client sent it, from before the
+	           accountmanager hashed passwords. These are replaced with a hash
+	           the next time the account logs in.
+
+Whichever the config asks for, passwords stored with the other are still
+checked, and rehashed on login the same way legacy ones are. So are hashes
+with a different cost from the config's.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownPasswordHash = errors.New("unrecognized password hash")
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// The argon2id defaults are the second recommended option of RFC 9106, for
+// servers without gigabytes of memory to spare
+const (
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024 // KiB
+	DefaultArgon2Threads = 2
+	DefaultBcryptCost    = bcrypt.DefaultCost
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// PasswordHasher hashes passwords with an algorithm and cost
+type PasswordHasher struct {
+	Algorithm     string
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+	BcryptCost    int
+}
+
+// PasswordHasherFromConfig reads the algorithm and cost from the crypt config,
+// taking the defaults for anything unset
+func PasswordHasherFromConfig(conf *config.Config) (PasswordHasher, error) {
+	c := conf.Crypt
+	h := PasswordHasher{
+		Algorithm:     HashArgon2id,
+		Argon2Time:    DefaultArgon2Time,
+		Argon2Memory:  DefaultArgon2Memory,
+		Argon2Threads: DefaultArgon2Threads,
+		BcryptCost:    DefaultBcryptCost,
+	}
+
+	switch strings.ToLower(c.PasswordHash) {
+	case "", HashArgon2id:
+	case HashBcrypt:
+		h.Algorithm = HashBcrypt
+	default:
+		return PasswordHasher{}, errors.New("invalid password_hash: " + c.PasswordHash)
+	}
+
+	if c.Argon2Time < 0 || c.Argon2Memory < 0 || c.Argon2Threads < 0 || c.Argon2Threads > 255 {
+		return PasswordHasher{}, errors.New("invalid argon2 cost")
+	}
+	if c.Argon2Time > 0 {
+		h.Argon2Time = uint32(c.Argon2Time)
+	}
+	if c.Argon2Memory > 0 {
+		h.Argon2Memory = uint32(c.Argon2Memory)
+	}
+	if c.Argon2Threads > 0 {
+		h.Argon2Threads = uint8(c.Argon2Threads)
+	}
+	if h.Argon2Memory < 8*uint32(h.Argon2Threads) {
+		return PasswordHasher{}, errors.New("argon2_memory must be at least 8 KiB per thread")
+	}
+
+	if c.BcryptCost != 0 {
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return PasswordHasher{}, fmt.Errorf("bcrypt_cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		h.BcryptCost = c.BcryptCost
+	}
+
+	return h, nil
+}
+
+// Hash returns a salted hash of password to store
+func (h PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, h.Argon2Threads, argon2KeyLength)
+
+	return fmt.Sprintf("$%v$v=%v$m=%v,t=%v,p=%v$%v$%v", HashArgon2id, argon2.Version,
+		h.Argon2Memory, h.Argon2Time, h.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash returns true if hash wasn't made by h, so that the password
+// should be hashed again the next time it is known
+func (h PasswordHasher) NeedsRehash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$"+HashArgon2id+"$"):
+		params, _, _, err := parseArgon2(hash)
+		return err != nil || h.Algorithm != HashArgon2id ||
+			params.Argon2Time != h.Argon2Time || params.Argon2Memory != h.Argon2Memory || params.Argon2Threads != h.Argon2Threads
+	case isBcrypt(hash):
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || h.Algorithm != HashBcrypt || cost != h.BcryptCost
+	}
+	return true
+}
+
+// VerifyPassword returns true if password matches hash, which may be an
+// argon2id, bcrypt or legacy hash. The comparison takes the same time however
+// much of the hash matches.
+func VerifyPassword(hash string, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$"+HashArgon2id+"$"):
+		params, salt, key, err := parseArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case isLegacyHash(hash):
+		candidate := hex.EncodeToString([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(candidate), []byte(strings.ToLower(hash))) == 1, nil
+	}
+
+	return false, ErrUnknownPasswordHash
+}
+
+// parseArgon2 returns the parameters, salt and key of an argon2id hash
+func parseArgon2(hash string) (PasswordHasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return PasswordHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	params := PasswordHasher{Algorithm: HashArgon2id}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads)
+	if err != nil || params.Argon2Time == 0 || params.Argon2Threads == 0 {
+		return PasswordHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return PasswordHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return PasswordHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// isLegacyHash returns true for the hex passwords stored before hashing
+func isLegacyHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
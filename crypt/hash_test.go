@@ -0,0 +1,120 @@
+package crypt
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap costs, the defaults would make the tests slow
+var testArgon2 = PasswordHasher{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+var testBcrypt = PasswordHasher{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}
+
+func Test_PasswordHash(t *testing.T) {
+	password := string(Sha256Sum("hunter2"))
+
+	for _, hasher := range []PasswordHasher{testArgon2, testBcrypt} {
+		hash, err := hasher.Hash(password)
+		if err != nil {
+			t.Fatalf("%v Hash() failed: %v", hasher.Algorithm, err)
+		}
+		if strings.Contains(hash, hex.EncodeToString([]byte(password))) {
+			t.Errorf("%v Hash() == %q, which contains the password", hasher.Algorithm, hash)
+		}
+
+		other, _ := hasher.Hash(password)
+		if other == hash {
+			t.Errorf("%v Hash() gave the same hash twice, it isn't salted", hasher.Algorithm)
+		}
+
+		if match, err := VerifyPassword(hash, password); !match || err != nil {
+			t.Errorf("%v VerifyPassword() of the right password == %v, %v", hasher.Algorithm, match, err)
+		}
+		if match, err := VerifyPassword(hash, string(Sha256Sum("hunter3"))); match || err != nil {
+			t.Errorf("%v VerifyPassword() of the wrong password == %v, %v", hasher.Algorithm, match, err)
+		}
+		if hasher.NeedsRehash(hash) {
+			t.Errorf("%v NeedsRehash() of its own hash == true", hasher.Algorithm)
+		}
+	}
+}
+
+func Test_LegacyPasswordHash(t *testing.T) {
+	password := string(Sha256Sum("hunter2"))
+	legacy := hex.EncodeToString([]byte(password))
+
+	if match, err := VerifyPassword(legacy, password); !match || err != nil {
+		t.Errorf("VerifyPassword() of a legacy hash == %v, %v", match, err)
+	}
+	if match, _ := VerifyPassword(legacy, string(Sha256Sum("hunter3"))); match {
+		t.Errorf("VerifyPassword() of a legacy hash and the wrong password == true")
+	}
+	if !testArgon2.NeedsRehash(legacy) {
+		t.Errorf("NeedsRehash() of a legacy hash == false")
+	}
+
+	if _, err := VerifyPassword("$scrypt$whatever", password); err != ErrUnknownPasswordHash {
+		t.Errorf("VerifyPassword() of an unknown hash returned %v", err)
+	}
+	if match, _ := VerifyPassword("", ""); match {
+		t.Errorf("VerifyPassword() of an empty hash == true")
+	}
+}
+
+func Test_PasswordRehash(t *testing.T) {
+	argon2Hash, _ := testArgon2.Hash("password")
+	bcryptHash, _ := testBcrypt.Hash("password")
+
+	stronger := testArgon2
+	stronger.Argon2Time++
+	if !stronger.NeedsRehash(argon2Hash) {
+		t.Errorf("NeedsRehash() with a higher argon2 time == false")
+	}
+	if !testArgon2.NeedsRehash(bcryptHash) || !testBcrypt.NeedsRehash(argon2Hash) {
+		t.Errorf("NeedsRehash() with a different algorithm == false")
+	}
+
+	stronger = testBcrypt
+	stronger.BcryptCost++
+	if !stronger.NeedsRehash(bcryptHash) {
+		t.Errorf("NeedsRehash() with a higher bcrypt cost == false")
+	}
+}
+
+func Test_PasswordHasherFromConfig(t *testing.T) {
+	hasher, err := PasswordHasherFromConfig(&config.Config{})
+	want := PasswordHasher{
+		Algorithm:     HashArgon2id,
+		Argon2Time:    DefaultArgon2Time,
+		Argon2Memory:  DefaultArgon2Memory,
+		Argon2Threads: DefaultArgon2Threads,
+		BcryptCost:    DefaultBcryptCost,
+	}
+	if err != nil || hasher != want {
+		t.Errorf("PasswordHasherFromConfig() of an empty config == %+v, %v, want %+v", hasher, err, want)
+	}
+
+	conf := &config.Config{}
+	conf.Crypt.PasswordHash = "bcrypt"
+	conf.Crypt.BcryptCost = 12
+	hasher, err = PasswordHasherFromConfig(conf)
+	if err != nil || hasher.Algorithm != HashBcrypt || hasher.BcryptCost != 12 {
+		t.Errorf("PasswordHasherFromConfig() == %+v, %v, want bcrypt with cost 12", hasher, err)
+	}
+
+	for _, invalid := range []func(c *config.Config){
+		func(c *config.Config) { c.Crypt.PasswordHash = "md5" },
+		func(c *config.Config) { c.Crypt.BcryptCost = 100 },
+		func(c *config.Config) { c.Crypt.Argon2Threads = 300 },
+		func(c *config.Config) { c.Crypt.Argon2Memory = 1 },
+	} {
+		conf := &config.Config{}
+		invalid(conf)
+		if _, err := PasswordHasherFromConfig(conf); err == nil {
+			t.Errorf("PasswordHasherFromConfig() accepted %+v", conf.Crypt)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package crypt
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/yamamushi/kmud-2020/config"
 	"github.com/yamamushi/kmud-2020/types"
 	"io/ioutil"
@@ -14,8 +15,38 @@ func GetAuthToken(username string, password string, conf *config.Config) (types.
 	sha := Sha256Sum(password)
 	hashedPass := string(sha)
 
-	jsonData := map[string]string{"secret": conf.Crypt.AccountManagerSecret, "username": username, "hashedpass": hashedPass}
-	jsonValue, _ := json.Marshal(jsonData)
+	return requestAuthToken(types.AuthRequest{Secret: conf.Crypt.AccountManagerSecret, Username: username, HashedPass: hashedPass}, conf)
+}
+
+// GetAuthTokenForKey logs in with a public key registered with the account,
+// in authorized_keys format
+func GetAuthTokenForKey(username string, publicKey string, conf *config.Config) (types.AuthResponse, bool) {
+	return requestAuthToken(types.AuthRequest{Secret: conf.Crypt.AccountManagerSecret, Username: username, PublicKey: publicKey}, conf)
+}
+
+// HasPublicKey returns an error unless a public key, in authorized_keys
+// format, is registered with the account. Unlike GetAuthTokenForKey it
+// doesn't log in.
+func HasPublicKey(username string, publicKey string, conf *config.Config) error {
+	jsonValue, _ := json.Marshal(types.PublicKeyRequest{Secret: conf.Crypt.AccountManagerSecret, Username: username, PublicKey: publicKey})
+	response, err := http.Post("http://"+conf.Cluster.AccountManagerHostname+"/haskey", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	output := types.PublicKeyResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&output); err != nil {
+		return err
+	}
+	if output.Err != "" {
+		return errors.New(output.Err)
+	}
+	return nil
+}
+
+func requestAuthToken(request types.AuthRequest, conf *config.Config) (types.AuthResponse, bool) {
+	jsonValue, _ := json.Marshal(request)
 	response, err := http.Post("http://"+conf.Cluster.AccountManagerHostname+"/auth", "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
 		log.Println("Error: GetAuthToken auth request failed with error: " + err.Error())
@@ -32,5 +63,23 @@ func GetAuthToken(username string, password string, conf *config.Config) (types.
 		}
 		return output, true
 	}
-	return types.AuthResponse{}, true
+}
+
+// Logout ends the session a token belongs to, so that it can't be used again
+func Logout(token string, conf *config.Config) error {
+	jsonValue, _ := json.Marshal(types.TokenRequest{Secret: conf.Crypt.AccountManagerSecret, Token: token})
+	response, err := http.Post("http://"+conf.Cluster.AccountManagerHostname+"/logout", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	output := types.LogoutResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&output); err != nil {
+		return err
+	}
+	if output.Err != "" {
+		return errors.New(output.Err)
+	}
+	return nil
 }
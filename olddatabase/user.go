@@ -8,16 +8,20 @@ import (
 	"net"
 	"reflect"
 
+	"github.com/yamamushi/kmud-2020/types"
 	"github.com/yamamushi/kmud-2020/utils"
 )
 
 type User struct {
 	DbObject `bson:",inline"`
 
-	Name      string
-	ColorMode color.ColorMode
-	Password  []byte
-	Admin     bool
+	Name       string
+	ColorMode  color.ColorMode
+	ColorDepth color.ColorDepth
+	Password   []byte
+	Admin      bool
+
+	ScreenReaderMode types.ScreenReaderMode
 
 	online       bool
 	conn         net.Conn
@@ -78,6 +82,34 @@ func (u *User) GetColorMode() color.ColorMode {
 	return u.ColorMode
 }
 
+// SetColorDepth overrides the number of colors detected for the user's client,
+// color.DepthAuto goes back to detecting it
+func (u *User) SetColorDepth(depth color.ColorDepth) {
+	u.writeLock(func() {
+		u.ColorDepth = depth
+	})
+}
+
+func (u *User) GetColorDepth() color.ColorDepth {
+	u.ReadLock()
+	defer u.ReadUnlock()
+	return u.ColorDepth
+}
+
+// SetScreenReaderMode overrides whether the user is sent output suited to
+// screen readers, types.ScreenReaderAuto goes back to asking the client
+func (u *User) SetScreenReaderMode(mode types.ScreenReaderMode) {
+	u.writeLock(func() {
+		u.ScreenReaderMode = mode
+	})
+}
+
+func (u *User) GetScreenReaderMode() types.ScreenReaderMode {
+	u.ReadLock()
+	defer u.ReadUnlock()
+	return u.ScreenReaderMode
+}
+
 func hash(data string) []byte {
 	h := sha1.New()
 	io.WriteString(h, data)
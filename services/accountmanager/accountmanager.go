@@ -8,6 +8,7 @@ import (
 	httptransport "github.com/go-kit/kit/transport/http"
 
 	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/crypt"
 	"github.com/yamamushi/kmud-2020/utils"
 )
 
@@ -19,6 +20,15 @@ func main() {
 		utils.HandleError(err)
 	}
 
+	// Passwords and tokens use these settings, they are checked up front
+	// rather than at the first registration
+	if _, err = crypt.PasswordHasherFromConfig(conf); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = utils.TokenSettingsFromConfig(conf); err != nil {
+		log.Fatal(err)
+	}
+
 	db := database.NewDatabaseHandler(conf)
 
 	log.Println("Creating endpoint handlers")
@@ -31,6 +41,12 @@ func main() {
 		encodeResponse,
 	)
 
+	hasPublicKeyHandler := httptransport.NewServer(
+		makeHasPublicKeyEndpoint(svc, conf, db),
+		decodePublicKeyRequest,
+		encodeResponse,
+	)
+
 	// Account Info
 	accountInfoHandler := httptransport.NewServer(
 		makeAccountInfoEndpoint(svc, conf, db),
@@ -58,16 +74,36 @@ func main() {
 		decodeModifyRequest,
 		encodeResponse,
 	)
+	// Sessions
+	refreshHandler := httptransport.NewServer(
+		makeRefreshEndpoint(svc, conf, db),
+		decodeTokenRequest,
+		encodeResponse,
+	)
+	logoutHandler := httptransport.NewServer(
+		makeLogoutEndpoint(svc, conf, db),
+		decodeTokenRequest,
+		encodeResponse,
+	)
+	logoutAllHandler := httptransport.NewServer(
+		makeLogoutAllEndpoint(svc, conf, db),
+		decodeTokenRequest,
+		encodeResponse,
+	)
 	/*
 		- ModifyPermissionsGroups
 	*/
 
 	log.Println("Registering endpoint handlers")
 	http.Handle("/auth", authHandler)
+	http.Handle("/haskey", hasPublicKeyHandler)
 	http.Handle("/accountinfo", accountInfoHandler)
 	http.Handle("/modify", modifyHandler)
 	http.Handle("/register", accountRegistrationHandler)
 	http.Handle("/search", searchHandler)
+	http.Handle("/refresh", refreshHandler)
+	http.Handle("/logout", logoutHandler)
+	http.Handle("/logout-all", logoutAllHandler)
 
 	log.Println("Listening for connections...")
 	err = http.ListenAndServe(conf.Server.Interface+":"+conf.Server.Port, nil)
@@ -1,30 +1,38 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
 	"errors"
 	"github.com/badoux/checkmail"
 	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/crypt"
 	"github.com/yamamushi/kmud-2020/database"
 	"github.com/yamamushi/kmud-2020/types"
 	"github.com/yamamushi/kmud-2020/utils"
 	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/ssh"
 	"log"
 	"strings"
 )
 
 type AccountManagerService interface {
-	Auth(string, string, string, *config.Config, *database.DatabaseHandler) (string, error)
+	Auth(string, string, string, string, *config.Config, *database.DatabaseHandler) (string, error)
+	HasPublicKey(string, string, string, *config.Config, *database.DatabaseHandler) error
 	AccountInfo(string, string, string, *config.Config, *database.DatabaseHandler) (types.Account, error)
 	AccountRegistration(string, string, string, string, *config.Config, *database.DatabaseHandler) error
 	Modify(string, string, types.Account, *config.Config, *database.DatabaseHandler) (types.Account, error)
 	Search(string, string, types.Account, *config.Config, *database.DatabaseHandler) ([]types.Account, error)
+	Refresh(string, string, *config.Config, *database.DatabaseHandler) (string, error)
+	Logout(string, string, *config.Config, *database.DatabaseHandler) error
+	LogoutAll(string, string, *config.Config, *database.DatabaseHandler) error
 }
 
 type accountManagerService struct {
 }
 
-func (accountManagerService) Auth(secret string, username string, hashedpass string, conf *config.Config, DB *database.DatabaseHandler) (string, error) {
+// Auth checks the password, or the public key if one is given, and returns
+// a token for a new session
+func (accountManagerService) Auth(secret string, username string, hashedpass string, publickey string, conf *config.Config, DB *database.DatabaseHandler) (string, error) {
 
 	if secret != conf.Crypt.AccountManagerSecret {
 		return "", errors.New("unauthorized request")
@@ -40,29 +48,100 @@ func (accountManagerService) Auth(secret string, username string, hashedpass str
 		}
 	}
 	account = utils.BsonMapToAccount(result)
-	inputPass := hex.EncodeToString([]byte(hashedpass))
 
-	if inputPass != account.HashedPass {
-		return "", errors.New("invalid password")
-	}
-
-	if account.Token == "" {
-		token, err := utils.GetRandomToken()
+	if publickey != "" {
+		if !hasPublicKey(account.PublicKeys, publickey) {
+			return "", errors.New("invalid public key")
+		}
+	} else {
+		match, err := crypt.VerifyPassword(account.HashedPass, hashedpass)
 		if err != nil {
-			return "", errors.New("error creating user token: " + err.Error())
+			log.Println("Error: could not check password of " + username + ": " + err.Error())
+		}
+		if !match {
+			return "", errors.New("invalid password")
+		}
+
+		// Legacy passwords, and ones hashed with an old cost, are hashed
+		// again now that the password is known
+		if hasher, err := crypt.PasswordHasherFromConfig(conf); err == nil && hasher.NeedsRehash(account.HashedPass) {
+			rehashed, err := hasher.Hash(hashedpass)
+			if err != nil {
+				log.Println("Error: could not rehash password of " + username + ": " + err.Error())
+			} else {
+				account.HashedPass = rehashed
+			}
 		}
-		account.Token = token
 	}
 
+	// Tokens used to be stored on the account in the clear
+	account.Token = ""
+
 	err = DB.UpdateOne(bson.M{"username": username}, account, conf.DB.MongoDB, "accounts")
 	if err != nil {
 		return "", err
 	}
 
-	auth := account.Username + ":" + account.Token
+	auth, err := utils.CreateToken(account.Username, conf, DB)
+	if err != nil {
+		return "", err
+	}
 	return auth, utils.EmptyError()
 }
 
+// HasPublicKey returns an error unless the public key is registered with the
+// account, without starting a session
+func (accountManagerService) HasPublicKey(secret string, username string, publickey string, conf *config.Config, DB *database.DatabaseHandler) error {
+	if secret != conf.Crypt.AccountManagerSecret {
+		return errors.New("unauthorized request")
+	}
+
+	result, err := DB.FindOne(bson.M{"username": username}, conf.DB.MongoDB, "accounts")
+	if err != nil {
+		if err.Error() == "mongo: no documents in result" {
+			return errors.New("account not found")
+		}
+		return err
+	}
+
+	if !hasPublicKey(utils.BsonMapToAccount(result).PublicKeys, publickey) {
+		return errors.New("invalid public key")
+	}
+	return nil
+}
+
+// Refresh swaps a valid token for a new one with a new expiry, the old one
+// stops working
+func (accountManagerService) Refresh(secret string, token string, conf *config.Config, DB *database.DatabaseHandler) (string, error) {
+	account, err := utils.ValidateRequest(secret, token, "", "", conf, DB)
+	if err != nil {
+		return "", err
+	}
+
+	if err = utils.RevokeToken(token, conf, DB); err != nil {
+		return "", err
+	}
+	return utils.CreateToken(account.Username, conf, DB)
+}
+
+// Logout ends the session a token belongs to
+func (accountManagerService) Logout(secret string, token string, conf *config.Config, DB *database.DatabaseHandler) error {
+	if _, err := utils.ValidateRequest(secret, token, "", "", conf, DB); err != nil {
+		return err
+	}
+	return utils.RevokeToken(token, conf, DB)
+}
+
+// LogoutAll ends every session of the account a token belongs to, for when
+// one of them may have been stolen
+func (accountManagerService) LogoutAll(secret string, token string, conf *config.Config, DB *database.DatabaseHandler) error {
+	account, err := utils.ValidateRequest(secret, token, "", "", conf, DB)
+	if err != nil {
+		return err
+	}
+	return utils.RevokeAllTokens(account.Username, conf, DB)
+}
+
 func (accountManagerService) AccountInfo(secret string, token string, field string, conf *config.Config, DB *database.DatabaseHandler) (types.Account, error) {
 
 	accountStruct, err := utils.ValidateRequest(secret, token, "", "moderators", conf, DB)
@@ -147,8 +226,16 @@ func (accountManagerService) AccountRegistration(secret string, username string,
 		return errors.New("account with email " + email + " already exists")
 	}
 
-	hexPass := hex.EncodeToString([]byte(hashedpass))
-	err = DB.Insert(types.Account{Username: username, Email: email, HashedPass: hexPass, Locked: "false", RequirePasswordReset: "false", Permissions: []string{"user"}, Groups: []string{"default"}}, conf.DB.MongoDB, "accounts")
+	hasher, err := crypt.PasswordHasherFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	hash, err := hasher.Hash(hashedpass)
+	if err != nil {
+		return errors.New("could not hash password: " + err.Error())
+	}
+
+	err = DB.Insert(types.Account{Username: username, Email: email, HashedPass: hash, Locked: "false", RequirePasswordReset: "false", Permissions: []string{"user"}, Groups: []string{"default"}}, conf.DB.MongoDB, "accounts")
 	if err != nil {
 		return err
 	}
@@ -209,6 +296,13 @@ func (accountManagerService) Modify(secret string, token string, inputAccount ty
 	if inputAccount.Email != "" {
 		retrievedAccount.Email = inputAccount.Email
 	}
+	if len(inputAccount.PublicKeys) > 0 {
+		keys, err := normalizePublicKeys(inputAccount.PublicKeys)
+		if err != nil {
+			return types.Account{}, err
+		}
+		retrievedAccount.PublicKeys = keys
+	}
 
 	updatedAccount := utils.AccountToBson(retrievedAccount)
 
@@ -222,3 +316,33 @@ func (accountManagerService) Modify(secret string, token string, inputAccount ty
 
 	return retrievedAccount, utils.EmptyError()
 }
+
+// normalizePublicKeys checks that each key is in authorized_keys format and
+// drops their comments and options
+func normalizePublicKeys(keys []string) ([]string, error) {
+	var output []string
+	for _, key := range keys {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, errors.New("invalid public key: " + key)
+		}
+		output = append(output, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsed))))
+	}
+	return output, nil
+}
+
+// hasPublicKey returns true if key, in authorized_keys format, is one of keys
+func hasPublicKey(keys []string, key string) bool {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return false
+	}
+
+	for _, registered := range keys {
+		candidate, _, _, _, err := ssh.ParseAuthorizedKey([]byte(registered))
+		if err == nil && bytes.Equal(candidate.Marshal(), parsed.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
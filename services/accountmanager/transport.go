@@ -13,7 +13,7 @@ import (
 func makeAuthEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req := request.(types.AuthRequest)
-		token, err := svc.Auth(req.Secret, req.Username, req.HashedPass, conf, db)
+		token, err := svc.Auth(req.Secret, req.Username, req.HashedPass, req.PublicKey, conf, db)
 		if err != nil {
 			return types.AuthResponse{token, err.Error()}, nil
 		}
@@ -21,6 +21,16 @@ func makeAuthEndpoint(svc AccountManagerService, conf *config.Config, db *databa
 	}
 }
 
+func makeHasPublicKeyEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(types.PublicKeyRequest)
+		if err := svc.HasPublicKey(req.Secret, req.Username, req.PublicKey, conf, db); err != nil {
+			return types.PublicKeyResponse{Err: err.Error()}, nil
+		}
+		return types.PublicKeyResponse{}, nil
+	}
+}
+
 func makeAccountInfoEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req := request.(types.AccountInfoRequest)
@@ -53,6 +63,37 @@ func makeModifyEndpoint(svc AccountManagerService, conf *config.Config, db *data
 	}
 }
 
+func makeRefreshEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(types.TokenRequest)
+		token, err := svc.Refresh(req.Secret, req.Token, conf, db)
+		if err != nil {
+			return types.AuthResponse{Err: err.Error()}, nil
+		}
+		return types.AuthResponse{AuthToken: token}, nil
+	}
+}
+
+func makeLogoutEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(types.TokenRequest)
+		if err := svc.Logout(req.Secret, req.Token, conf, db); err != nil {
+			return types.LogoutResponse{Err: err.Error()}, nil
+		}
+		return types.LogoutResponse{}, nil
+	}
+}
+
+func makeLogoutAllEndpoint(svc AccountManagerService, conf *config.Config, db *database.DatabaseHandler) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(types.TokenRequest)
+		if err := svc.LogoutAll(req.Secret, req.Token, conf, db); err != nil {
+			return types.LogoutResponse{Err: err.Error()}, nil
+		}
+		return types.LogoutResponse{}, nil
+	}
+}
+
 func decodeAuthRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	var request types.AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -61,6 +102,14 @@ func decodeAuthRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return request, nil
 }
 
+func decodePublicKeyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var request types.PublicKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
 func decodeAccountInfoRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	var request types.AccountInfoRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -93,6 +142,14 @@ func decodeSearchRequest(_ context.Context, r *http.Request) (interface{}, error
 	return request, nil
 }
 
+func decodeTokenRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var request types.TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	return json.NewEncoder(w).Encode(response)
 }
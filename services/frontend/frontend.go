@@ -3,6 +3,7 @@ package main
 // Default necessary imports from kmud-2020 libraries
 import (
 	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/session"
 	"github.com/yamamushi/kmud-2020/telnet"
 	"github.com/yamamushi/kmud-2020/utils"
 )
@@ -21,8 +22,26 @@ func main() {
 	// Here we create our server object using the provided configuration file.
 	s := telnet.NewServer(conf)
 
+	// SSH clients log in before they reach the menu, with their password or
+	// a public key registered with their account
+	s.SetSSHAuthenticator(accountLogin{conf: conf})
+
+	// Once everyone has been disconnected on shutdown, players whose sessions
+	// haven't ended by the drain deadline are logged out
+	s.OnShutdown(session.Shutdown)
+
+	// kill -USR2 restarts the server from its binary without dropping the
+	// players connected over plain telnet
+	go s.HandleCopyoverSignal()
+
 	// We execute the server using a func(c *telnetserver.ConnectionHandler) function
 	// The provided function will run in a goroutine and is expected to handle
 	// All connections (the functionality will vary depending on the service)
-	s.Run(mainMenu, conf)
+	// SIGINT or SIGTERM warns everyone and disconnects them before exiting.
+	runner := func(c *telnet.ConnectionHandler, term *telnet.Terminal, conf *config.Config) {
+		mainMenu(s, c, term, conf)
+	}
+	if err = s.RunContext(utils.InterruptContext(), runner, conf); err != nil {
+		utils.HandleError(err)
+	}
 }
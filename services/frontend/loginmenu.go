@@ -17,27 +17,52 @@ import (
 	"time"
 )
 
-func mainMenu(c *telnet.ConnectionHandler, term *telnet.Terminal, conf *config.Config) {
+func mainMenu(s *telnet.Server, c *telnet.ConnectionHandler, term *telnet.Terminal, conf *config.Config) {
+	// The account's session ends with the connection, a copyover doesn't
+	// return from here so its token carries on working
+	defer func() {
+		if c.Authenticated() {
+			if err := crypt.Logout(c.AuthToken(), conf); err != nil {
+				log.Println("Error: logout failed with error: " + err.Error())
+			}
+		}
+	}()
+
 	// Menu is a helper set of utilities
 	// For drawing an interactive menuing system
 	utils.ExecMenu(
 		conf.Frontend.Title,
 		c,
 		func(menu *utils.Menu) {
-			menu.AddAction("l", "Login", func() {
-				_, err := loginUserHandler(c.GetConn(), conf)
-				if err == nil {
+			// SSH clients are already logged in
+			if !c.Authenticated() {
+				menu.AddAction("l", "Login", func() {
+					auth, err := loginUserHandler(c.GetConn(), conf)
+					if err == nil {
+						c.SetAuthToken(auth.AuthToken)
+					} else if err == errTooManyLogins {
+						menu.Exit()
+					}
+				})
+			}
 
-				}
-			})
+			// Accounts listed in the security config's admins
+			if c.Admin() {
+				menu.AddAction("a", "Admin", func() {
+					s.AdminMenu(c)
+				})
+			}
 
-			menu.AddAction("n", "Nyan", func() {
-				term.Nyan()
-			})
+			if !c.ScreenReader() {
+				menu.AddAction("n", "Nyan", func() {
+					term.Nyan()
+				})
+			}
 
 			menu.AddAction("t", "Testing", func() {
+				columns, _ := term.Size()
 				term.Refresh()
-				term.MoveCursor(0, (term.ColI/2)-10)
+				term.MoveCursor(0, (columns/2)-10)
 			})
 			menu.AddAction("c", "refresh", func() {
 				term.Refresh()
@@ -57,8 +82,15 @@ func mainMenu(c *telnet.ConnectionHandler, term *telnet.Terminal, conf *config.C
 		})
 }
 
+var errTooManyLogins = errors.New("too many failed logins")
+
 // Login Menu
+// Failed logins are counted against the client's address, so each one makes
+// the next attempt wait longer even after reconnecting.
 func loginUserHandler(wc *telnet.WrappedConnection, conf *config.Config) (auth types.AuthResponse, err error) {
+	access := wc.Access()
+	addr := wc.RemoteAddr().String()
+
 	for {
 		username := utils.GetUserInput(wc, "Username: ", color.ModeNone)
 
@@ -66,26 +98,31 @@ func loginUserHandler(wc *telnet.WrappedConnection, conf *config.Config) (auth t
 			return types.AuthResponse{}, errors.New("no username provided")
 		}
 
-		attempts := 1
 		wc.WillEcho()
-		for {
+		for attempts := 1; ; attempts++ {
+			if delay := access.LoginDelay(addr); delay > 0 {
+				utils.WriteLine(wc, "Too many failed logins, please wait "+delay.Round(time.Second).String(), color.ModeNone)
+				time.Sleep(delay)
+			}
+
 			password := utils.GetRawUserInputSuffix(wc, "Password: ", "\r\n", color.ModeNone)
 			auth, ok := crypt.GetAuthToken(username, password, conf)
-			if !ok {
-				utils.WriteLine(wc, "Invalid password", color.ModeNone)
-			} else {
+			if ok {
+				access.LoginSucceeded(addr)
 				wc.WontEcho()
 				//utils.WriteLine(wc, "Welcome "+username+" to "+conf.Game.ServerName, types.ModeNone)
 				return auth, nil
 			}
 
-			if attempts >= 3 {
-				utils.WriteLine(wc, "Too many failed loginUserHandler attempts", color.ModeNone)
-				_ = wc.Close()
-				log.Println("User booted user due to too many failed logins (" + username + ")")
+			access.LoginFailed(addr)
+			utils.WriteLine(wc, "Invalid password", color.ModeNone)
+
+			if attempts >= access.LoginAttempts() {
+				wc.WontEcho()
+				utils.WriteLine(wc, "Too many failed login attempts", color.ModeNone)
+				log.Println("Disconnecting " + addr + " due to too many failed logins (" + username + ")")
+				return types.AuthResponse{}, errTooManyLogins
 			}
-			attempts++
-			time.Sleep(2 * time.Second)
 		}
 	}
 }
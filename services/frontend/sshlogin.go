@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/crypt"
+	"github.com/yamamushi/kmud-2020/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// accountLogin checks SSH logins with the accountmanager
+type accountLogin struct {
+	conf *config.Config
+}
+
+func (a accountLogin) PasswordLogin(username string, password string) (string, error) {
+	return authTokenOrError(crypt.GetAuthToken(username, password, a.conf))
+}
+
+func (a accountLogin) PublicKeyRegistered(username string, key ssh.PublicKey) error {
+	return crypt.HasPublicKey(username, authorizedKey(key), a.conf)
+}
+
+func (a accountLogin) PublicKeyLogin(username string, key ssh.PublicKey) (string, error) {
+	return authTokenOrError(crypt.GetAuthTokenForKey(username, authorizedKey(key), a.conf))
+}
+
+// authorizedKey returns key in authorized_keys format, as the accountmanager
+// takes it
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func authTokenOrError(auth types.AuthResponse, ok bool) (string, error) {
+	if ok {
+		return auth.AuthToken, nil
+	}
+	if auth.Err != "" {
+		return "", errors.New(auth.Err)
+	}
+	return "", errors.New("login failed")
+}
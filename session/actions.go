@@ -258,7 +258,8 @@ var actions = map[string]action{
 				names := make([]string, len(items))
 				for i, item := range items {
 					template := model.GetTemplate(item.GetTemplateId())
-					names[i] = fmt.Sprintf("%s (%v)", item.GetName(), template.GetWeight())
+					name := color.Link(item.GetName(), "drop "+item.GetName(), "Drop "+item.GetName())
+					names[i] = fmt.Sprintf("%s (%v)", name, template.GetWeight())
 				}
 				s.WriteLinef("You are carrying: %s", strings.Join(names, ", "))
 			}
@@ -11,10 +11,17 @@ import (
 	"github.com/yamamushi/kmud-2020/combat"
 	"github.com/yamamushi/kmud-2020/engine"
 	"github.com/yamamushi/kmud-2020/model"
+	"github.com/yamamushi/kmud-2020/telnet"
 	"github.com/yamamushi/kmud-2020/types"
 	"github.com/yamamushi/kmud-2020/utils"
 )
 
+// accessControlled is implemented by connections that can reach the server's
+// access control (telnet.WrappedConnection)
+type accessControlled interface {
+	Access() *telnet.AccessControl
+}
+
 type command struct {
 	admin bool
 	alias string
@@ -46,7 +53,7 @@ func init() {
 						}
 					}
 					sort.Strings(names)
-					width, height := s.user.GetWindowSize()
+					width, height := s.GetWindowSize()
 
 					pages := utils.Paginate(names, width, height/2)
 
@@ -111,7 +118,7 @@ func init() {
 						})
 
 						menu.AddAction("d", "Description", func() {
-							description := s.getRawUserInput("Enter new description: ")
+							description := s.getRawUserInput("Enter new description (see /colors for color codes): ")
 							if description != "" {
 								s.GetRoom().SetDescription(description)
 							}
@@ -162,7 +169,7 @@ func init() {
 					roomsByLocation[room.GetLocation()] = room
 				}
 
-				width, height := s.user.GetWindowSize()
+				width, height := s.GetWindowSize()
 				height /= 2
 				width /= 2
 
@@ -171,6 +178,11 @@ func init() {
 				width += (width % 2) - 1
 				height += (height % 2) - 1
 
+				if s.ScreenReader() {
+					s.WriteLine(describeMap(s.GetRoom(), roomsByLocation, width, height))
+					return
+				}
+
 				builder := newMapBuilder(width, height, 1)
 				builder.setUserRoom(s.GetRoom())
 				center := s.GetRoom().GetLocation()
@@ -364,11 +376,35 @@ func init() {
 				s.WriteLineColor(color.Black, "Black")
 				s.WriteLineColor(color.White, "White")
 				s.WriteLineColor(color.Gray, "Gray")
+
+				s.WriteLine("")
+				s.WriteLine("256 colors, @(n) in the foreground and @[n] in the background:")
+				for row := 0; row < 16; row++ {
+					line := ""
+					for column := 0; column < 16; column++ {
+						index := uint8(row*16 + column)
+						line += color.Colorize(color.Background(color.Xterm(index)), "  ")
+					}
+					s.Write(line + "\r\n")
+				}
+
+				s.WriteLine("")
+				s.WriteLine("Truecolor, @(#rrggbb) in the foreground and @[#rrggbb] in the background:")
+				line := ""
+				for i := 0; i < 64; i++ {
+					level := uint8(i * 4)
+					line += color.Colorize(color.Background(color.RGB(level, 0, 255-level)), " ")
+				}
+				s.Write(line + "\r\n")
+
+				s.WriteLine("")
+				s.WriteLine("Colors sent to your client: %s", s.colorDepth())
 			},
 		},
 		"cm": cAlias("colormode"),
 		"colormode": {
 			admin: false,
+			usage: "/colormode [none|light|dark|auto|16|256|truecolor]",
 			exec: func(c *command, s *Session, arg string) {
 				if arg == "" {
 					message := "Current color mode is: "
@@ -381,6 +417,12 @@ func init() {
 						message = message + "Dark"
 					}
 					s.WriteLine(message)
+
+					message = "Current color depth is: " + s.colorDepth().String()
+					if s.user.GetColorDepth() == color.DepthAuto {
+						message = message + " (detected)"
+					}
+					s.WriteLine(message)
 				} else {
 					switch strings.ToLower(arg) {
 					case "none":
@@ -392,10 +434,167 @@ func init() {
 					case "dark":
 						s.user.SetColorMode(color.ModeDark)
 						s.WriteLine("Color mode set to: Dark")
+					case "auto", "16", "256", "truecolor":
+						depths := map[string]color.ColorDepth{
+							"auto":      color.DepthAuto,
+							"16":        color.Depth16,
+							"256":       color.Depth256,
+							"truecolor": color.DepthTrueColor,
+						}
+						s.user.SetColorDepth(depths[strings.ToLower(arg)])
+						s.applyColorDepth()
+						s.WriteLine("Color depth set to: " + s.colorDepth().String())
 					default:
 						s.WriteLine("Valid color modes are: None, Light, Dark")
+						s.WriteLine("Valid color depths are: Auto, 16, 256, Truecolor")
+					}
+				}
+			},
+		},
+		"access": {
+			admin: true,
+			usage: "/access [list|allow <address>|deny <address>|remove <address>]",
+			exec: func(c *command, s *Session, arg string) {
+				controlled, ok := s.conn.(accessControlled)
+				if !ok || controlled.Access() == nil {
+					s.WriteLine("Access control isn't available on this connection")
+					return
+				}
+				access := controlled.Access()
+
+				subcommand, address := utils.Argify(arg)
+				var err error
+
+				switch strings.ToLower(subcommand) {
+				case "", "list":
+					allow, deny := access.Rules()
+					if len(allow) == 0 {
+						s.WriteLine("Allowed: everyone not denied")
+					} else {
+						s.WriteLine("Allowed: " + strings.Join(allow, ", "))
+					}
+					if len(deny) == 0 {
+						s.WriteLine("Denied: nobody")
+					} else {
+						s.WriteLine("Denied: " + strings.Join(deny, ", "))
+					}
+					return
+				case "allow":
+					err = access.Allow(address)
+				case "deny":
+					err = access.Deny(address)
+				case "remove":
+					err = access.RemoveRule(address)
+				default:
+					c.Usage(s)
+					return
+				}
+
+				if err != nil {
+					s.printError(err.Error())
+				} else {
+					s.WriteLine("Access rules updated")
+				}
+			},
+		},
+		"snoop": {
+			admin: true,
+			usage: "/snoop [<player>|off]",
+			exec: func(c *command, s *Session, arg string) {
+				switch strings.ToLower(arg) {
+				case "":
+					if target := s.snoopTarget(); target != nil {
+						s.WriteLine("Snooping on " + target.pc.GetName())
+					} else {
+						s.WriteLine("You aren't snooping on anyone")
+					}
+				case "off":
+					if s.snoopTarget() == nil {
+						s.WriteLine("You aren't snooping on anyone")
+						return
+					}
+					s.stopSnoop()
+					s.WriteLine("Snoop ended")
+				default:
+					target := findSession(arg)
+					if target == nil {
+						s.printError("Player not found: %s", arg)
+						return
+					}
+					if target == s {
+						s.printError("You can't snoop on yourself")
+						return
+					}
+					if err := s.startSnoop(target); err != nil {
+						s.printError("Can't snoop on %s: %s", target.pc.GetName(), err.Error())
+						return
+					}
+					s.WriteLine("Snooping on " + target.pc.GetName() + ", /snoop off to stop")
+				}
+			},
+		},
+		"record": {
+			admin: false,
+			usage: "/record [on|off]",
+			exec: func(c *command, s *Session, arg string) {
+				conn, ok := s.conn.(recorder)
+				if !ok {
+					s.WriteLine("This connection can't be recorded")
+					return
+				}
+
+				switch strings.ToLower(arg) {
+				case "":
+					if conn.Recording() {
+						s.WriteLine("This session is being recorded")
+					} else {
+						s.WriteLine("This session isn't being recorded")
 					}
+				case "on":
+					if _, err := conn.StartRecording(s.pc.GetName()); err != nil {
+						s.printError(err.Error())
+					} else {
+						s.WriteLine("Recording this session, /record off to stop")
+					}
+				case "off":
+					if err := conn.StopRecording(); err != nil {
+						s.printError(err.Error())
+					} else {
+						s.WriteLine("Recording stopped")
+					}
+				default:
+					c.Usage(s)
+				}
+			},
+		},
+		"screenreader": {
+			admin: false,
+			usage: "/screenreader [on|off|auto]",
+			exec: func(c *command, s *Session, arg string) {
+				modes := map[string]types.ScreenReaderMode{
+					"auto": types.ScreenReaderAuto,
+					"on":   types.ScreenReaderOn,
+					"off":  types.ScreenReaderOff,
+				}
+
+				if arg != "" {
+					mode, found := modes[strings.ToLower(arg)]
+					if !found {
+						c.Usage(s)
+						return
+					}
+					s.user.SetScreenReaderMode(mode)
+					s.applyScreenReaderMode()
+				}
+
+				message := "Screen reader mode is off"
+				if s.ScreenReader() {
+					message = "Screen reader mode is on"
+				}
+				if s.user.GetScreenReaderMode() == types.ScreenReaderAuto {
+					message = message + " (detected)"
 				}
+				s.WriteLine(message)
 			},
 		},
 		"dr": cAlias("destroyroom"),
@@ -523,7 +722,7 @@ func init() {
 		"windowsize": {
 			admin: false,
 			exec: func(c *command, s *Session, arg string) {
-				width, height := s.user.GetWindowSize()
+				width, height := s.GetWindowSize()
 
 				header := fmt.Sprintf("Width: %v, Height: %v", width, height)
 
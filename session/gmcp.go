@@ -0,0 +1,95 @@
+package session
+
+import (
+	"strings"
+
+	"github.com/yamamushi/kmud-2020/color"
+	"github.com/yamamushi/kmud-2020/events"
+	"github.com/yamamushi/kmud-2020/model"
+	"github.com/yamamushi/kmud-2020/types"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+// gmcpWriter is implemented by connections that can carry GMCP packages
+// (telnet.WrappedConnection for instance)
+type gmcpWriter interface {
+	SendGMCP(pkg string, data interface{}) error
+}
+
+// SendGMCP pushes a GMCP package to the client. It is a no-op for connections
+// that don't support GMCP.
+func (s *Session) SendGMCP(message types.GMCPMessage) {
+	writer, ok := s.conn.(gmcpWriter)
+	if !ok {
+		return
+	}
+
+	utils.HandleError(writer.SendGMCP(message.Package(), message))
+}
+
+// SendCharVitals sends the player's current hitpoints as Char.Vitals
+func (s *Session) SendCharVitals() {
+	s.SendGMCP(types.GMCPCharVitals{
+		HP:    s.pc.GetHitPoints(),
+		MaxHP: s.pc.GetHealth(),
+	})
+}
+
+// SendRoomInfo sends the given room as Room.Info
+func (s *Session) SendRoomInfo(room types.Room) {
+	info := types.GMCPRoomInfo{
+		Num:   room.GetId().String(),
+		Name:  room.GetTitle(),
+		Exits: roomExits(room),
+	}
+
+	location := room.GetLocation()
+	info.Coordinates = []int{location.X, location.Y, location.Z}
+
+	if room.GetAreaId() != nil {
+		if area := model.GetArea(room.GetAreaId()); area != nil {
+			info.Area = area.GetName()
+		}
+	}
+
+	if zone := model.GetZone(room.GetZoneId()); zone != nil {
+		info.Zone = zone.GetName()
+	}
+
+	s.SendGMCP(info)
+}
+
+// roomExits maps each of the room's exit directions to the id of the room it leads to
+func roomExits(room types.Room) map[string]string {
+	exits := map[string]string{}
+	for _, direction := range room.GetExits() {
+		next := model.GetRoomByLocation(room.NextLocation(direction), room.GetZoneId())
+		if next != nil {
+			exits[strings.ToLower(direction.ToString())] = next.GetId().String()
+		}
+	}
+	return exits
+}
+
+// SendCommChannel sends a line of chat as Comm.Channel
+func (s *Session) SendCommChannel(channel string, player string, message string) {
+	s.SendGMCP(types.GMCPCommChannel{
+		Channel: channel,
+		Player:  player,
+		Message: color.StripColors(message),
+	})
+}
+
+// reportEvent forwards events that have an out of band representation
+func (s *Session) reportEvent(event events.Event) {
+	switch e := event.(type) {
+	case events.SayEvent:
+		s.SendCommChannel("say", e.Character.GetName(), e.ToString(s.pc))
+	case events.TellEvent:
+		s.SendCommChannel("tell", e.From.GetName(), e.ToString(s.pc))
+	case events.BroadcastEvent:
+		s.SendCommChannel("broadcast", e.Character.GetName(), e.ToString(s.pc))
+	case events.CombatEvent:
+		s.reportVitals()
+	}
+}
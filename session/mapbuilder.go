@@ -1,6 +1,10 @@
 package session
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	color2 "github.com/yamamushi/kmud-2020/color"
 	"github.com/yamamushi/kmud-2020/types"
 	"github.com/yamamushi/kmud-2020/utils"
@@ -173,3 +177,85 @@ func (t *mapTile) addExit(dir types.Direction) {
 		panic("Unexpected direction given to mapTile::addExit()")
 	}
 }
+
+// maxNearbyRooms is the most rooms describeMap lists besides the exits
+const maxNearbyRooms = 8
+
+// describeMap describes the map around the user's room for screen readers: where
+// each exit leads, then the nearest other rooms on the same level
+func describeMap(room types.Room, roomsByLocation map[types.Coordinate]types.Room, width int, height int) string {
+	center := room.GetLocation()
+	lines := []string{fmt.Sprintf("You are in %s.", room.GetTitle())}
+
+	exits := room.GetExits()
+	if len(exits) == 0 {
+		lines = append(lines, "There are no exits.")
+	}
+
+	for _, dir := range exits {
+		name := strings.ToLower(dir.ToString())
+		if next := roomsByLocation[room.NextLocation(dir)]; next != nil {
+			lines = append(lines, fmt.Sprintf("The exit %s leads to %s.", name, next.GetTitle()))
+		} else {
+			lines = append(lines, fmt.Sprintf("The exit %s leads off the map.", name))
+		}
+	}
+
+	var nearby []types.Room
+	for loc, other := range roomsByLocation {
+		dx, dy := loc.X-center.X, loc.Y-center.Y
+		if loc.Z != center.Z || (dx == 0 && dy == 0) ||
+			utils.Abs(dx) > width/2 || utils.Abs(dy) > height/2 {
+			continue
+		}
+		nearby = append(nearby, other)
+	}
+
+	distance := func(other types.Room) int {
+		loc := other.GetLocation()
+		dx, dy := loc.X-center.X, loc.Y-center.Y
+		return dx*dx + dy*dy
+	}
+
+	sort.Slice(nearby, func(i, j int) bool {
+		if distance(nearby[i]) != distance(nearby[j]) {
+			return distance(nearby[i]) < distance(nearby[j])
+		}
+		return nearby[i].GetTitle() < nearby[j].GetTitle()
+	})
+
+	if len(nearby) == 0 {
+		lines = append(lines, "There are no other rooms nearby.")
+	} else if len(nearby) > maxNearbyRooms {
+		nearby = nearby[:maxNearbyRooms]
+	}
+
+	for _, other := range nearby {
+		loc := other.GetLocation()
+		lines = append(lines, fmt.Sprintf("%s is %s.", other.GetTitle(), describeOffset(loc.X-center.X, loc.Y-center.Y)))
+	}
+
+	return strings.Join(lines, "\r\n")
+}
+
+// describeOffset describes how far away a room is in words, such as
+// "2 north and 1 east"
+func describeOffset(dx int, dy int) string {
+	var parts []string
+
+	switch {
+	case dy < 0:
+		parts = append(parts, fmt.Sprintf("%v north", -dy))
+	case dy > 0:
+		parts = append(parts, fmt.Sprintf("%v south", dy))
+	}
+
+	switch {
+	case dx > 0:
+		parts = append(parts, fmt.Sprintf("%v east", dx))
+	case dx < 0:
+		parts = append(parts, fmt.Sprintf("%v west", -dx))
+	}
+
+	return strings.Join(parts, " and ")
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"github.com/yamamushi/kmud-2020/model"
+	"github.com/yamamushi/kmud-2020/telnet"
+	"github.com/yamamushi/kmud-2020/types"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+func init() {
+	telnet.RegisterMSDPVariable("HEALTH", "HEALTH_MAX", "ROOM_NAME", "ROOM_EXITS", "WORLD_TIME")
+}
+
+// msdpWriter is implemented by connections that can carry MSDP variables
+type msdpWriter interface {
+	SetMSDPVariable(name string, value interface{}) error
+}
+
+// SetMSDPVariable updates an MSDP variable for this session's client. It is a
+// no-op for connections that don't support MSDP.
+func (s *Session) SetMSDPVariable(name string, value interface{}) {
+	writer, ok := s.conn.(msdpWriter)
+	if !ok {
+		return
+	}
+
+	utils.HandleError(writer.SetMSDPVariable(name, value))
+}
+
+// reportVitals sends the player's hitpoints over every out of band protocol
+func (s *Session) reportVitals() {
+	s.SendCharVitals()
+	s.SetMSDPVariable("HEALTH", s.pc.GetHitPoints())
+	s.SetMSDPVariable("HEALTH_MAX", s.pc.GetHealth())
+}
+
+// reportRoom sends the player's current room over every out of band protocol
+func (s *Session) reportRoom(room types.Room) {
+	s.SendRoomInfo(room)
+	s.SetMSDPVariable("ROOM_NAME", room.GetTitle())
+	s.SetMSDPVariable("ROOM_EXITS", roomExits(room))
+}
+
+// reportTime sends the current world time to MSDP clients, it is only pushed
+// when it has actually changed
+func (s *Session) reportTime() {
+	s.SetMSDPVariable("WORLD_TIME", model.GetWorld().GetTime().String())
+}
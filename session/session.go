@@ -15,6 +15,7 @@ import (
 	// "log"
 	// "os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -36,6 +37,15 @@ type Session struct {
 	replyId    types.Id
 	lastInput  string
 
+	// snoopChannel carries lines from the player this admin is snooping on
+	snoopChannel chan string
+	snoopLock    sync.Mutex
+	snooping     *snooper
+
+	// logoutOnce stops a player being logged out twice when Shutdown gives up
+	// waiting on their session
+	logoutOnce sync.Once
+
 	// logger *log.Logger
 }
 
@@ -53,6 +63,7 @@ func NewSession(conn io.ReadWriter, user types.User, pc types.PC) *Session {
 	session.prompterChannel = make(chan utils.Prompter)
 	session.panicChannel = make(chan interface{})
 	session.eventChannel = events.Register(pc)
+	session.snoopChannel = make(chan string, snoopBuffer)
 
 	session.silentMode = false
 
@@ -75,10 +86,22 @@ const (
 
 func (s *Session) Exec() {
 	defer events.Unregister(s.pc)
-	defer model.Logout(s.pc)
+	defer s.logout()
+
+	registerSession(s)
+	defer unregisterSession(s)
+
+	s.applyColorDepth()
+	s.applyScreenReaderMode()
+
+	if c, ok := s.conn.(completer); ok {
+		c.SetCompleter(s.complete)
+		defer c.SetCompleter(nil)
+	}
 
 	s.WriteLine("Welcome, " + s.pc.GetName())
 	s.PrintRoom()
+	s.reportVitals()
 
 	// Main routine in charge of actually reading input from the connection object,
 	// also has built in throttling to limit how fast we are allowed to process
@@ -168,10 +191,104 @@ func (s *Session) GetInput(prompt string) string {
 	return s.getUserInput(CleanUserInput, prompt)
 }
 
+// windowSizer is implemented by connections that track the client's window
+// size as it is resized (telnet.WrappedConnection for instance)
+type windowSizer interface {
+	WindowSize() (int, int)
+}
+
+// GetWindowSize returns the current size of the client's window, updating the
+// user's stored size if the connection reported a new one
 func (s *Session) GetWindowSize() (int, int) {
+	if sizer, ok := s.conn.(windowSizer); ok {
+		if width, height := sizer.WindowSize(); width > 0 && height > 0 {
+			s.user.SetWindowSize(width, height)
+		}
+	}
+
 	return s.user.GetWindowSize()
 }
 
+// colorDepther is implemented by connections that know how many colors the
+// client can show, and let the user override it
+type colorDepther interface {
+	ColorDepth() color.ColorDepth
+	SetColorDepth(color.ColorDepth)
+}
+
+// applyColorDepth passes the user's color depth setting on to the connection
+func (s *Session) applyColorDepth() {
+	if depther, ok := s.conn.(colorDepther); ok {
+		depther.SetColorDepth(s.user.GetColorDepth())
+	}
+}
+
+// colorDepth returns the number of colors used for the user's client
+func (s *Session) colorDepth() color.ColorDepth {
+	if depther, ok := s.conn.(colorDepther); ok {
+		return depther.ColorDepth()
+	}
+	return color.Depth16
+}
+
+// screenReaderConn is implemented by connections that know whether the client
+// has a screen reader, and let the user override it
+type screenReaderConn interface {
+	ScreenReader() bool
+	SetScreenReaderMode(types.ScreenReaderMode)
+}
+
+// applyScreenReaderMode passes the user's screen reader setting on to the
+// connection
+func (s *Session) applyScreenReaderMode() {
+	if conn, ok := s.conn.(screenReaderConn); ok {
+		conn.SetScreenReaderMode(s.user.GetScreenReaderMode())
+	}
+}
+
+// ScreenReader returns whether the user is sent output suited to screen
+// readers, menus check for it
+func (s *Session) ScreenReader() bool {
+	if conn, ok := s.conn.(screenReaderConn); ok {
+		return conn.ScreenReader()
+	}
+	return s.user.GetScreenReaderMode() == types.ScreenReaderOn
+}
+
+// completer is implemented by connections that can tab complete input
+// (telnet.WrappedConnection in character mode for instance)
+type completer interface {
+	SetCompleter(func(line string) []string)
+}
+
+// complete returns the possible completions of the last word of line: command
+// names after a "/", action names and exits for the first word, and the
+// characters and items at hand for the rest
+func (s *Session) complete(line string) []string {
+	words := strings.Split(line, " ")
+
+	var candidates []string
+	switch {
+	case len(words) == 1 && strings.HasPrefix(line, "/"):
+		for name := range commands {
+			candidates = append(candidates, "/"+name)
+		}
+	case len(words) == 1:
+		for name := range actions {
+			candidates = append(candidates, name)
+		}
+		for _, exit := range s.GetRoom().GetExits() {
+			candidates = append(candidates, strings.ToLower(exit.ToString()))
+		}
+	default:
+		candidates = append(candidates, model.CharactersIn(s.pc.GetRoomId()).Names()...)
+		candidates = append(candidates, model.ItemsIn(s.pc.GetRoomId()).Names()...)
+		candidates = append(candidates, model.ItemsIn(s.pc.GetId()).Names()...)
+	}
+
+	return candidates
+}
+
 // getUserInput allows us to retrieve user input in a way that doesn't block the
 // event loop by using channels and a separate Go routine to grab
 // either the next user input or the next event.
@@ -192,6 +309,8 @@ func (s *Session) getUserInputP(inputMode userInputMode, prompter utils.Prompter
 			case events.TellEvent:
 				s.replyId = e.From.GetId()
 			case events.TickEvent:
+				s.reportTime()
+
 				if !combat.InCombat(s.pc) {
 					oldHps := s.pc.GetHitPoints()
 					s.pc.Heal(5)
@@ -200,16 +319,22 @@ func (s *Session) getUserInputP(inputMode userInputMode, prompter utils.Prompter
 					if oldHps != newHps {
 						s.clearLine()
 						s.Write(prompter.GetPrompt())
+						s.reportVitals()
 					}
 				}
 			}
 
+			s.reportEvent(event)
+
 			message := event.ToString(s.pc)
 			if message != "" {
 				s.asyncMessage(message)
 				s.Write(prompter.GetPrompt())
 			}
 
+		case line := <-s.snoopChannel:
+			s.showSnoopLine(line, prompter.GetPrompt())
+
 		case quitMessage := <-s.panicChannel:
 			panic(quitMessage)
 		}
@@ -339,7 +464,9 @@ func (s *Session) GetRoom() types.Room {
 }
 
 func (s *Session) PrintRoom() {
-	s.printRoom(s.GetRoom())
+	room := s.GetRoom()
+	s.printRoom(room)
+	s.reportRoom(room)
 }
 
 func (s *Session) printRoom(room types.Room) {
@@ -360,13 +487,26 @@ func (s *Session) printRoom(room types.Room) {
 		areaStr = fmt.Sprintf("%s - ", area.GetName())
 	}
 
-	str = fmt.Sprintf("\r\n %v>>> %v%s%s %v<<< %v(%v %v %v)\r\n\r\n %v%s\r\n\r\n",
-		color.White, color.Blue,
-		areaStr, room.GetTitle(),
-		color.White, color.Blue,
-		room.GetLocation().X, room.GetLocation().Y, room.GetLocation().Z,
-		color.White,
-		room.GetDescription())
+	screenReader := s.ScreenReader()
+
+	// Descriptions may set colors of their own, reset them afterwards
+	if screenReader {
+		str = fmt.Sprintf("\r\n %v%s%s.\r\n\r\n %v%s%v\r\n\r\n",
+			color.Blue,
+			areaStr, room.GetTitle(),
+			color.White,
+			room.GetDescription(),
+			color.Normal)
+	} else {
+		str = fmt.Sprintf("\r\n %v>>> %v%s%s %v<<< %v(%v %v %v)\r\n\r\n %v%s%v\r\n\r\n",
+			color.White, color.Blue,
+			areaStr, room.GetTitle(),
+			color.White, color.Blue,
+			room.GetLocation().X, room.GetLocation().Y, room.GetLocation().Z,
+			color.White,
+			room.GetDescription(),
+			color.Normal)
+	}
 
 	if store != nil {
 		str = fmt.Sprintf("%s Store: %s\r\n\r\n", str, color.Colorize(color.Blue, store.GetName()))
@@ -420,10 +560,11 @@ func (s *Session) printRoom(room types.Room) {
 
 		var names []string
 		for _, name := range nameList {
+			text := name
 			if itemMap[name] > 1 {
-				name = fmt.Sprintf("%s x%v", name, itemMap[name])
+				text = fmt.Sprintf("%s x%v", name, itemMap[name])
 			}
-			names = append(names, color.Colorize(color.White, name))
+			names = append(names, color.Menu(color.Colorize(color.White, text), name, "get "+name, "look "+name))
 		}
 		str = str + strings.Join(names, color.Colorize(color.Blue, ", ")) + "\r\n"
 
@@ -434,20 +575,31 @@ func (s *Session) printRoom(room types.Room) {
 
 	var exitList []string
 	for _, direction := range room.GetExits() {
-		exitList = append(exitList, utils.DirectionToExitString(direction))
+		if screenReader {
+			exitList = append(exitList, strings.ToLower(direction.ToString()))
+		} else {
+			exitList = append(exitList, utils.DirectionToExitString(direction))
+		}
 	}
 
 	if len(exitList) == 0 {
 		str = str + color.Colorize(color.White, "None")
+	} else if screenReader {
+		str = str + color.Colorize(color.White, strings.Join(exitList, ", ")+".")
 	} else {
 		str = str + strings.Join(exitList, " ")
 	}
 
 	if len(room.GetLinks()) > 0 {
+		var links []string
+		for _, name := range room.LinkNames() {
+			links = append(links, color.Link(name, "go "+name, "Go to "+name))
+		}
+
 		str = fmt.Sprintf("%s\r\n\r\n %s %s",
 			str,
 			color.Colorize(color.Blue, "Other exits:"),
-			color.Colorize(color.White, strings.Join(room.LinkNames(), ", ")),
+			color.Colorize(color.White, strings.Join(links, ", ")),
 		)
 	}
 
@@ -0,0 +1,56 @@
+package session
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/model"
+)
+
+// shutdownPollInterval is how often Shutdown checks for sessions still running
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown waits for every session to end, which logs its player out, until
+// ctx is done, then logs out the players of any that haven't. It is meant for
+// telnet.Server.OnShutdown, which calls it once the connections the sessions
+// read from have been closed.
+func Shutdown(ctx context.Context) {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		remaining := runningSessions()
+		if len(remaining) == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, s := range remaining {
+				log.Println("Logging out " + s.pc.GetName() + ", their session didn't end in time")
+				s.logout()
+			}
+			return
+		}
+	}
+}
+
+func runningSessions() []*Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	running := make([]*Session, 0, len(sessions))
+	for s := range sessions {
+		running = append(running, s)
+	}
+	return running
+}
+
+// logout logs the player out, only the first time it is called
+func (s *Session) logout() {
+	s.logoutOnce.Do(func() {
+		model.Logout(s.pc)
+	})
+}
@@ -0,0 +1,190 @@
+package session
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+// watchable is implemented by connections that can pass on what their client
+// sees and types (telnet.WrappedConnection)
+type watchable interface {
+	AddWatcher(w io.Writer)
+	RemoveWatcher(w io.Writer)
+}
+
+// recorder is implemented by connections that can record the session to a
+// file (telnet.WrappedConnection)
+type recorder interface {
+	StartRecording(name string) (string, error)
+	StopRecording() error
+	Recording() bool
+}
+
+// rawWriter is implemented by connections that can write to the client
+// without passing it on to their watchers (telnet.WrappedConnection)
+type rawWriter interface {
+	RawWrite(p []byte) (int, error)
+}
+
+// rawWriterFunc writes with a connection's RawWrite
+type rawWriterFunc func(p []byte) (int, error)
+
+func (f rawWriterFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+var errNotWatchable = errors.New("their connection can't be watched")
+
+// snoopBuffer is how many lines may wait to be shown to a snooping admin
+// before more are dropped
+const snoopBuffer = 256
+
+var (
+	sessionsLock sync.Mutex
+	sessions     = map[*Session]bool{}
+)
+
+func registerSession(s *Session) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	sessions[s] = true
+}
+
+// unregisterSession removes a session that has ended, ending its own snoop
+// and any snoops on it
+func unregisterSession(s *Session) {
+	s.stopSnoop()
+
+	sessionsLock.Lock()
+	delete(sessions, s)
+	var snoopers []*Session
+	for other := range sessions {
+		if other.snoopTarget() == s {
+			snoopers = append(snoopers, other)
+		}
+	}
+	sessionsLock.Unlock()
+
+	for _, snooper := range snoopers {
+		snooper.stopSnoop()
+		snooper.sendSnoopLine(s.pc.GetName() + " has logged out, snoop ended")
+	}
+}
+
+// findSession returns the session of the player with the given name, or nil
+// if they aren't logged in
+func findSession(name string) *Session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	for s := range sessions {
+		if utils.Compare(s.pc.GetName(), name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// snooper passes what a player sees and types on to an admin's session a line
+// at a time. It never blocks the player, lines the admin can't keep up with
+// are dropped.
+type snooper struct {
+	target *Session
+	admin  *Session
+
+	lock    sync.Mutex
+	partial []byte
+}
+
+func (w *snooper) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		index := strings.IndexByte(string(w.partial), '\n')
+		if index == -1 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.partial[:index]), "\r")
+		w.partial = w.partial[index+1:]
+		w.admin.sendSnoopLine("% " + line)
+	}
+
+	return len(p), nil
+}
+
+func (s *Session) sendSnoopLine(line string) {
+	select {
+	case s.snoopChannel <- line:
+	default:
+	}
+}
+
+// showSnoopLine shows the admin a line from their snoop, followed by their
+// prompt. It is written straight to their client rather than through their
+// connection's watchers, so that two admins snooping on each other don't pass
+// the same lines back and forth for ever.
+func (s *Session) showSnoopLine(line string, prompt string) {
+	var out io.Writer = s.conn
+	if conn, ok := s.conn.(rawWriter); ok {
+		out = rawWriterFunc(conn.RawWrite)
+	}
+
+	utils.ClearLine(out)
+	utils.Write(out, line+"\r\n"+prompt, s.user.GetColorMode())
+}
+
+// startSnoop starts showing the admin everything target sees and types
+func (s *Session) startSnoop(target *Session) error {
+	conn, ok := target.conn.(watchable)
+	if !ok {
+		return errNotWatchable
+	}
+
+	s.stopSnoop()
+
+	watcher := &snooper{target: target, admin: s}
+	s.snoopLock.Lock()
+	s.snooping = watcher
+	s.snoopLock.Unlock()
+
+	conn.AddWatcher(watcher)
+	log.Println(s.pc.GetName() + " started snooping on " + target.pc.GetName())
+	return nil
+}
+
+// stopSnoop stops the session's snoop, if it has one
+func (s *Session) stopSnoop() {
+	s.snoopLock.Lock()
+	watcher := s.snooping
+	s.snooping = nil
+	s.snoopLock.Unlock()
+
+	if watcher == nil {
+		return
+	}
+
+	if conn, ok := watcher.target.conn.(watchable); ok {
+		conn.RemoveWatcher(watcher)
+	}
+	log.Println(s.pc.GetName() + " stopped snooping on " + watcher.target.pc.GetName())
+}
+
+// snoopTarget returns the session being snooped on, or nil
+func (s *Session) snoopTarget() *Session {
+	s.snoopLock.Lock()
+	defer s.snoopLock.Unlock()
+
+	if s.snooping == nil {
+		return nil
+	}
+	return s.snooping.target
+}
@@ -0,0 +1,557 @@
+package telnet
+
+/*
+Access control
+
+Before a client is let in its address is checked against the deny and allow
+lists, the number of connections it already has open and the number it has
+opened in the last minute. Failed logins make the next attempt from the same
+address wait, twice as long each time, reconnecting doesn't reset that.
+
+Rules from the config file always apply. Rules added at runtime are kept in
+the state file along with the login failures, so they survive restarts.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+)
+
+var (
+	ErrAccessDenied         = errors.New("connections from your address are not allowed")
+	ErrTooManyConnections   = errors.New("too many connections from your address")
+	ErrConnectingTooOften   = errors.New("too many connection attempts from your address, try again later")
+	ErrRuleNotFound         = errors.New("no such rule")
+	ErrRuleInConfig         = errors.New("rules from the config file can only be removed there")
+	ErrInvalidAddressOrCIDR = errors.New("not an address or CIDR range")
+	ErrAccessControlOff     = errors.New("access control is off")
+)
+
+// connectionRateWindow is the period ConnectionsPerMinute counts over
+const connectionRateWindow = time.Minute
+
+// Login settings used when the config leaves them out
+const (
+	defaultLoginAttempts     = 3
+	defaultLoginBackoff      = 2 * time.Second
+	defaultMaxLoginBackoff   = 5 * time.Minute
+	defaultLoginFailureReset = time.Hour
+)
+
+// AccessControl decides which clients may connect and how long they must wait
+// between failed logins. A nil AccessControl lets everything through.
+type AccessControl struct {
+	lock sync.Mutex
+
+	maxConnections    int
+	connectionRate    int
+	loginAttempts     int
+	loginBackoff      time.Duration
+	maxLoginBackoff   time.Duration
+	loginFailureReset time.Duration
+
+	configAllow []*net.IPNet
+	configDeny  []*net.IPNet
+	state       accessState
+	stateFile   string
+
+	// The config and runtime rules together
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	connections map[string]int
+	recent      map[string][]time.Time
+	lastSweep   time.Time
+}
+
+// accessState is what is kept in the state file
+type accessState struct {
+	Allow    []string                 `json:"allow"`
+	Deny     []string                 `json:"deny"`
+	Failures map[string]loginFailures `json:"failures"`
+}
+
+type loginFailures struct {
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// NewAccessControl sets up access control from the config, loading the state
+// file if there is one
+func NewAccessControl(conf *config.Config) (*AccessControl, error) {
+	security := conf.Security
+
+	a := &AccessControl{
+		maxConnections: security.MaxConnectionsPerIP,
+		connectionRate: security.ConnectionsPerMinute,
+		loginAttempts:  security.LoginAttempts,
+		stateFile:      security.StateFile,
+		state:          accessState{Failures: map[string]loginFailures{}},
+		connections:    map[string]int{},
+		recent:         map[string][]time.Time{},
+	}
+	if a.loginAttempts <= 0 {
+		a.loginAttempts = defaultLoginAttempts
+	}
+
+	durations := []struct {
+		name     string
+		value    string
+		fallback time.Duration
+		dest     *time.Duration
+	}{
+		{"login_backoff", security.LoginBackoff, defaultLoginBackoff, &a.loginBackoff},
+		{"max_login_backoff", security.MaxLoginBackoff, defaultMaxLoginBackoff, &a.maxLoginBackoff},
+		{"login_failure_reset", security.LoginFailureReset, defaultLoginFailureReset, &a.loginFailureReset},
+	}
+	for _, duration := range durations {
+		*duration.dest = duration.fallback
+		if duration.value == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value < 0 {
+			return nil, errors.New("invalid " + duration.name + ": " + duration.value)
+		}
+		*duration.dest = value
+	}
+
+	var err error
+	if a.configAllow, err = parseCIDRs(security.Allow); err != nil {
+		return nil, err
+	}
+	if a.configDeny, err = parseCIDRs(security.Deny); err != nil {
+		return nil, err
+	}
+
+	if err = a.load(); err != nil {
+		return nil, err
+	}
+	a.compileRules()
+	return a, nil
+}
+
+// Admit checks whether a client at addr may connect, and if so counts the
+// connection until release is called
+func (a *AccessControl) Admit(addr string) (release func(), err error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	host := hostOf(addr)
+	ip := net.ParseIP(host)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.denied(ip) {
+		return nil, ErrAccessDenied
+	}
+
+	now := time.Now()
+	if now.Sub(a.lastSweep) > connectionRateWindow {
+		a.sweepRecent(now)
+	}
+
+	if a.connectionRate > 0 {
+		var recent []time.Time
+		for _, t := range a.recent[host] {
+			if now.Sub(t) < connectionRateWindow {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) >= a.connectionRate {
+			a.recent[host] = recent
+			return nil, ErrConnectingTooOften
+		}
+		a.recent[host] = append(recent, now)
+	}
+
+	if a.maxConnections > 0 && a.connections[host] >= a.maxConnections {
+		return nil, ErrTooManyConnections
+	}
+	a.connections[host]++
+	return a.releaseFunc(host), nil
+}
+
+// Denied returns true if a client at addr would be turned away by the allow
+// and deny lists
+func (a *AccessControl) Denied(addr string) bool {
+	if a == nil {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.denied(net.ParseIP(hostOf(addr)))
+}
+
+func (a *AccessControl) denied(ip net.IP) bool {
+	return ip != nil && (matchCIDRs(a.deny, ip) || (len(a.allow) > 0 && !matchCIDRs(a.allow, ip)))
+}
+
+// readmit counts a connection carried over from before a copyover, which was
+// let in once already and mustn't be turned away now
+func (a *AccessControl) readmit(addr string) (release func()) {
+	if a == nil {
+		return func() {}
+	}
+
+	host := hostOf(addr)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.connections[host]++
+	return a.releaseFunc(host)
+}
+
+// releaseFunc returns a function that gives up one of host's connections, only
+// the first time it is called
+func (a *AccessControl) releaseFunc(host string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+
+			a.connections[host]--
+			if a.connections[host] <= 0 {
+				delete(a.connections, host)
+			}
+		})
+	}
+}
+
+// sweepRecent forgets connection times too old to count towards the rate
+// limit, for every address
+func (a *AccessControl) sweepRecent(now time.Time) {
+	a.lastSweep = now
+	for host, times := range a.recent {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= connectionRateWindow {
+			delete(a.recent, host)
+		}
+	}
+}
+
+// compileRules puts the config and runtime rules together for Admit
+func (a *AccessControl) compileRules() {
+	allow, _ := parseCIDRs(a.state.Allow)
+	deny, _ := parseCIDRs(a.state.Deny)
+
+	a.allow = append(append([]*net.IPNet{}, a.configAllow...), allow...)
+	a.deny = append(append([]*net.IPNet{}, a.configDeny...), deny...)
+}
+
+// Allow adds an address or CIDR range to the allow list
+func (a *AccessControl) Allow(cidr string) error {
+	return a.addRule(false, cidr)
+}
+
+// Deny adds an address or CIDR range to the deny list
+func (a *AccessControl) Deny(cidr string) error {
+	return a.addRule(true, cidr)
+}
+
+func (a *AccessControl) addRule(deny bool, cidr string) error {
+	if a == nil {
+		return ErrAccessControlOff
+	}
+
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	allow, denied := a.state.Allow, a.state.Deny
+	list := &allow
+	if deny {
+		list = &denied
+	}
+
+	for _, rule := range *list {
+		if rule == network.String() {
+			return nil
+		}
+	}
+	*list = append(append([]string{}, *list...), network.String())
+	return a.changeRules(allow, denied)
+}
+
+// changeRules replaces the runtime rules, only once the state file has been
+// saved with them
+func (a *AccessControl) changeRules(allow []string, deny []string) error {
+	previousAllow, previousDeny := a.state.Allow, a.state.Deny
+	a.state.Allow, a.state.Deny = allow, deny
+	if err := a.save(); err != nil {
+		a.state.Allow, a.state.Deny = previousAllow, previousDeny
+		return err
+	}
+
+	a.compileRules()
+	return nil
+}
+
+// RemoveRule removes an address or CIDR range added at runtime from both lists
+func (a *AccessControl) RemoveRule(cidr string) error {
+	if a == nil {
+		return ErrAccessControlOff
+	}
+
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	rule := network.String()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	allow, deny := withoutRule(a.state.Allow, rule), withoutRule(a.state.Deny, rule)
+	if len(allow) != len(a.state.Allow) || len(deny) != len(a.state.Deny) {
+		return a.changeRules(allow, deny)
+	}
+
+	for _, configured := range append(append([]*net.IPNet{}, a.configAllow...), a.configDeny...) {
+		if configured.String() == rule {
+			return ErrRuleInConfig
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// withoutRule returns a copy of rules without rule
+func withoutRule(rules []string, rule string) []string {
+	var output []string
+	for _, r := range rules {
+		if r != rule {
+			output = append(output, r)
+		}
+	}
+	return output
+}
+
+// Rules returns the allow and deny lists, the config file's rules first
+func (a *AccessControl) Rules() (allow []string, deny []string) {
+	if a == nil {
+		return nil, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, network := range a.configAllow {
+		allow = append(allow, network.String())
+	}
+	for _, network := range a.configDeny {
+		deny = append(deny, network.String())
+	}
+	return append(allow, a.state.Allow...), append(deny, a.state.Deny...)
+}
+
+// LoginAttempts returns how many logins may fail before the client is
+// disconnected
+func (a *AccessControl) LoginAttempts() int {
+	if a == nil {
+		return defaultLoginAttempts
+	}
+	return a.loginAttempts
+}
+
+// LoginDelay returns how long a client at addr must wait before trying to log
+// in again
+func (a *AccessControl) LoginDelay(addr string) time.Duration {
+	if a == nil {
+		return 0
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	failures, found := a.state.Failures[hostOf(addr)]
+	if !found || failures.Count == 0 {
+		return 0
+	}
+
+	delay := a.loginBackoff
+	for i := 1; i < failures.Count && delay < a.maxLoginBackoff; i++ {
+		delay *= 2
+	}
+	if delay > a.maxLoginBackoff {
+		delay = a.maxLoginBackoff
+	}
+
+	if wait := time.Until(failures.Last.Add(delay)); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// LoginFailed records a failed login from addr
+func (a *AccessControl) LoginFailed(addr string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	host := hostOf(addr)
+	failures := a.state.Failures[host]
+	if time.Since(failures.Last) > a.loginFailureReset {
+		failures.Count = 0
+	}
+
+	failures.Count++
+	failures.Last = time.Now()
+	a.state.Failures[host] = failures
+	a.expireFailures()
+
+	_ = a.save()
+}
+
+// LoginSucceeded forgets the failed logins from addr
+func (a *AccessControl) LoginSucceeded(addr string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	host := hostOf(addr)
+	if _, found := a.state.Failures[host]; found {
+		delete(a.state.Failures, host)
+		_ = a.save()
+	}
+}
+
+// expireFailures forgets failures old enough not to count any more, so that
+// the state file doesn't grow for good
+func (a *AccessControl) expireFailures() {
+	for host, failures := range a.state.Failures {
+		if time.Since(failures.Last) > a.loginFailureReset {
+			delete(a.state.Failures, host)
+		}
+	}
+}
+
+func (a *AccessControl) load() error {
+	if a.stateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("could not read access state: " + err.Error())
+	}
+
+	if err = json.Unmarshal(data, &a.state); err != nil {
+		return errors.New("could not read access state: " + err.Error())
+	}
+	if a.state.Failures == nil {
+		a.state.Failures = map[string]loginFailures{}
+	}
+	return nil
+}
+
+// save writes the state file, through a temporary file so that a crash can't
+// leave it half written
+func (a *AccessControl) save() error {
+	if a.stateFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(a.stateFile), filepath.Base(a.stateFile)+".*")
+	if err != nil {
+		return errors.New("could not save access state: " + err.Error())
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), a.stateFile)
+	}
+	if err != nil {
+		return errors.New("could not save access state: " + err.Error())
+	}
+	return nil
+}
+
+// hostOf returns the host part of an address, or the address itself if it
+// has no port
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// parseCIDR reads a CIDR range, or a single address as a range of its own
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, ErrInvalidAddressOrCIDR
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, ErrInvalidAddressOrCIDR
+	}
+	return network, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		network, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New(cidr + ": " + err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func matchCIDRs(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+package telnet
+
+/*
+Administration
+
+Accounts listed in the security config's admins may manage the access rules
+and snoop on other connections, from the frontend's admin menu. A snoop copies
+everything a connection is sent, and everything its client types, to the
+admin. It is written straight to the admin's client rather than through their
+connection's watchers, so snoops never pass each other's output around.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/yamamushi/kmud-2020/color"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+var (
+	ErrNotAdmin   = errors.New("only admins may do that")
+	ErrSnoopSelf  = errors.New("you can't snoop on yourself")
+	ErrSnoopEnded = errors.New("the snoop has ended")
+)
+
+// snoopBuffer is how many writes may wait to be shown to a snooping admin
+// before more are dropped
+const snoopBuffer = 256
+
+// Username returns the account the client logged in to, or an empty string if
+// it hasn't. Tokens start with the account name.
+func (c *ConnectionHandler) Username() string {
+	username, _, _ := strings.Cut(c.AuthToken(), ":")
+	return username
+}
+
+// Admin returns true if the client logged in to one of the accounts listed in
+// the security config's admins
+func (c *ConnectionHandler) Admin() bool {
+	username := c.Username()
+	if username == "" {
+		return false
+	}
+
+	for _, admin := range c.config.Security.Admins {
+		if strings.EqualFold(admin, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminMenu lets an admin manage the access rules and snoop on connections,
+// for anyone else it does nothing
+func (s *Server) AdminMenu(c *ConnectionHandler) {
+	if !c.Admin() {
+		return
+	}
+
+	utils.ExecMenu("Admin", c, func(menu *utils.Menu) {
+		menu.AddAction("l", "List access rules", func() {
+			s.listAccessRules(c)
+		})
+		menu.AddAction("a", "Allow an address", func() {
+			s.changeAccessRule(c, s.access.Allow)
+		})
+		menu.AddAction("d", "Deny an address and disconnect it", func() {
+			s.changeAccessRule(c, func(cidr string) error {
+				if err := s.access.Deny(cidr); err != nil {
+					return err
+				}
+				if closed := s.disconnectDenied(c); closed > 0 {
+					c.WriteLine("Disconnected %v connections from there", closed)
+				}
+				return nil
+			})
+		})
+		menu.AddAction("r", "Remove an access rule", func() {
+			s.changeAccessRule(c, s.access.RemoveRule)
+		})
+		menu.AddAction("s", "Snoop on a connection", func() {
+			s.snoopMenu(c)
+		})
+	})
+}
+
+func (s *Server) listAccessRules(c *ConnectionHandler) {
+	allow, deny := s.access.Rules()
+	if len(allow) == 0 {
+		c.WriteLine("Allowed: everyone not denied")
+	} else {
+		c.WriteLine("Allowed: %s", strings.Join(allow, ", "))
+	}
+	if len(deny) == 0 {
+		c.WriteLine("Denied: nobody")
+	} else {
+		c.WriteLine("Denied: %s", strings.Join(deny, ", "))
+	}
+}
+
+// changeAccessRule asks for an address or CIDR range and passes it to change
+func (s *Server) changeAccessRule(c *ConnectionHandler, change func(cidr string) error) {
+	address := c.GetInput("Address or CIDR range: ")
+	if address == "" {
+		return
+	}
+
+	if err := change(address); err != nil {
+		c.WriteLine("%s", color.Colorize(color.Red, "Error: "+err.Error()))
+	} else {
+		c.WriteLine("Access rules updated")
+	}
+}
+
+// disconnectDenied closes the connections of everyone the access rules now
+// turn away, apart from admin, returning how many it closed
+func (s *Server) disconnectDenied(admin *ConnectionHandler) int {
+	closed := 0
+	for _, info := range s.Connections() {
+		if info.ID == admin.id || !s.access.Denied(info.RemoteAddr) {
+			continue
+		}
+		if c := s.pool.Find(info.ID); c != nil {
+			log.Println("Disconnecting denied client:", info.RemoteAddr)
+			c.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// snoopMenu lists the other connections, snooping on the one picked until the
+// admin types something
+func (s *Server) snoopMenu(c *ConnectionHandler) {
+	utils.ExecMenu("Snoop", c, func(menu *utils.Menu) {
+		i := 0
+		for _, info := range s.Connections() {
+			if info.ID == c.id {
+				continue
+			}
+
+			who := "not logged in"
+			if info.Username != "" {
+				who = info.Username
+			}
+			text := fmt.Sprintf("%s from %s, idle %s", who, info.RemoteAddr, formatDuration(info.Idle))
+
+			id := info.ID
+			menu.AddActionI(i, text, func() {
+				s.snoop(c, id)
+				menu.Exit()
+			})
+			i++
+		}
+	})
+}
+
+func (s *Server) snoop(c *ConnectionHandler, id string) {
+	stop, err := s.Snoop(c, id)
+	if err != nil {
+		c.WriteLine("%s", color.Colorize(color.Red, "Error: "+err.Error()))
+		return
+	}
+
+	c.WriteLine("Snooping, type x to stop")
+	c.GetInput("")
+	stop()
+	c.WriteLine("Snoop ended")
+}
+
+// Connections describes the connections to the server, oldest first
+func (s *Server) Connections() []ConnectionInfo {
+	if s.pool == nil {
+		return nil
+	}
+	return s.pool.Connections()
+}
+
+// Snoop shows admin everything the connection with the given ID is sent and
+// types, until the returned function is called. The snooped connection is
+// never held up by the admin's, writes the admin can't keep up with are
+// dropped.
+func (s *Server) Snoop(admin *ConnectionHandler, id string) (stop func(), err error) {
+	if !admin.Admin() {
+		return nil, ErrNotAdmin
+	}
+	if admin.id == id {
+		return nil, ErrSnoopSelf
+	}
+
+	var target *ConnectionHandler
+	if s.pool != nil {
+		target = s.pool.Find(id)
+	}
+	if target == nil {
+		return nil, ErrConnectionNotFound
+	}
+
+	watcher := newSnoopWriter(admin.conn)
+	target.conn.AddWatcher(watcher)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			target.conn.RemoveWatcher(watcher)
+			watcher.close()
+		})
+	}, nil
+}
+
+// snoopWriter passes what it is given on to an admin's client from its own
+// goroutine
+type snoopWriter struct {
+	admin   *WrappedConnection
+	pending chan []byte
+	done    chan struct{}
+}
+
+func newSnoopWriter(admin *WrappedConnection) *snoopWriter {
+	w := &snoopWriter{
+		admin:   admin,
+		pending: make(chan []byte, snoopBuffer),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *snoopWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.done:
+		return 0, ErrSnoopEnded
+	default:
+	}
+
+	select {
+	case w.pending <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+func (w *snoopWriter) run() {
+	for {
+		select {
+		case p := <-w.pending:
+			if _, err := w.admin.RawWrite(p); err != nil {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *snoopWriter) close() {
+	close(w.done)
+}
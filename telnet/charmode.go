@@ -0,0 +1,48 @@
+package telnet
+
+/*
+Character mode
+
+A client that agrees to both WILL SGA and WILL ECHO stops editing lines
+itself and sends every key press as it is typed, leaving the echoing and
+editing to the server. The editing is done by utils.LineEditor, see
+WrappedConnection.Read.
+*/
+
+func init() {
+	RegisterOption(SGA, OptionHandler{AcceptLocal: true})
+}
+
+// OfferCharacterMode asks the client to switch to character mode and waits for
+// its answer, for at most NegotiationTimeout. A client that only agrees to one
+// of the two options is left in line mode.
+func (t *Telnet) OfferCharacterMode() error {
+	t.EnableLocal(SGA)
+	t.EnableLocal(ECHO)
+
+	err := t.awaitNegotiation(func() bool {
+		return t.localSettled(SGA) && t.localSettled(ECHO)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !t.CharacterMode() {
+		t.DisableLocal(SGA)
+		t.DisableLocal(ECHO)
+		return ErrNegotiationRefused
+	}
+	return nil
+}
+
+// CharacterMode returns true if the client sends key presses as they are typed
+func (t *Telnet) CharacterMode() bool {
+	return t.LocalEnabled(SGA) && t.LocalEnabled(ECHO)
+}
+
+// localSettled returns true if no negotiation of the server's side of the
+// option is pending
+func (t *Telnet) localSettled(option TelnetCode) bool {
+	state := t.optionState(option, true)
+	return state == qYes || state == qNo
+}
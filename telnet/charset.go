@@ -0,0 +1,290 @@
+package telnet
+
+/*
+CHARSET (RFC 2066)
+https://tools.ietf.org/html/rfc2066
+
+Once the client agrees with IAC DO CHARSET the server offers the character
+sets it speaks, in order of preference:
+
+	IAC SB CHARSET REQUEST ;UTF-8;ISO-8859-1;US-ASCII IAC SE
+
+and the client picks one with IAC SB CHARSET ACCEPTED <charset> IAC SE or
+turns them all down with REJECTED. Clients may send a REQUEST of their own,
+which is answered the same way.
+
+Clients that never agree on a character set are sent UTF-8 if they report
+it over MTTS, and plain ASCII with anything else transliterated otherwise.
+What they send is read as UTF-8 where it is valid and as Latin-1 where it
+isn't.
+*/
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+const (
+	charsetRequest  byte = 1
+	charsetAccepted byte = 2
+	charsetRejected byte = 3
+)
+
+// Character sets the server speaks
+const (
+	CharsetUTF8   = "UTF-8"
+	CharsetLatin1 = "ISO-8859-1"
+	CharsetASCII  = "US-ASCII"
+)
+
+var supportedCharsets = []string{CharsetUTF8, CharsetLatin1, CharsetASCII}
+
+// charsetAliases maps other common names of the supported character sets to
+// the names above
+var charsetAliases = map[string]string{
+	"UTF8":       CharsetUTF8,
+	"LATIN1":     CharsetLatin1,
+	"LATIN-1":    CharsetLatin1,
+	"ISO8859-1":  CharsetLatin1,
+	"ISO_8859-1": CharsetLatin1,
+	"ASCII":      CharsetASCII,
+}
+
+func init() {
+	RegisterOption(CHARSET, OptionHandler{
+		AcceptLocal:  true,
+		AcceptRemote: true,
+		Enabled: func(t *Telnet, local bool) {
+			if local {
+				t.requestCharset()
+			}
+		},
+		Disabled: func(t *Telnet, local bool) {
+			t.charset.lock.Lock()
+			defer t.charset.lock.Unlock()
+
+			t.charset.answered = true
+		},
+		Subnegotiation: func(t *Telnet, data []byte) {
+			t.handleCharset(data)
+		},
+	})
+}
+
+type charsetState struct {
+	lock     sync.RWMutex
+	name     string
+	answered bool
+}
+
+// OfferCharset offers the client the character sets the server speaks and
+// waits for it to pick one, for at most NegotiationTimeout
+func (t *Telnet) OfferCharset() error {
+	t.EnableLocal(CHARSET)
+
+	return t.awaitNegotiation(func() bool {
+		t.charset.lock.RLock()
+		defer t.charset.lock.RUnlock()
+
+		return t.charset.answered || t.optionState(CHARSET, true) == qNo
+	})
+}
+
+// Charset returns the character set agreed with the client, or an empty string
+// if none was
+func (t *Telnet) Charset() string {
+	t.charset.lock.RLock()
+	defer t.charset.lock.RUnlock()
+
+	return t.charset.name
+}
+
+// textCharset returns the character set to convert text to and from, falling
+// back to what the client reported over MTTS
+func (t *Telnet) textCharset() string {
+	if charset := t.Charset(); charset != "" {
+		return charset
+	}
+	if t.Capabilities().UTF8 {
+		return CharsetUTF8
+	}
+	return ""
+}
+
+// SetCharset sets the character set without negotiating it, for connections
+// such as WebSockets whose character set is fixed
+func (t *Telnet) SetCharset(name string) {
+	t.charset.lock.Lock()
+	defer t.charset.lock.Unlock()
+
+	t.charset.name = canonicalCharset(name)
+	t.charset.answered = true
+}
+
+func (t *Telnet) requestCharset() {
+	data := []byte{charsetRequest}
+	for _, name := range supportedCharsets {
+		data = append(data, ';')
+		data = append(data, name...)
+	}
+
+	_ = t.sendSubnegotiation(CHARSET, data)
+}
+
+func (t *Telnet) handleCharset(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch data[0] {
+	case charsetAccepted:
+		t.SetCharset(string(data[1:]))
+	case charsetRejected:
+		t.charset.lock.Lock()
+		t.charset.answered = true
+		t.charset.lock.Unlock()
+	case charsetRequest:
+		// The first byte after REQUEST separates the offered names
+		if len(data) < 2 {
+			return
+		}
+		for _, name := range strings.Split(string(data[2:]), string(data[1])) {
+			if charset := canonicalCharset(name); charset != "" {
+				t.SetCharset(charset)
+				_ = t.sendSubnegotiation(CHARSET, append([]byte{charsetAccepted}, name...))
+				return
+			}
+		}
+		_ = t.sendSubnegotiation(CHARSET, []byte{charsetRejected})
+	}
+}
+
+// canonicalCharset returns the name used here for a supported character set,
+// or an empty string if it isn't supported
+func canonicalCharset(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for _, charset := range supportedCharsets {
+		if name == charset {
+			return charset
+		}
+	}
+	return charsetAliases[name]
+}
+
+// charsetConn converts text between UTF-8 and the client's character set
+type charsetConn struct {
+	telnet  *Telnet
+	partial []byte
+	pending []byte
+}
+
+func newCharsetConn(t *Telnet) *charsetConn {
+	return &charsetConn{telnet: t}
+}
+
+func (c *charsetConn) Write(p []byte) (int, error) {
+	_, err := c.telnet.Write(encodeText(p, c.telnet.textCharset()))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *charsetConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		buf := make([]byte, len(p))
+		n, err := c.telnet.Read(buf)
+
+		data := append(c.partial, buf[:n]...)
+		c.partial = nil
+		c.pending, c.partial = decodeText(data, c.telnet.textCharset(), err == nil)
+
+		if err != nil {
+			if len(c.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// encodeText converts UTF-8 text to the given character set
+func encodeText(p []byte, charset string) []byte {
+	if charset == CharsetUTF8 || isASCII(p) {
+		return p
+	}
+
+	if charset != CharsetLatin1 {
+		return []byte(utils.Transliterate(string(p)))
+	}
+
+	var encoded bytes.Buffer
+	for _, r := range string(p) {
+		switch {
+		case r == 0xff:
+			// ÿ shares its byte with IAC
+			encoded.Write([]byte{codeToByte[IAC], codeToByte[IAC]})
+		case r < 0x100:
+			encoded.WriteByte(byte(r))
+		default:
+			encoded.WriteString(utils.Transliterate(string(r)))
+		}
+	}
+	return encoded.Bytes()
+}
+
+// decodeText converts text in the given character set to UTF-8. An incomplete
+// UTF-8 sequence at the end is returned separately when more is true, to be
+// completed by the next read.
+func decodeText(p []byte, charset string, more bool) ([]byte, []byte) {
+	if isASCII(p) {
+		return p, nil
+	}
+
+	var decoded bytes.Buffer
+	for i := 0; i < len(p); {
+		if charset == CharsetLatin1 {
+			decoded.WriteRune(rune(p[i]))
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(p[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if more && !utf8.FullRune(p[i:]) {
+				return decoded.Bytes(), p[i:]
+			}
+
+			if charset == CharsetUTF8 {
+				decoded.WriteRune(utf8.RuneError)
+			} else {
+				// Legacy clients that don't send UTF-8 most likely send Latin-1
+				decoded.WriteRune(rune(p[i]))
+			}
+			i++
+			continue
+		}
+
+		decoded.WriteRune(r)
+		i += size
+	}
+
+	return decoded.Bytes(), nil
+}
+
+func isASCII(p []byte) bool {
+	for _, b := range p {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -1,28 +1,112 @@
 package telnet
 
 import (
+	"errors"
 	"fmt"
 	"github.com/yamamushi/kmud-2020/color"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/types"
 	"github.com/yamamushi/kmud-2020/utils"
 )
 
+var (
+	ErrRecordingOff     = errors.New("session recording is turned off")
+	ErrAlreadyRecording = errors.New("session is already being recorded")
+	ErrNotRecording     = errors.New("session isn't being recorded")
+	ErrRecordingFull    = errors.New("the recording has reached its size limit")
+)
+
+// DefaultRecordingLimit is how large a recording may grow, in bytes, unless
+// the config's recording_max_size says otherwise
+const DefaultRecordingLimit = 10 << 20
+
+// recordingLimitFromConfig reads the recording limit, which the config gives
+// in KiB, from the server config
+func recordingLimitFromConfig(conf *config.Config) int64 {
+	if conf.Server.RecordingMaxSize <= 0 {
+		return DefaultRecordingLimit
+	}
+	return int64(conf.Server.RecordingMaxSize) * 1024
+}
+
 type ConnectionHandler struct {
 	id        string
-	AuthToken string
 	pool      chan PoolMessage
 	conn      *WrappedConnection
 	config    *config.Config
+	connected time.Time
+	term      *Terminal
+
+	authLock  sync.RWMutex
+	authToken string
 }
 
 type WrappedConnection struct {
-	Telnet
+	*Telnet
 	watcher *utils.WatchableReadWriter
+	editor  *utils.LineEditor
+
+	// hidingInput is set while echo is turned off for a client in line mode,
+	// which enables ECHO without the client being in character mode
+	hidingInput bool
+
+	// pty is set for SSH sessions with a pty, whose clients always send key
+	// presses as they are typed
+	pty bool
+
+	settingsLock     sync.RWMutex
+	colorDepth       color.ColorDepth
+	screenReaderMode types.ScreenReaderMode
+
+	access *AccessControl
+
+	// recordingDir is where sessions are recorded to, recording is off if
+	// it is empty
+	recordingDir string
+	// recordingLimit is how large a recording may grow, in bytes
+	recordingLimit int64
+	recordLock     sync.Mutex
+	recording      *os.File
+	recorder       *utils.TtyrecWriter
+}
+
+// The watcher sits above the line editor, so that watchers see each line the
+// client enters once, however it was edited, and not the editor's echo
+func newWrappedConnection(t *Telnet) *WrappedConnection {
+	conn := newCharsetConn(t)
+	wc := &WrappedConnection{Telnet: t}
+	wc.editor = utils.NewLineEditor(conn)
+	wc.watcher = utils.NewWatchableReadWriter(editedConn{wc: wc, conn: conn})
+	return wc
+}
+
+// editedConn reads through the line editor while the client is in character
+// mode and straight from the client otherwise. Everything written goes through
+// the editor, which keeps track of the prompt.
+type editedConn struct {
+	wc   *WrappedConnection
+	conn io.ReadWriter
+}
+
+func (e editedConn) Read(p []byte) (int, error) {
+	if e.wc.characterMode() {
+		return e.wc.editor.Read(p)
+	}
+	return e.conn.Read(p)
+}
+
+func (e editedConn) Write(p []byte) (int, error) {
+	return e.wc.editor.Write(p)
 }
 
 // Write a raw byte to the connection rather than through the io.Writer (the wc.watcher writer)
@@ -39,10 +123,247 @@ func (wc *WrappedConnection) Write(p []byte) (int, error) {
 	return wc.watcher.Write(p)
 }
 
+// Read reads input from the client, through the line editor if the client is
+// in character mode
 func (wc *WrappedConnection) Read(p []byte) (int, error) {
 	return wc.watcher.Read(p)
 }
 
+func (wc *WrappedConnection) characterMode() bool {
+	return wc.pty || (!wc.hidingInput && wc.Telnet.CharacterMode())
+}
+
+// WillEcho hides what the client types, for passwords
+func (wc *WrappedConnection) WillEcho() {
+	wc.watcher.HideInput(true)
+	if wc.characterMode() {
+		wc.editor.SetEcho(false)
+		return
+	}
+
+	wc.hidingInput = true
+	wc.Telnet.WillEcho()
+}
+
+// WontEcho shows what the client types again
+func (wc *WrappedConnection) WontEcho() {
+	wc.watcher.HideInput(false)
+	if wc.hidingInput {
+		wc.hidingInput = false
+		wc.Telnet.WontEcho()
+		return
+	}
+
+	wc.editor.SetEcho(true)
+}
+
+// ColorDepth returns the number of colors the client can show, as set with
+// SetColorDepth or else as reported over MTTS or guessed from its terminal type
+func (wc *WrappedConnection) ColorDepth() color.ColorDepth {
+	wc.settingsLock.RLock()
+	depth := wc.colorDepth
+	wc.settingsLock.RUnlock()
+
+	if depth != color.DepthAuto {
+		return depth
+	}
+
+	caps := wc.Capabilities()
+	switch {
+	case caps.TrueColor:
+		return color.DepthTrueColor
+	case caps.Colors256:
+		return color.Depth256
+	}
+	return color.DepthForTerminal(caps.TerminalType)
+}
+
+// SetColorDepth overrides the detected number of colors, color.DepthAuto
+// removes the override
+func (wc *WrappedConnection) SetColorDepth(depth color.ColorDepth) {
+	wc.settingsLock.Lock()
+	defer wc.settingsLock.Unlock()
+
+	wc.colorDepth = depth
+}
+
+// ScreenReader returns whether the client should be sent output suited to
+// screen readers, as set with SetScreenReaderMode or else as reported over MTTS
+func (wc *WrappedConnection) ScreenReader() bool {
+	wc.settingsLock.RLock()
+	mode := wc.screenReaderMode
+	wc.settingsLock.RUnlock()
+
+	switch mode {
+	case types.ScreenReaderOn:
+		return true
+	case types.ScreenReaderOff:
+		return false
+	}
+	return wc.Capabilities().ScreenReader
+}
+
+// SetScreenReaderMode overrides whether the client has a screen reader,
+// types.ScreenReaderAuto removes the override
+func (wc *WrappedConnection) SetScreenReaderMode(mode types.ScreenReaderMode) {
+	wc.settingsLock.Lock()
+	defer wc.settingsLock.Unlock()
+
+	wc.screenReaderMode = mode
+}
+
+// Access returns what decides which clients may connect and how often they
+// may fail to log in
+func (wc *WrappedConnection) Access() *AccessControl {
+	return wc.access
+}
+
+// SetCompleter sets the function used for tab completion in character mode
+func (wc *WrappedConnection) SetCompleter(completer func(line string) []string) {
+	wc.editor.SetCompleter(completer)
+}
+
+// AddWatcher passes everything the client is sent and enters on to w as well,
+// apart from passwords
+func (wc *WrappedConnection) AddWatcher(w io.Writer) {
+	wc.watcher.AddWatcher(w)
+}
+
+// RemoveWatcher stops passing things on to w
+func (wc *WrappedConnection) RemoveWatcher(w io.Writer) {
+	wc.watcher.RemoveWatcher(w)
+}
+
+// StartRecording records the session to a new ttyrec file named after name
+// and the time, returning the file's path
+func (wc *WrappedConnection) StartRecording(name string) (string, error) {
+	if wc.recordingDir == "" {
+		return "", ErrRecordingOff
+	}
+
+	wc.recordLock.Lock()
+	defer wc.recordLock.Unlock()
+
+	if wc.recording != nil {
+		return "", ErrAlreadyRecording
+	}
+
+	if err := os.MkdirAll(wc.recordingDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(wc.recordingDir, recordingName(name, time.Now()))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	wc.record(file, 0)
+	return path, nil
+}
+
+// record starts recording to file, which already holds size bytes. The
+// recording stops once it would grow past the recording limit. recordLock
+// must be held.
+func (wc *WrappedConnection) record(file *os.File, size int64) {
+	limit := wc.recordingLimit
+	if limit <= 0 {
+		limit = DefaultRecordingLimit
+	}
+
+	var recorder *utils.TtyrecWriter
+	capped := &cappedWriter{w: file, remaining: limit - size, full: func() {
+		log.Println("Recording " + file.Name() + " reached its size limit")
+		// The watcher calling full holds up RemoveWatcher until it returns
+		go wc.stopRecording(recorder)
+	}}
+	recorder = utils.NewTtyrecWriter(capped)
+
+	wc.recording = file
+	wc.recorder = recorder
+	wc.watcher.AddWatcher(recorder)
+}
+
+// StopRecording stops recording the session and closes the file
+func (wc *WrappedConnection) StopRecording() error {
+	return wc.stopRecording(nil)
+}
+
+// stopRecording stops the recording made by recorder, or any recording if
+// recorder is nil
+func (wc *WrappedConnection) stopRecording(recorder *utils.TtyrecWriter) error {
+	wc.recordLock.Lock()
+	defer wc.recordLock.Unlock()
+
+	if wc.recording == nil || (recorder != nil && wc.recorder != recorder) {
+		return ErrNotRecording
+	}
+
+	wc.watcher.RemoveWatcher(wc.recorder)
+	err := wc.recording.Close()
+	wc.recording = nil
+	wc.recorder = nil
+	return err
+}
+
+// Recording returns whether the session is being recorded
+func (wc *WrappedConnection) Recording() bool {
+	wc.recordLock.Lock()
+	defer wc.recordLock.Unlock()
+
+	return wc.recording != nil
+}
+
+// Close stops any recording and closes the connection
+func (wc *WrappedConnection) Close() error {
+	_ = wc.StopRecording()
+	return wc.Telnet.Close()
+}
+
+// cappedWriter passes writes on to w until the next would take it past
+// remaining bytes, then calls full once and drops that write and the rest.
+// Writes are kept whole, so a recording never ends with half a frame.
+type cappedWriter struct {
+	w         io.Writer
+	lock      sync.Mutex
+	remaining int64
+	full      func()
+	done      bool
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.done {
+		return 0, ErrRecordingFull
+	}
+	if int64(len(p)) > c.remaining {
+		c.done = true
+		c.full()
+		return 0, ErrRecordingFull
+	}
+
+	n, err := c.w.Write(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// recordingName returns a file name for a recording of name's session that
+// started at start, leaving out anything in name that doesn't belong in one
+func recordingName(name string, start time.Time) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+	if clean == "" {
+		clean = "session"
+	}
+
+	return clean + "-" + start.Format("20060102-150405.000") + ".ttyrec"
+}
+
 func (c *ConnectionHandler) WriteLine(line string, a ...interface{}) {
 	utils.WriteLine(c.conn, fmt.Sprintf(line, a...), color.ModeNone)
 }
@@ -51,13 +372,33 @@ func (c *ConnectionHandler) Write(text string) {
 	utils.Write(c.conn, text, color.ModeNone)
 }
 
+// GetInput reads a line of input, answering any plain text MSSP-REQUEST from
+// a crawler along the way
 func (c *ConnectionHandler) GetInput(prompt string) string {
-	return utils.GetUserInput(c.conn, prompt, color.ModeNone)
+	for {
+		input := utils.GetUserInput(c.conn, prompt, color.ModeNone)
+		if !IsMSSPRequest(input) {
+			return input
+		}
+
+		c.Write(c.conn.MSSPPlainText())
+	}
 }
 
+// GetWindowSize returns the size last reported by the client over NAWS,
+// falling back to the default size for clients that don't report one
 func (c *ConnectionHandler) GetWindowSize() (int, int) {
-	// This is incorrect, this should ask the client for information, instead it's static for now
-	return 80, 80
+	width, height := c.conn.WindowSize()
+	if width == 0 || height == 0 {
+		return DefaultColumns, DefaultRows
+	}
+	return width, height
+}
+
+// ScreenReader returns whether the client should be sent output suited to
+// screen readers
+func (c *ConnectionHandler) ScreenReader() bool {
+	return c.conn.ScreenReader()
 }
 
 func (c *ConnectionHandler) Handle(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), term *Terminal, conf *config.Config) {
@@ -84,6 +425,34 @@ func (c *ConnectionHandler) HandleDisconnect() {
 	c.pool <- PoolMessage{TargetID: c.id, Type: "disconnected"}
 }
 
+// ID returns the ID the connection is known by in the pool
+func (c *ConnectionHandler) ID() string {
+	return c.id
+}
+
+// SetAuthToken records the token the client logged in with, an empty token
+// logs it out
+func (c *ConnectionHandler) SetAuthToken(token string) {
+	c.authLock.Lock()
+	defer c.authLock.Unlock()
+
+	c.authToken = token
+}
+
+// AuthToken returns the token the client logged in with, or an empty string if
+// it hasn't
+func (c *ConnectionHandler) AuthToken() string {
+	c.authLock.RLock()
+	defer c.authLock.RUnlock()
+
+	return c.authToken
+}
+
+// Authenticated returns whether the client has logged in
+func (c *ConnectionHandler) Authenticated() bool {
+	return c.AuthToken() != ""
+}
+
 func (c *ConnectionHandler) Close() {
 	c.conn.Close()
 }
@@ -0,0 +1,611 @@
+package telnet
+
+/*
+Copyover
+
+A copyover restarts the server from its binary, which may have been replaced
+with a new build, without disconnecting anyone. The listening sockets and the
+plain telnet connections are left open across exec, and what the new process
+needs to carry on with them (which options were agreed, the terminal, who is
+logged in and so on) is passed to it in a state file named by the
+KMUD_COPYOVER_STATE environment variable.
+
+Compression is ended before the exec and started again after it, as the zlib
+stream can't be carried over. TLS, WebSocket and SSH connections can't be
+carried over either, their clients are asked to reconnect. Each restored
+connection is handed to the runner again from the start.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/color"
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/types"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+var ErrCopyoverUnsupported = errors.New("copyover isn't supported on this platform")
+
+const copyoverStateVariable = "KMUD_COPYOVER_STATE"
+
+// Names of the listeners kept across a copyover
+const (
+	listenerTelnet    = "telnet"
+	listenerTLS       = "tls"
+	listenerWebSocket = "websocket"
+	listenerSSH       = "ssh"
+)
+
+// copyoverState is everything passed on to the new process
+type copyoverState struct {
+	Listeners   map[string]uintptr   `json:"listeners"`
+	Connections []copyoverConnection `json:"connections"`
+}
+
+type copyoverConnection struct {
+	ID         string      `json:"id"`
+	FD         uintptr     `json:"fd"`
+	RemoteAddr string      `json:"remote_addr"`
+	AuthToken  string      `json:"auth_token,omitempty"`
+	Connected  time.Time   `json:"connected"`
+	Telnet     telnetState `json:"telnet"`
+
+	TerminalType string `json:"terminal_type,omitempty"`
+	Columns      int    `json:"columns"`
+	Rows         int    `json:"rows"`
+	VT100        bool   `json:"vt100,omitempty"`
+
+	HidingInput      bool                   `json:"hiding_input,omitempty"`
+	ColorDepth       color.ColorDepth       `json:"color_depth,omitempty"`
+	ScreenReaderMode types.ScreenReaderMode `json:"screen_reader_mode,omitempty"`
+	Recording        string                 `json:"recording,omitempty"`
+}
+
+// telnetState is what the protocol side of a connection has agreed on
+type telnetState struct {
+	LocalOptions  []byte `json:"local_options,omitempty"`
+	RemoteOptions []byte `json:"remote_options,omitempty"`
+	Compressed    bool   `json:"compressed,omitempty"`
+
+	Charset       string    `json:"charset,omitempty"`
+	TerminalTypes []string  `json:"terminal_types,omitempty"`
+	Width         int       `json:"width,omitempty"`
+	Height        int       `json:"height,omitempty"`
+	LastInput     time.Time `json:"last_input"`
+
+	GMCPClient        string            `json:"gmcp_client,omitempty"`
+	GMCPClientVersion string            `json:"gmcp_client_version,omitempty"`
+	GMCPSupports      map[string]int    `json:"gmcp_supports,omitempty"`
+	MSDPValues        map[string][]byte `json:"msdp_values,omitempty"`
+	MSDPReported      []string          `json:"msdp_reported,omitempty"`
+}
+
+// saveState returns the options agreed with the client and what it has told
+// the server about itself
+func (t *Telnet) saveState() telnetState {
+	var state telnetState
+
+	t.options.lock.Lock()
+	for option, sides := range t.options.states {
+		if sides.local.state == qYes {
+			state.LocalOptions = append(state.LocalOptions, option)
+		}
+		if sides.remote.state == qYes {
+			state.RemoteOptions = append(state.RemoteOptions, option)
+		}
+	}
+	t.options.lock.Unlock()
+
+	state.Compressed = t.Compressed()
+	state.Charset = t.Charset()
+	state.Width, state.Height = t.WindowSize()
+
+	t.ttype.lock.RLock()
+	state.TerminalTypes = append([]string(nil), t.ttype.responses...)
+	t.ttype.lock.RUnlock()
+
+	t.inputLock.RLock()
+	state.LastInput = t.lastInput
+	t.inputLock.RUnlock()
+
+	t.gmcp.lock.RLock()
+	state.GMCPClient = t.gmcp.client
+	state.GMCPClientVersion = t.gmcp.clientVersion
+	if t.gmcp.supports != nil {
+		state.GMCPSupports = map[string]int{}
+		for name, version := range t.gmcp.supports {
+			state.GMCPSupports[name] = version
+		}
+	}
+	t.gmcp.lock.RUnlock()
+
+	t.msdp.lock.Lock()
+	if t.msdp.values != nil {
+		state.MSDPValues = map[string][]byte{}
+		for name, value := range t.msdp.values {
+			state.MSDPValues[name] = append([]byte(nil), value...)
+		}
+	}
+	for name, reported := range t.msdp.reported {
+		if reported {
+			state.MSDPReported = append(state.MSDPReported, name)
+		}
+	}
+	t.msdp.lock.Unlock()
+
+	return state
+}
+
+// restoreState picks up where saveState left off, without negotiating
+// anything again apart from restarting compression
+func (t *Telnet) restoreState(state telnetState) {
+	t.options.lock.Lock()
+	for _, option := range state.LocalOptions {
+		t.options.side(option, true).state = qYes
+	}
+	for _, option := range state.RemoteOptions {
+		t.options.side(option, false).state = qYes
+	}
+	t.options.lock.Unlock()
+
+	if state.Charset != "" {
+		t.charset.lock.Lock()
+		t.charset.name = state.Charset
+		t.charset.answered = true
+		t.charset.lock.Unlock()
+	}
+	if len(state.TerminalTypes) > 0 {
+		t.ttype.lock.Lock()
+		t.ttype.responses = state.TerminalTypes
+		t.ttype.capabilities = parseMTTS(state.TerminalTypes)
+		t.ttype.lock.Unlock()
+	}
+	if state.Width > 0 && state.Height > 0 {
+		t.setWindowSize(state.Width, state.Height)
+	}
+	if !state.LastInput.IsZero() {
+		t.inputLock.Lock()
+		t.lastInput = state.LastInput
+		t.inputLock.Unlock()
+	}
+
+	t.gmcp.lock.Lock()
+	t.gmcp.client = state.GMCPClient
+	t.gmcp.clientVersion = state.GMCPClientVersion
+	t.gmcp.supports = state.GMCPSupports
+	t.gmcp.lock.Unlock()
+
+	t.msdp.lock.Lock()
+	t.msdp.values = state.MSDPValues
+	t.msdp.reported = map[string]bool{}
+	for _, name := range state.MSDPReported {
+		t.msdp.reported[name] = true
+	}
+	t.msdp.lock.Unlock()
+
+	if state.Compressed {
+		t.StartCompression()
+	}
+}
+
+// saveConnection returns the state of a connection that can be carried over,
+// along with its socket, or false if it can't be
+func saveConnection(c *ConnectionHandler) (copyoverConnection, *net.TCPConn, bool) {
+	tcp := tcpConnOf(c.conn.Telnet.conn)
+	if tcp == nil {
+		return copyoverConnection{}, nil, false
+	}
+
+	wc := c.conn
+	state := copyoverConnection{
+		ID:          c.id,
+		AuthToken:   c.AuthToken(),
+		Connected:   c.connected,
+		RemoteAddr:  wc.RemoteAddr().String(),
+		Telnet:      wc.Telnet.saveState(),
+		HidingInput: wc.hidingInput,
+	}
+
+	if c.term != nil {
+		state.TerminalType = c.term.Type
+		state.Columns, state.Rows = c.term.Size()
+		state.VT100 = c.term.VT100
+	}
+
+	wc.settingsLock.RLock()
+	state.ColorDepth = wc.colorDepth
+	state.ScreenReaderMode = wc.screenReaderMode
+	wc.settingsLock.RUnlock()
+
+	wc.recordLock.Lock()
+	if wc.recording != nil {
+		state.Recording = wc.recording.Name()
+	}
+	wc.recordLock.Unlock()
+
+	return state, tcp, true
+}
+
+// tcpConnOf returns the TCP connection underneath conn, or nil if there is
+// something in the way that can't be carried over, such as TLS
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *admittedConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// restoredConn reports the client's address from before the copyover, which
+// may have come from a PROXY protocol header
+type restoredConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *restoredConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// copyoverAddr is a remote address read back from the state file
+type copyoverAddr string
+
+func (a copyoverAddr) Network() string {
+	return "tcp"
+}
+
+func (a copyoverAddr) String() string {
+	return string(a)
+}
+
+// loadCopyoverState reads the state left by the process before a copyover,
+// if this process was started by one
+func loadCopyoverState() (*copyoverState, error) {
+	path := os.Getenv(copyoverStateVariable)
+	if path == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(copyoverStateVariable)
+	defer os.Remove(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("could not read copyover state: " + err.Error())
+	}
+
+	var state copyoverState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.New("could not read copyover state: " + err.Error())
+	}
+
+	log.Printf("Recovering from copyover with %v connections", len(state.Connections))
+	return &state, nil
+}
+
+// inheritedListener returns the listener with the given name carried over
+// from before a copyover, or nil if there isn't one
+func (s *Server) inheritedListener(name string) net.Listener {
+	if s.copyover == nil {
+		return nil
+	}
+
+	fd, found := s.copyover.Listeners[name]
+	if !found {
+		return nil
+	}
+	delete(s.copyover.Listeners, name)
+
+	file := os.NewFile(fd, name+" listener")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		utils.Error("could not recover " + name + " listener: " + err.Error())
+		return nil
+	}
+	return listener
+}
+
+// restoreConnections hands the connections carried over from before a
+// copyover back to the runner
+func (s *Server) restoreConnections(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	if s.copyover == nil {
+		return
+	}
+
+	for _, state := range s.copyover.Connections {
+		if err := s.restoreConnection(state, runner, conf); err != nil {
+			utils.Error("could not recover connection " + state.ID + ": " + err.Error())
+		}
+	}
+	s.copyover = nil
+}
+
+func (s *Server) restoreConnection(state copyoverConnection, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) error {
+	file := os.NewFile(state.FD, "connection "+state.ID)
+	conn, err := net.FileConn(file)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+
+	if state.RemoteAddr != conn.RemoteAddr().String() {
+		conn = &restoredConn{Conn: conn, remote: copyoverAddr(state.RemoteAddr)}
+	}
+	conn = &admittedConn{Conn: conn, release: s.access.readmit(state.RemoteAddr)}
+
+	t := NewTelnet(conn)
+	t.SetMSSPSource(s.MSSPVariables)
+	t.restoreState(state.Telnet)
+
+	term := &Terminal{telnet: t, Type: state.TerminalType, VT100: state.VT100, Capabilities: t.Capabilities()}
+	term.setSize(state.Columns, state.Rows)
+	t.OnWindowSize(term.setSize)
+
+	wc := newWrappedConnection(t)
+	wc.access = s.access
+	wc.recordingDir = s.config.Server.RecordingDir
+	wc.recordingLimit = recordingLimitFromConfig(s.config)
+	wc.colorDepth = state.ColorDepth
+	wc.screenReaderMode = state.ScreenReaderMode
+	if state.HidingInput {
+		// The runner starts over, so whatever was being hidden is gone
+		t.WontEcho()
+	}
+	if state.Recording != "" {
+		if err := wc.resumeRecording(state.Recording); err != nil {
+			utils.Error("could not resume recording " + state.Recording + ": " + err.Error())
+		}
+	}
+
+	ch := &ConnectionHandler{
+		id:        state.ID,
+		config:    s.config,
+		conn:      wc,
+		pool:      s.pool.messages,
+		connected: state.Connected,
+		authToken: state.AuthToken,
+		term:      term,
+	}
+	if err = s.pool.AddToPool(ch); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	ch.WriteLine("Copyover complete.")
+	ch.Handle(runner, term, conf)
+	return nil
+}
+
+// resumeRecording carries on recording to a file started before a copyover
+func (wc *WrappedConnection) resumeRecording(path string) error {
+	wc.recordLock.Lock()
+	defer wc.recordLock.Unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	wc.record(file, info.Size())
+	return nil
+}
+
+// Copyover restarts the server from its binary, carrying over every
+// connection it can. It only returns if the restart failed, in which case
+// everyone is still connected to this process.
+func (s *Server) Copyover() error {
+	if !copyoverSupported {
+		return ErrCopyoverUnsupported
+	}
+
+	s.copyoverLock.Lock()
+	defer s.copyoverLock.Unlock()
+
+	if s.ShuttingDown() {
+		return errors.New("copyover cancelled, the server is shutting down")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	state := copyoverState{Listeners: map[string]uintptr{}}
+	var inherited []syscall.Conn
+	defer func() {
+		// Only reached if the exec failed
+		for _, conn := range inherited {
+			_ = setInheritable(conn, false)
+		}
+	}()
+
+	for name, listener := range s.listeners {
+		conn, ok := listener.(syscall.Conn)
+		if !ok {
+			continue
+		}
+		fd, err := inheritableFD(conn)
+		if err != nil {
+			return errors.New("could not keep " + name + " listener open: " + err.Error())
+		}
+		inherited = append(inherited, conn)
+		state.Listeners[name] = fd
+	}
+
+	var carried, dropped []*ConnectionHandler
+	sockets := map[*ConnectionHandler]*net.TCPConn{}
+	for _, c := range s.pool.snapshot() {
+		conn, tcp, ok := saveConnection(c)
+		if !ok {
+			dropped = append(dropped, c)
+			continue
+		}
+		fd, err := inheritableFD(tcp)
+		if err != nil {
+			utils.Error("could not keep connection " + c.id + " open: " + err.Error())
+			dropped = append(dropped, c)
+			continue
+		}
+		inherited = append(inherited, tcp)
+		conn.FD = fd
+		state.Connections = append(state.Connections, conn)
+		carried = append(carried, c)
+		sockets[c] = tcp
+	}
+
+	// Clients that don't take their message in time aren't carried over, so
+	// that none of them can hold up the copyover
+	tellCopyover(dropped, "The server is restarting, please reconnect.", false)
+	stalled := tellCopyover(carried, "Copyover in progress, please wait...", true)
+	for _, c := range stalled {
+		utils.Error("write timed out for " + c.id + ", dropping it from the copyover")
+		state.Connections = removeCopyoverConnection(state.Connections, c.id)
+		carried = removeWrappedConnection(carried, c)
+		_ = setInheritable(sockets[c], false)
+		c.Close()
+	}
+
+	path, err := writeCopyoverState(state)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	log.Printf("Copyover with %v connections, dropping %v", len(carried), len(dropped)+len(stalled))
+
+	env := append(os.Environ(), copyoverStateVariable+"="+path)
+	err = execve(executable, os.Args, env)
+
+	for _, c := range carried {
+		for _, conn := range state.Connections {
+			if conn.ID == c.id && conn.Telnet.Compressed {
+				c.conn.StartCompression()
+			}
+		}
+	}
+	s.pool.BroadcastMessage("Copyover failed, carry on.", nil)
+	return errors.New("copyover failed: " + err.Error())
+}
+
+// tellCopyover writes message to every one of conns at once, ending their
+// compression afterwards if endCompression is true, and returns those that
+// didn't take it within ShutdownWriteTimeout
+func tellCopyover(conns []*ConnectionHandler, message string, endCompression bool) []*ConnectionHandler {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var stalled []*ConnectionHandler
+
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *ConnectionHandler) {
+			defer wg.Done()
+
+			err := c.conn.writeWithin(ShutdownWriteTimeout, func() error {
+				if err := utils.WriteLine(c.conn, message, color.ModeNone); err != nil {
+					return err
+				}
+				if endCompression {
+					c.conn.EndCompression()
+				}
+				return nil
+			})
+			if err != nil {
+				lock.Lock()
+				stalled = append(stalled, c)
+				lock.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return stalled
+}
+
+// removeCopyoverConnection returns conns without the one with the given ID
+func removeCopyoverConnection(conns []copyoverConnection, id string) []copyoverConnection {
+	for i, conn := range conns {
+		if conn.ID == id {
+			return append(conns[:i:i], conns[i+1:]...)
+		}
+	}
+	return conns
+}
+
+// writeCopyoverState writes state to a temporary file for the new process,
+// returning its path
+func writeCopyoverState(state copyoverState) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "kmud-copyover-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(data); err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// inheritableFD returns the file descriptor of conn, which is left open
+// across exec from now on. The descriptor isn't taken out of the runtime's
+// hands, so the connection carries on working until then.
+func inheritableFD(conn syscall.Conn) (uintptr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd uintptr
+	err = raw.Control(func(f uintptr) {
+		fd = f
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fd, setInheritable(conn, true)
+}
+
+// HandleCopyoverSignal copies over whenever the process receives
+// CopyoverSignal, it doesn't return
+func (s *Server) HandleCopyoverSignal() {
+	if !copyoverSupported {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, copyoverSignal)
+	for range signals {
+		log.Println("Copyover requested")
+		if err := s.Copyover(); err != nil {
+			utils.Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package telnet
+
+import (
+	"os"
+	"syscall"
+)
+
+const copyoverSupported = false
+
+var copyoverSignal os.Signal
+
+func setInheritable(conn syscall.Conn, inherit bool) error {
+	return ErrCopyoverUnsupported
+}
+
+func execve(path string, args []string, env []string) error {
+	return ErrCopyoverUnsupported
+}
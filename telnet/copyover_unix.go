@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package telnet
+
+import (
+	"syscall"
+)
+
+const copyoverSupported = true
+
+// copyoverSignal asks a running server to copy over
+const copyoverSignal = syscall.SIGUSR2
+
+// setInheritable sets whether conn's file descriptor is left open across exec
+func setInheritable(conn syscall.Conn, inherit bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var flags uintptr
+	if !inherit {
+		flags = syscall.FD_CLOEXEC
+	}
+
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, flags)
+		if errno != 0 {
+			opErr = errno
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func execve(path string, args []string, env []string) error {
+	return syscall.Exec(path, args, env)
+}
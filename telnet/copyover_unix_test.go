@@ -0,0 +1,188 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package telnet
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+)
+
+// dupFD returns a copy of fd for the copyover code to take over and close,
+// the way it would a descriptor inherited across exec
+func dupFD(t *testing.T, fd uintptr) uintptr {
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		t.Fatalf("Dup() failed: %v", err)
+	}
+	return uintptr(dup)
+}
+
+func Test_Copyover(t *testing.T) {
+	conf := &config.Config{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer client.Close()
+	var received bytes.Buffer
+	var lock sync.Mutex
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := client.Read(buf)
+			lock.Lock()
+			received.Write(buf[:n])
+			lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	serverSide, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+	defer serverSide.Close()
+
+	old := NewTelnet(&admittedConn{Conn: serverSide, release: func() {}})
+	old.options.side(codeToByte[ECHO], true).state = qYes
+	old.options.side(codeToByte[WS], false).state = qYes
+	old.SetCharset("UTF-8")
+	old.setWindowSize(100, 40)
+	term := &Terminal{telnet: old, Type: "XTERM", VT100: true}
+	term.setSize(100, 40)
+
+	ch := &ConnectionHandler{
+		id:        "copied",
+		config:    conf,
+		conn:      newWrappedConnection(old),
+		connected: time.Now(),
+		authToken: "token",
+		term:      term,
+	}
+
+	saved, tcp, ok := saveConnection(ch)
+	if !ok {
+		t.Fatalf("saveConnection() of a TCP connection returned false")
+	}
+	piped, _ := net.Pipe()
+	if _, _, ok := saveConnection(&ConnectionHandler{conn: newWrappedConnection(NewTelnet(piped))}); ok {
+		t.Errorf("saveConnection() of a pipe returned true")
+	}
+
+	// The new process would inherit the descriptor itself, here it has to
+	// be a copy so that the old connection can be closed separately. It is
+	// restoreConnection's to close, file must keep its own.
+	file, err := tcp.File()
+	if err != nil {
+		t.Fatalf("File() failed: %v", err)
+	}
+	defer file.Close()
+	saved.FD = dupFD(t, file.Fd())
+
+	path, err := writeCopyoverState(copyoverState{Connections: []copyoverConnection{saved}})
+	if err != nil {
+		t.Fatalf("writeCopyoverState() failed: %v", err)
+	}
+	t.Setenv(copyoverStateVariable, path)
+	state, err := loadCopyoverState()
+	if err != nil || state == nil || len(state.Connections) != 1 {
+		t.Fatalf("loadCopyoverState() == %v, %v, want one connection", state, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("loadCopyoverState() left the state file behind")
+	}
+
+	server := NewServer(conf)
+	server.access, _ = NewAccessControl(conf)
+	server.CreateConnectionPool()
+	server.copyover = state
+
+	restored := make(chan *ConnectionHandler, 1)
+	terms := make(chan *Terminal, 1)
+	server.restoreConnections(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		restored <- c
+		terms <- term
+	}, conf)
+
+	var c *ConnectionHandler
+	select {
+	case c = <-restored:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Restored connection was never handed to the runner")
+	}
+	defer c.conn.Telnet.conn.Close()
+
+	if c.id != "copied" || c.AuthToken() != "token" {
+		t.Errorf("Restored connection is %v with token %q, want copied with token", c.id, c.AuthToken())
+	}
+	if addr := c.GetConn().RemoteAddr().String(); addr != client.LocalAddr().String() {
+		t.Errorf("Restored RemoteAddr() == %v, want %v", addr, client.LocalAddr())
+	}
+
+	nt := c.conn.Telnet
+	if nt.optionState(ECHO, true) != qYes || nt.optionState(WS, false) != qYes {
+		t.Errorf("Restored connection lost its options")
+	}
+	if nt.Charset() != "UTF-8" {
+		t.Errorf("Restored Charset() == %v, want UTF-8", nt.Charset())
+	}
+	if width, height := nt.WindowSize(); width != 100 || height != 40 {
+		t.Errorf("Restored WindowSize() == %v, %v, want 100, 40", width, height)
+	}
+	if term := <-terms; term.Type != "XTERM" || !term.VT100 {
+		t.Errorf("Restored terminal is %v, VT100 %v, want XTERM", term.Type, term.VT100)
+	} else if columns, rows := term.Size(); columns != 100 || rows != 40 {
+		t.Errorf("Restored terminal size == %v, %v, want 100, 40", columns, rows)
+	}
+
+	waitFor(t, "the copyover message", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Contains(received.String(), "Copyover complete.")
+	})
+}
+
+func Test_CopyoverListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File() failed: %v", err)
+	}
+	defer file.Close()
+
+	server := NewServer(&config.Config{})
+	server.copyover = &copyoverState{Listeners: map[string]uintptr{listenerTelnet: dupFD(t, file.Fd())}}
+	inherited, err := server.listen(listenerTelnet, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen() failed: %v", err)
+	}
+	defer inherited.Close()
+
+	if inherited.Addr().String() != listener.Addr().String() {
+		t.Errorf("Inherited listener is on %v, want %v", inherited.Addr(), listener.Addr())
+	}
+	if server.listeners[listenerTelnet] != inherited {
+		t.Errorf("Inherited listener wasn't recorded for the next copyover")
+	}
+}
@@ -0,0 +1,231 @@
+package telnet
+
+/*
+GMCP (Generic Mud Communication Protocol)
+https://mudhalla.net/tintin/protocols/gmcp/
+https://www.gammon.com.au/gmcp
+
+Messages are sent as IAC SB GMCP <package.name> <json> IAC SE in both
+directions. The client announces itself with Core.Hello and lists the modules
+it wants to receive with Core.Supports.Set/Add/Remove.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GMCPHandler is called with the connection a package arrived on, the package
+// name as sent by the client and its raw JSON payload (which may be empty).
+type GMCPHandler func(t *Telnet, pkg string, data []byte)
+
+// gmcpHandlers holds pointers so that a subscription can find itself again
+var gmcpHandlers = map[string][]*GMCPHandler{}
+var gmcpHandlersLock sync.RWMutex
+
+// SubscribeGMCP registers handler to be called whenever any client sends the
+// given package. Package names are case insensitive. The returned function
+// unsubscribes the handler.
+func SubscribeGMCP(pkg string, handler GMCPHandler) (unsubscribe func()) {
+	gmcpHandlersLock.Lock()
+	defer gmcpHandlersLock.Unlock()
+
+	pkg = strings.ToLower(pkg)
+	registered := &handler
+	gmcpHandlers[pkg] = append(gmcpHandlers[pkg], registered)
+
+	return func() {
+		gmcpHandlersLock.Lock()
+		defer gmcpHandlersLock.Unlock()
+
+		handlers := gmcpHandlers[pkg]
+		for i, h := range handlers {
+			if h == registered {
+				// Copy rather than shift in place, handleGMCP may be ranging
+				// over the old slice
+				remaining := make([]*GMCPHandler, 0, len(handlers)-1)
+				remaining = append(remaining, handlers[:i]...)
+				gmcpHandlers[pkg] = append(remaining, handlers[i+1:]...)
+				break
+			}
+		}
+		if len(gmcpHandlers[pkg]) == 0 {
+			delete(gmcpHandlers, pkg)
+		}
+	}
+}
+
+func init() {
+	RegisterOption(GMCP, OptionHandler{
+		AcceptLocal: true,
+		Subnegotiation: func(t *Telnet, data []byte) {
+			t.handleGMCP(data)
+		},
+	})
+}
+
+type gmcpState struct {
+	lock          sync.RWMutex
+	client        string
+	clientVersion string
+	supports      map[string]int
+}
+
+// OfferGMCP tells the client that the server is willing to speak GMCP
+func (t *Telnet) OfferGMCP() {
+	t.EnableLocal(GMCP)
+}
+
+// GMCPEnabled returns true if the client has agreed to speak GMCP
+func (t *Telnet) GMCPEnabled() bool {
+	return t.LocalEnabled(GMCP)
+}
+
+// GMCPClient returns the client name and version sent with Core.Hello
+func (t *Telnet) GMCPClient() (string, string) {
+	t.gmcp.lock.RLock()
+	defer t.gmcp.lock.RUnlock()
+
+	return t.gmcp.client, t.gmcp.clientVersion
+}
+
+// GMCPSupports returns true if the client has asked to receive the given
+// package, or a module it belongs to, such as Char for Char.Vitals. Core is
+// always supported.
+func (t *Telnet) GMCPSupports(pkg string) bool {
+	parts := strings.Split(strings.ToLower(pkg), ".")
+	if parts[0] == "core" {
+		return true
+	}
+
+	t.gmcp.lock.RLock()
+	defer t.gmcp.lock.RUnlock()
+
+	for i := range parts {
+		if _, found := t.gmcp.supports[strings.Join(parts[:i+1], ".")]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// SendGMCP marshals data to JSON and sends it to the client as the given
+// package. Nothing is sent if the client hasn't negotiated GMCP or hasn't
+// asked for the package's module, so callers don't need to check first.
+func (t *Telnet) SendGMCP(pkg string, data interface{}) error {
+	if !t.GMCPEnabled() || !t.GMCPSupports(pkg) {
+		return nil
+	}
+
+	message := []byte(pkg)
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		message = append(message, ' ')
+		message = append(message, payload...)
+	}
+
+	return t.sendSubnegotiation(GMCP, message)
+}
+
+// sendSubnegotiation wraps data in IAC SB <option> ... IAC SE, escaping any
+// IAC bytes found in the data
+func (t *Telnet) sendSubnegotiation(option TelnetCode, data []byte) error {
+	iac := []byte{codeToByte[IAC]}
+	data = bytes.Replace(data, iac, []byte{codeToByte[IAC], codeToByte[IAC]}, -1)
+
+	command := BuildCommand(SB, option)
+	command = append(command, data...)
+	command = append(command, BuildCommand(SE)...)
+
+	_, err := t.Write(command)
+	return err
+}
+
+func (t *Telnet) handleGMCP(data []byte) {
+	message := strings.TrimSpace(string(data))
+	if message == "" {
+		return
+	}
+
+	pkg := message
+	payload := ""
+	if index := strings.IndexAny(message, " \t"); index != -1 {
+		pkg = message[:index]
+		payload = strings.TrimSpace(message[index+1:])
+	}
+
+	switch strings.ToLower(pkg) {
+	case "core.hello":
+		var hello struct {
+			Client  string `json:"client"`
+			Version string `json:"version"`
+		}
+		if json.Unmarshal([]byte(payload), &hello) == nil {
+			t.gmcp.lock.Lock()
+			t.gmcp.client = hello.Client
+			t.gmcp.clientVersion = hello.Version
+			t.gmcp.lock.Unlock()
+		}
+	case "core.supports.set":
+		t.gmcp.lock.Lock()
+		t.gmcp.supports = map[string]int{}
+		t.gmcp.lock.Unlock()
+		t.updateGMCPSupports(payload, true)
+	case "core.supports.add":
+		t.updateGMCPSupports(payload, true)
+	case "core.supports.remove":
+		t.updateGMCPSupports(payload, false)
+	case "core.ping":
+		_ = t.SendGMCP("Core.Ping", nil)
+	}
+
+	gmcpHandlersLock.RLock()
+	handlers := gmcpHandlers[strings.ToLower(pkg)]
+	gmcpHandlersLock.RUnlock()
+
+	for _, handler := range handlers {
+		(*handler)(t, pkg, []byte(payload))
+	}
+}
+
+// updateGMCPSupports parses a Core.Supports list such as ["Char 1", "Room 1"]
+func (t *Telnet) updateGMCPSupports(payload string, add bool) {
+	var modules []string
+	if json.Unmarshal([]byte(payload), &modules) != nil {
+		return
+	}
+
+	t.gmcp.lock.Lock()
+	defer t.gmcp.lock.Unlock()
+
+	if t.gmcp.supports == nil {
+		t.gmcp.supports = map[string]int{}
+	}
+
+	for _, module := range modules {
+		fields := strings.Fields(module)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(fields[0])
+		if !add {
+			delete(t.gmcp.supports, name)
+			continue
+		}
+
+		version := 1
+		if len(fields) > 1 {
+			if v, err := strconv.Atoi(fields[1]); err == nil {
+				version = v
+			}
+		}
+		t.gmcp.supports[name] = version
+	}
+}
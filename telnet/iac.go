@@ -7,85 +7,101 @@ https://users.cs.cf.ac.uk/Dave.Marshall/Internet/node141.html
 */
 
 import (
-	"errors"
-	"strconv"
 	"strings"
 )
 
+func init() {
+	RegisterOption(ECHO, OptionHandler{})
+}
+
 func (t *Telnet) WillEcho() {
-	t.SendCommand(WILL, ECHO)
+	t.EnableLocal(ECHO)
 }
 
 func (t *Telnet) WontEcho() {
-	t.SendCommand(WONT, ECHO)
+	t.DisableLocal(ECHO)
 }
 
+// DoWindowSize asks the client to report its window size and waits for the
+// first report, for at most NegotiationTimeout. Later reports are tracked as
+// they arrive, see WindowSize.
 func (t *Telnet) DoWindowSize() (int, int, error) {
-	t.SendCommand(DO, WS)
-	response, err := t.ReadIACResponse()
+	t.EnableRemote(WS)
+
+	reported := func() bool {
+		x, y := t.WindowSize()
+		return x > 0 && y > 0
+	}
+
+	err := t.awaitNegotiation(func() bool {
+		return reported() || t.remoteRefused(WS)
+	})
 	if err != nil {
 		return 0, 0, err
 	}
-	x := 0
-	y := 0
-	if strings.Contains(response, "IAC WILL WS") {
-		codes := strings.Split(response, " ")
-		for _, code := range codes {
-			if strings.Contains(code, "??(") {
-				code = strings.TrimPrefix(code, "??(")
-				code = strings.TrimSuffix(code, ")")
-				if x == 0 {
-					x, err = strconv.Atoi(code)
-					if err != nil {
-						return 0, 0, errors.New("IAC window size conversion failed")
-					}
-				} else {
-					y, err = strconv.Atoi(code)
-					if err != nil {
-						return 0, 0, errors.New("IAC window size conversion failed")
-					}
-				}
-			}
-		}
-		return x, y, nil
+	if !reported() {
+		return 0, 0, ErrNegotiationRefused
 	}
 
-	return 0, 0, errors.New("no proper window size response found")
+	x, y := t.WindowSize()
+	return x, y, nil
 }
 
+// DoTerminalType asks the client for its terminal type, going through the
+// MTTS cycle for clients that support it, see Capabilities. Each answer is
+// waited on for at most NegotiationTimeout.
 func (t *Telnet) DoTerminalType() (string, error) {
-	// This is really supposed to be two commands, one to ask if they'll send a
-	// terminal type, and another to indicate that they should send it if
-	// they've expressed a "willingness" to send it. For the time being this
-	// works well enough.
-
-	// See http://tools.ietf.org/html/rfc884
+	// See http://tools.ietf.org/html/rfc1091
+	t.ttype.lock.Lock()
+	t.ttype.responses = nil
+	t.ttype.capabilities = Capabilities{}
+	t.ttype.lock.Unlock()
+
+	if t.RemoteEnabled(TT) {
+		// Turning TTYPE off and on again starts the MTTS cycle over
+		t.DisableRemote(TT)
+	}
+	t.EnableRemote(TT)
 
-	t.SendCommand(DO, TT, IAC, SB, TT, 1, IAC, SE) // 1 = SEND
-	iac, err := t.ReadIACResponse()
+	err := t.awaitNegotiation(func() bool {
+		count, _ := t.terminalTypeResponses()
+		return count > 0 || t.remoteRefused(TT)
+	})
 	if err != nil {
 		return "", err
 	}
-	iacfields := strings.Split(iac, " ")
-
-	var term string
-	for _, field := range iacfields {
-		if strings.Contains(field, "??(") {
-			field = strings.TrimPrefix(field, "??(")
-			field = strings.TrimSuffix(field, ")")
-			val, err := strconv.Atoi(field)
-			if err != nil {
-				return "", err
+	if t.TerminalType() == "" {
+		return "", ErrNegotiationRefused
+	}
+
+	for {
+		count, done := t.terminalTypeResponses()
+		if done {
+			break
+		}
+
+		t.requestTerminalType()
+		err = t.awaitNegotiation(func() bool {
+			answered, _ := t.terminalTypeResponses()
+			return answered > count || t.remoteRefused(TT)
+		})
+		if err != nil {
+			if negotiationFailed(err) {
+				// Keep what the client has told us so far
+				break
 			}
-			term = term + string(val)
+			return "", err
+		}
+		if t.remoteRefused(TT) {
+			break
 		}
 	}
 
-	return strings.ToLower(term), err
+	return t.TerminalType(), nil
 }
 
 func (t *Telnet) SendCommand(codes ...TelnetCode) {
-	t.conn.Write(BuildCommand(codes...))
+	t.Write(BuildCommand(codes...))
 }
 
 func (t *Telnet) ReadIACResponse() (string, error) {
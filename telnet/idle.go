@@ -0,0 +1,197 @@
+package telnet
+
+/*
+Idle timeouts and keepalives
+
+Connections that send no text for too long are warned and then disconnected,
+with separate limits for connections still at the login menu and logged in
+ones. Telnet commands don't count as activity.
+
+Every connection is also sent a NOP (or AYT) now and then. Writing to a
+half-open connection fails, or blocks until KeepaliveTimeout passes, either
+of which gets it disconnected rather than left in the pool for good.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+// IdleCheckInterval is how often connections are checked for being idle
+var IdleCheckInterval = time.Second
+
+// KeepaliveTimeout is how long a keepalive may take to write before the
+// connection is given up on
+var KeepaliveTimeout = 30 * time.Second
+
+// IdleSettings say when idle connections are warned and disconnected and how
+// often keepalives are sent, zero durations turn each off
+type IdleSettings struct {
+	LoginTimeout      time.Duration
+	GameTimeout       time.Duration
+	Warning           time.Duration // How long before disconnecting to warn
+	KeepaliveInterval time.Duration
+	KeepaliveCommand  TelnetCode // NOP or AYT
+}
+
+// IdleSettingsFromConfig reads the idle settings from the server config
+func IdleSettingsFromConfig(conf *config.Config) (IdleSettings, error) {
+	settings := IdleSettings{KeepaliveCommand: NOP}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"login_idle_timeout", conf.Server.LoginIdleTimeout, &settings.LoginTimeout},
+		{"game_idle_timeout", conf.Server.GameIdleTimeout, &settings.GameTimeout},
+		{"idle_warning", conf.Server.IdleWarning, &settings.Warning},
+		{"keepalive_interval", conf.Server.KeepaliveInterval, &settings.KeepaliveInterval},
+	}
+
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value < 0 {
+			return IdleSettings{}, errors.New("invalid " + duration.name + ": " + duration.value)
+		}
+		*duration.dest = value
+	}
+
+	switch strings.ToLower(conf.Server.KeepaliveCommand) {
+	case "", "nop":
+	case "ayt":
+		settings.KeepaliveCommand = AYT
+	default:
+		return IdleSettings{}, errors.New("invalid keepalive_command: " + conf.Server.KeepaliveCommand)
+	}
+
+	return settings, nil
+}
+
+func (s IdleSettings) enabled() bool {
+	return s.LoginTimeout > 0 || s.GameTimeout > 0 || s.KeepaliveInterval > 0
+}
+
+// SendKeepalive sends the client a command that needs no answer, to find out
+// whether the connection is still there
+func (t *Telnet) SendKeepalive(code TelnetCode) error {
+	return t.writeWithin(KeepaliveTimeout, func() error {
+		_, err := t.Write(BuildCommand(code))
+		return err
+	})
+}
+
+// writeWithin calls write with a deadline on writing to the client, so that it
+// can't block for longer than timeout. Only one writeWithin runs at a time, so
+// that none clears the deadline of another. The deadline is on the connection,
+// so any other write to the client that is stuck meanwhile gives up with it.
+func (t *Telnet) writeWithin(timeout time.Duration, write func() error) error {
+	t.withinLock.Lock()
+	defer t.withinLock.Unlock()
+
+	_ = t.SetWriteDeadline(time.Now().Add(timeout))
+	defer t.SetWriteDeadline(time.Time{})
+
+	return write()
+}
+
+// WatchIdle warns and disconnects idle connections and sends keepalives the
+// way settings say, reporting what it finds to the pool
+func (p *ConnectionPool) WatchIdle(settings IdleSettings) {
+	if !settings.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(IdleCheckInterval)
+	defer ticker.Stop()
+
+	warned := map[string]bool{}
+	lastKeepalive := time.Now()
+
+	for now := range ticker.C {
+		p.checkIdle(settings, warned)
+
+		if settings.KeepaliveInterval > 0 && now.Sub(lastKeepalive) >= settings.KeepaliveInterval {
+			lastKeepalive = now
+			p.sendKeepalives(settings.KeepaliveCommand)
+		}
+	}
+}
+
+// checkIdle sends a warning or timeout message to the pool for each
+// connection that has been idle for long enough, warned keeps track of the
+// connections already warned
+func (p *ConnectionPool) checkIdle(settings IdleSettings, warned map[string]bool) {
+	current := map[string]bool{}
+
+	for _, conn := range p.snapshot() {
+		current[conn.id] = true
+
+		timeout := settings.LoginTimeout
+		if conn.Authenticated() {
+			timeout = settings.GameTimeout
+		}
+
+		idle := conn.conn.IdleTime()
+		switch {
+		case timeout <= 0:
+			delete(warned, conn.id)
+		case idle >= timeout:
+			delete(warned, conn.id)
+			p.messages <- PoolMessage{TargetID: conn.id, Type: "timeout"}
+		case settings.Warning > 0 && settings.Warning < timeout && idle >= timeout-settings.Warning:
+			if !warned[conn.id] {
+				warned[conn.id] = true
+				message := fmt.Sprintf("You will be disconnected for inactivity in %s.", formatDuration(timeout-idle))
+				p.messages <- PoolMessage{TargetID: conn.id, Type: "idlewarning", Args: []string{message}}
+			}
+		default:
+			delete(warned, conn.id)
+		}
+	}
+
+	for id := range warned {
+		if !current[id] {
+			delete(warned, id)
+		}
+	}
+}
+
+// sendKeepalives sends every connection a keepalive, disconnecting the ones it
+// can't be written to
+func (p *ConnectionPool) sendKeepalives(code TelnetCode) {
+	for _, conn := range p.snapshot() {
+		go func(conn *ConnectionHandler) {
+			if err := conn.conn.SendKeepalive(code); err != nil {
+				utils.Error("keepalive failed for " + conn.id + ": " + err.Error())
+				p.messages <- PoolMessage{TargetID: conn.id, Type: "disconnect"}
+			}
+		}(conn)
+	}
+}
+
+// formatDuration rounds a duration to whole minutes, or seconds under a minute
+func formatDuration(d time.Duration) string {
+	if d >= time.Minute {
+		minutes := int((d + time.Minute/2) / time.Minute)
+		if minutes == 1 {
+			return "1 minute"
+		}
+		return fmt.Sprintf("%v minutes", minutes)
+	}
+
+	seconds := int((d + time.Second/2) / time.Second)
+	if seconds == 1 {
+		return "1 second"
+	}
+	return fmt.Sprintf("%v seconds", seconds)
+}
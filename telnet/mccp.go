@@ -0,0 +1,73 @@
+package telnet
+
+/*
+MCCP2 (Mud Client Compression Protocol v2)
+https://mudhalla.net/tintin/protocols/mccp/
+
+The server offers IAC WILL COMPRESS2. If the client answers IAC DO COMPRESS2
+the server sends IAC SB COMPRESS2 IAC SE, and every byte written after that
+sequence is part of a zlib stream until the stream is finished.
+*/
+
+import (
+	"compress/zlib"
+)
+
+func init() {
+	RegisterOption(CMP2, OptionHandler{
+		AcceptLocal: true,
+		Enabled: func(t *Telnet, local bool) {
+			t.StartCompression()
+		},
+		Disabled: func(t *Telnet, local bool) {
+			t.EndCompression()
+		},
+	})
+}
+
+// OfferCompression asks the client whether it is willing to receive a
+// compressed stream. Compression starts once the client agrees.
+func (t *Telnet) OfferCompression() {
+	t.EnableLocal(CMP2)
+}
+
+// StartCompression switches the outbound side of the connection over to a
+// zlib stream. Calling it while compression is already active does nothing.
+func (t *Telnet) StartCompression() {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.compressor != nil {
+		return
+	}
+
+	// The start sequence itself must go out uncompressed
+	_, err := t.conn.Write(BuildCommand(SB, CMP2, IAC, SE))
+	if err != nil {
+		return
+	}
+
+	t.compressor = zlib.NewWriter(t.conn)
+}
+
+// EndCompression finishes the zlib stream, after which output is sent
+// uncompressed again.
+func (t *Telnet) EndCompression() {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.compressor == nil {
+		return
+	}
+
+	_ = t.compressor.Close()
+	t.compressor = nil
+}
+
+// Compressed returns true if output to the client is currently compressed
+func (t *Telnet) Compressed() bool {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	return t.compressor != nil
+}
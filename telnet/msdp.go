@@ -0,0 +1,318 @@
+package telnet
+
+/*
+MSDP (Mud Server Data Protocol)
+https://tintin.mudhalla.net/protocols/msdp/
+
+Variables are sent as IAC SB MSDP MSDP_VAR <name> MSDP_VAL <value> IAC SE,
+where a value may itself be a table or an array. Clients use the LIST, REPORT,
+UNREPORT, RESET and SEND commands to discover variables and subscribe to them.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	msdpVar        byte = 1
+	msdpVal        byte = 2
+	msdpTableOpen  byte = 3
+	msdpTableClose byte = 4
+	msdpArrayOpen  byte = 5
+	msdpArrayClose byte = 6
+)
+
+var msdpCommands = []string{"LIST", "REPORT", "RESET", "SEND", "UNREPORT"}
+var msdpLists = []string{"COMMANDS", "LISTS", "CONFIGURABLE_VARIABLES", "REPORTABLE_VARIABLES", "REPORTED_VARIABLES", "SENDABLE_VARIABLES"}
+
+var msdpVariables = map[string]bool{}
+var msdpVariablesLock sync.RWMutex
+
+func init() {
+	RegisterOption(MSDP, OptionHandler{
+		AcceptLocal: true,
+		Subnegotiation: func(t *Telnet, data []byte) {
+			t.handleMSDP(data)
+		},
+	})
+}
+
+// RegisterMSDPVariable makes the given variables reportable and sendable for
+// every connection. Names are upper case by convention, such as HEALTH.
+func RegisterMSDPVariable(names ...string) {
+	msdpVariablesLock.Lock()
+	defer msdpVariablesLock.Unlock()
+
+	for _, name := range names {
+		msdpVariables[strings.ToUpper(name)] = true
+	}
+}
+
+func msdpVariableNames() []string {
+	msdpVariablesLock.RLock()
+	defer msdpVariablesLock.RUnlock()
+
+	var names []string
+	for name := range msdpVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func msdpRegistered(name string) bool {
+	msdpVariablesLock.RLock()
+	defer msdpVariablesLock.RUnlock()
+
+	return msdpVariables[name]
+}
+
+// msdpState is the per-connection variable table. Values are stored already
+// encoded so that changes can be detected by comparing bytes.
+type msdpState struct {
+	lock     sync.Mutex
+	values   map[string][]byte
+	reported map[string]bool
+}
+
+// OfferMSDP tells the client that the server is willing to speak MSDP
+func (t *Telnet) OfferMSDP() {
+	t.EnableLocal(MSDP)
+}
+
+// MSDPEnabled returns true if the client has agreed to speak MSDP
+func (t *Telnet) MSDPEnabled() bool {
+	return t.LocalEnabled(MSDP)
+}
+
+// MSDPReported returns true if the client has asked to be sent updates to the
+// given variable
+func (t *Telnet) MSDPReported(name string) bool {
+	t.msdp.lock.Lock()
+	defer t.msdp.lock.Unlock()
+
+	return t.msdp.reported[strings.ToUpper(name)]
+}
+
+// SetMSDPVariable updates this connection's value for a registered variable.
+// The value is pushed to the client if it has changed and the client asked for
+// it with REPORT. Values may be strings, numbers, slices (sent as arrays) or
+// maps with string keys (sent as tables).
+func (t *Telnet) SetMSDPVariable(name string, value interface{}) error {
+	name = strings.ToUpper(name)
+	if !msdpRegistered(name) {
+		return fmt.Errorf("msdp variable %s is not registered", name)
+	}
+
+	encoded := msdpEncode(value)
+	enabled := t.MSDPEnabled()
+
+	t.msdp.lock.Lock()
+	if t.msdp.values == nil {
+		t.msdp.values = map[string][]byte{}
+	}
+	old, found := t.msdp.values[name]
+	t.msdp.values[name] = encoded
+	push := enabled && t.msdp.reported[name] && (!found || !bytes.Equal(old, encoded))
+	t.msdp.lock.Unlock()
+
+	if push {
+		return t.sendMSDP(name, encoded)
+	}
+	return nil
+}
+
+func (t *Telnet) sendMSDP(name string, encoded []byte) error {
+	data := []byte{msdpVar}
+	data = append(data, []byte(name)...)
+	data = append(data, msdpVal)
+	data = append(data, encoded...)
+	return t.sendSubnegotiation(MSDP, data)
+}
+
+// msdpEncode encodes a value, not including the leading MSDP_VAL
+func msdpEncode(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case []string:
+		data := []byte{msdpArrayOpen}
+		for _, item := range v {
+			data = append(data, msdpVal)
+			data = append(data, []byte(item)...)
+		}
+		return append(data, msdpArrayClose)
+	case []interface{}:
+		data := []byte{msdpArrayOpen}
+		for _, item := range v {
+			data = append(data, msdpVal)
+			data = append(data, msdpEncode(item)...)
+		}
+		return append(data, msdpArrayClose)
+	case map[string]string:
+		table := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			table[key] = item
+		}
+		return msdpEncode(table)
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		data := []byte{msdpTableOpen}
+		for _, key := range keys {
+			data = append(data, msdpVar)
+			data = append(data, []byte(key)...)
+			data = append(data, msdpVal)
+			data = append(data, msdpEncode(v[key])...)
+		}
+		return append(data, msdpTableClose)
+	case nil:
+		return []byte{}
+	}
+
+	return []byte(fmt.Sprint(value))
+}
+
+type msdpCommand struct {
+	name   string
+	values []string
+}
+
+// msdpParse reads the commands a client sent, flattening any arrays into a
+// plain list of values.
+func msdpParse(data []byte) []msdpCommand {
+	var commands []msdpCommand
+	var current *msdpCommand
+	var field []byte
+	inVar := false
+
+	finishField := func() {
+		if current == nil {
+			field = nil
+			return
+		}
+		if inVar {
+			current.name = string(field)
+		} else if field != nil {
+			current.values = append(current.values, string(field))
+		}
+		field = nil
+	}
+
+	for _, b := range data {
+		switch b {
+		case msdpVar:
+			finishField()
+			commands = append(commands, msdpCommand{})
+			current = &commands[len(commands)-1]
+			inVar = true
+		case msdpVal:
+			finishField()
+			inVar = false
+			field = []byte{}
+		case msdpArrayOpen, msdpTableOpen:
+			// The MSDP_VAL before an array isn't a value of its own
+			field = nil
+		case msdpArrayClose, msdpTableClose:
+			finishField()
+		default:
+			field = append(field, b)
+		}
+	}
+	finishField()
+
+	return commands
+}
+
+func (t *Telnet) handleMSDP(data []byte) {
+	for _, command := range msdpParse(data) {
+		switch strings.ToUpper(command.name) {
+		case "LIST":
+			for _, list := range command.values {
+				t.msdpList(strings.ToUpper(list))
+			}
+		case "REPORT":
+			for _, name := range command.values {
+				t.msdpReport(strings.ToUpper(name))
+			}
+		case "UNREPORT":
+			t.msdp.lock.Lock()
+			for _, name := range command.values {
+				delete(t.msdp.reported, strings.ToUpper(name))
+			}
+			t.msdp.lock.Unlock()
+		case "RESET":
+			for _, list := range command.values {
+				if strings.ToUpper(list) == "REPORTABLE_VARIABLES" || strings.ToUpper(list) == "REPORTED_VARIABLES" {
+					t.msdp.lock.Lock()
+					t.msdp.reported = map[string]bool{}
+					t.msdp.lock.Unlock()
+				}
+			}
+		case "SEND":
+			for _, name := range command.values {
+				name = strings.ToUpper(name)
+				t.msdp.lock.Lock()
+				value, found := t.msdp.values[name]
+				t.msdp.lock.Unlock()
+
+				if found {
+					_ = t.sendMSDP(name, value)
+				}
+			}
+		}
+	}
+}
+
+func (t *Telnet) msdpReport(name string) {
+	if !msdpRegistered(name) {
+		return
+	}
+
+	t.msdp.lock.Lock()
+	if t.msdp.reported == nil {
+		t.msdp.reported = map[string]bool{}
+	}
+	t.msdp.reported[name] = true
+	value, found := t.msdp.values[name]
+	t.msdp.lock.Unlock()
+
+	// Reporting a variable also sends its current value
+	if found {
+		_ = t.sendMSDP(name, value)
+	}
+}
+
+func (t *Telnet) msdpList(list string) {
+	var items []string
+
+	switch list {
+	case "COMMANDS":
+		items = msdpCommands
+	case "LISTS":
+		items = msdpLists
+	case "REPORTABLE_VARIABLES", "SENDABLE_VARIABLES":
+		items = msdpVariableNames()
+	case "REPORTED_VARIABLES":
+		t.msdp.lock.Lock()
+		for name := range t.msdp.reported {
+			items = append(items, name)
+		}
+		t.msdp.lock.Unlock()
+		sort.Strings(items)
+	case "CONFIGURABLE_VARIABLES":
+		items = []string{}
+	default:
+		return
+	}
+
+	_ = t.sendMSDP(list, msdpEncode(items))
+}
@@ -0,0 +1,82 @@
+package telnet
+
+/*
+MSSP (Mud Server Status Protocol)
+https://tintin.mudhalla.net/protocols/mssp/
+
+Crawlers either negotiate MSSP over telnet, in which case the variables are
+sent as IAC SB MSSP MSSP_VAR <name> MSSP_VAL <value> ... IAC SE, or type
+MSSP-REQUEST at the login prompt and expect a plain text reply.
+*/
+
+import (
+	"strings"
+)
+
+const (
+	msspVar byte = 1
+	msspVal byte = 2
+
+	msspRequest = "mssp-request"
+)
+
+// MSSPVariable is a single name/value pair reported to crawlers
+type MSSPVariable struct {
+	Name  string
+	Value string
+}
+
+func init() {
+	RegisterOption(MSSP, OptionHandler{
+		AcceptLocal: true,
+		Enabled: func(t *Telnet, local bool) {
+			_ = t.SendMSSP()
+		},
+	})
+}
+
+// OfferMSSP tells the client that the server can report its status
+func (t *Telnet) OfferMSSP() {
+	t.EnableLocal(MSSP)
+}
+
+// SetMSSPSource sets the function used to look up the current status values
+// when a client asks for them
+func (t *Telnet) SetMSSPSource(source func() []MSSPVariable) {
+	t.msspSource = source
+}
+
+func (t *Telnet) msspVariables() []MSSPVariable {
+	if t.msspSource == nil {
+		return nil
+	}
+	return t.msspSource()
+}
+
+// SendMSSP sends the status variables as an MSSP subnegotiation
+func (t *Telnet) SendMSSP() error {
+	var data []byte
+	for _, variable := range t.msspVariables() {
+		data = append(data, msspVar)
+		data = append(data, []byte(variable.Name)...)
+		data = append(data, msspVal)
+		data = append(data, []byte(variable.Value)...)
+	}
+
+	return t.sendSubnegotiation(MSSP, data)
+}
+
+// MSSPPlainText formats the status variables as the plain text reply to an
+// MSSP-REQUEST typed at the login prompt
+func (t *Telnet) MSSPPlainText() string {
+	reply := "\r\nMSSP-REPLY-START\r\n"
+	for _, variable := range t.msspVariables() {
+		reply += variable.Name + "\t" + variable.Value + "\r\n"
+	}
+	return reply + "MSSP-REPLY-END\r\n"
+}
+
+// IsMSSPRequest returns true if the given line of input is a plain text MSSP request
+func IsMSSPRequest(input string) bool {
+	return strings.ToLower(strings.TrimSpace(input)) == msspRequest
+}
@@ -0,0 +1,124 @@
+package telnet
+
+/*
+MTTS (Mud Terminal Type Standard)
+https://tintin.mudhalla.net/protocols/mtts/
+
+Clients that support MTTS answer successive TTYPE requests with their name,
+their terminal type and finally "MTTS <bitvector>", repeating the last answer
+from then on. Clients that don't keep repeating their terminal type.
+*/
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MTTS bits
+const (
+	mttsANSI         = 1
+	mttsVT100        = 2
+	mttsUTF8         = 4
+	mtts256Colors    = 8
+	mttsMouse        = 16
+	mttsOSCPalette   = 32
+	mttsScreenReader = 64
+	mttsProxy        = 128
+	mttsTrueColor    = 256
+	mttsMNES         = 512
+	mttsMSLP         = 1024
+	mttsTLS          = 2048
+)
+
+// mttsRounds is the number of TTYPE requests it takes to get through the MTTS
+// cycle
+const mttsRounds = 3
+
+// Capabilities are what the client reported about itself over TTYPE/MTTS
+type Capabilities struct {
+	ClientName   string // As reported, empty for clients without MTTS
+	TerminalType string // In lower case
+	MTTS         bool   // Whether the client sent an MTTS bitvector at all
+
+	ANSI         bool
+	VT100        bool
+	UTF8         bool
+	Colors256    bool
+	Mouse        bool
+	OSCPalette   bool
+	ScreenReader bool
+	Proxy        bool
+	TrueColor    bool
+	MNES         bool
+	MSLP         bool
+	TLS          bool
+}
+
+// parseMTTS works out the capabilities of a client from its answers to TTYPE
+// requests so far, in the order they came
+func parseMTTS(responses []string) Capabilities {
+	var caps Capabilities
+
+	var names []string
+	for _, response := range responses {
+		if strings.HasPrefix(strings.ToUpper(response), "MTTS ") {
+			bits, err := strconv.Atoi(strings.TrimSpace(response[len("MTTS "):]))
+			if err == nil {
+				caps.setBits(bits)
+			}
+			continue
+		}
+
+		if len(names) == 0 || names[len(names)-1] != response {
+			names = append(names, response)
+		}
+	}
+
+	switch {
+	case len(names) >= 2:
+		caps.ClientName = names[0]
+		caps.TerminalType = strings.ToLower(names[1])
+	case len(names) == 1:
+		caps.TerminalType = strings.ToLower(names[0])
+	}
+
+	return caps
+}
+
+func (c *Capabilities) setBits(bits int) {
+	c.MTTS = true
+	c.ANSI = bits&mttsANSI != 0
+	c.VT100 = bits&mttsVT100 != 0
+	c.UTF8 = bits&mttsUTF8 != 0
+	c.Colors256 = bits&mtts256Colors != 0
+	c.Mouse = bits&mttsMouse != 0
+	c.OSCPalette = bits&mttsOSCPalette != 0
+	c.ScreenReader = bits&mttsScreenReader != 0
+	c.Proxy = bits&mttsProxy != 0
+	c.TrueColor = bits&mttsTrueColor != 0
+	c.MNES = bits&mttsMNES != 0
+	c.MSLP = bits&mttsMSLP != 0
+	c.TLS = bits&mttsTLS != 0
+}
+
+// mttsDone returns true once there is no point asking the client again: it
+// has sent its bitvector, or repeated itself because it doesn't cycle
+func mttsDone(responses []string) bool {
+	count := len(responses)
+	if count == 0 {
+		return false
+	}
+
+	last := responses[count-1]
+	return count >= mttsRounds ||
+		strings.HasPrefix(strings.ToUpper(last), "MTTS ") ||
+		(count >= 2 && responses[count-2] == last)
+}
+
+// Capabilities returns what the client has reported about itself so far
+func (t *Telnet) Capabilities() Capabilities {
+	t.ttype.lock.RLock()
+	defer t.ttype.lock.RUnlock()
+
+	return t.ttype.capabilities
+}
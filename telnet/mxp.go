@@ -0,0 +1,31 @@
+package telnet
+
+/*
+MXP (Mud eXtension Protocol)
+https://www.zuggsoft.com/zmud/mxp.htm
+https://tintin.mudhalla.net/protocols/mxp/
+
+Once the client agrees with IAC DO MXP the server sends IAC SB MXP IAC SE,
+after which the client parses MXP tags in the text stream. The tags themselves
+are produced by the color package, see color.Link and color.ProcessMXP.
+*/
+
+func init() {
+	RegisterOption(MXP, OptionHandler{
+		AcceptLocal: true,
+		Enabled: func(t *Telnet, local bool) {
+			_ = t.sendSubnegotiation(MXP, nil)
+		},
+	})
+}
+
+// OfferMXP tells the client that the server is willing to send MXP tags
+func (t *Telnet) OfferMXP() {
+	t.EnableLocal(MXP)
+}
+
+// MXPEnabled returns true if the client has agreed to receive MXP tags, output
+// to connections without MXP has its tags stripped
+func (t *Telnet) MXPEnabled() bool {
+	return t.LocalEnabled(MXP)
+}
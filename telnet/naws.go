@@ -0,0 +1,80 @@
+package telnet
+
+/*
+NAWS (Negotiate About Window Size)
+https://tools.ietf.org/html/rfc1073
+
+Once the client agrees with IAC WILL NAWS it sends its window size as
+IAC SB NAWS <width hi> <width lo> <height hi> <height lo> IAC SE, and sends it
+again every time the window is resized.
+*/
+
+import (
+	"sync"
+)
+
+func init() {
+	RegisterOption(WS, OptionHandler{
+		AcceptRemote: true,
+		Subnegotiation: func(t *Telnet, data []byte) {
+			t.handleNAWS(data)
+		},
+	})
+}
+
+type nawsState struct {
+	lock      sync.RWMutex
+	width     int
+	height    int
+	listeners []func(width int, height int)
+}
+
+// WindowSize returns the last window size the client reported, or 0, 0 if it
+// hasn't reported one
+func (t *Telnet) WindowSize() (int, int) {
+	t.naws.lock.RLock()
+	defer t.naws.lock.RUnlock()
+
+	return t.naws.width, t.naws.height
+}
+
+// OnWindowSize registers a function to be called whenever the client reports
+// a new window size
+func (t *Telnet) OnWindowSize(listener func(width int, height int)) {
+	t.naws.lock.Lock()
+	defer t.naws.lock.Unlock()
+
+	t.naws.listeners = append(t.naws.listeners, listener)
+}
+
+func (t *Telnet) handleNAWS(data []byte) {
+	width, height, ok := parseNAWS(data)
+	if ok {
+		t.setWindowSize(width, height)
+	}
+}
+
+// setWindowSize records a new window size and tells the listeners about it
+func (t *Telnet) setWindowSize(width int, height int) {
+	t.naws.lock.Lock()
+	t.naws.width = width
+	t.naws.height = height
+	listeners := t.naws.listeners
+	t.naws.lock.Unlock()
+
+	for _, listener := range listeners {
+		listener(width, height)
+	}
+}
+
+// parseNAWS reads the width and height from NAWS subnegotiation data, the
+// processor has already unescaped any doubled IACs
+func parseNAWS(data []byte) (int, int, bool) {
+	if len(data) != 4 {
+		return 0, 0, false
+	}
+
+	width := int(data[0])<<8 | int(data[1])
+	height := int(data[2])<<8 | int(data[3])
+	return width, height, true
+}
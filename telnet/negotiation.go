@@ -0,0 +1,105 @@
+package telnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// NegotiationTimeout is how long to wait for a client to answer a negotiation
+// before giving up on it. Raw TCP clients such as netcat never answer at all.
+var NegotiationTimeout = 5 * time.Second
+
+var ErrNegotiationTimeout = errors.New("client did not answer negotiation in time")
+var ErrNegotiationRefused = errors.New("client refused negotiation")
+
+const (
+	ttypeIs   byte = 0
+	ttypeSend byte = 1
+)
+
+func init() {
+	RegisterOption(TT, OptionHandler{
+		AcceptRemote: true,
+		Enabled: func(t *Telnet, local bool) {
+			t.requestTerminalType()
+		},
+		Subnegotiation: func(t *Telnet, data []byte) {
+			t.handleTerminalType(data)
+		},
+	})
+}
+
+type ttypeState struct {
+	lock         sync.RWMutex
+	responses    []string
+	capabilities Capabilities
+}
+
+// TerminalType returns the terminal type the client reported, in lower case,
+// or an empty string if it hasn't reported one
+func (t *Telnet) TerminalType() string {
+	return t.Capabilities().TerminalType
+}
+
+func (t *Telnet) handleTerminalType(data []byte) {
+	if len(data) == 0 || data[0] != ttypeIs {
+		return
+	}
+
+	t.ttype.lock.Lock()
+	defer t.ttype.lock.Unlock()
+
+	t.ttype.responses = append(t.ttype.responses, string(data[1:]))
+	t.ttype.capabilities = parseMTTS(t.ttype.responses)
+}
+
+// setTerminalType records a terminal type the client gave some other way than
+// over TTYPE, such as in an SSH pty request
+func (t *Telnet) setTerminalType(name string) {
+	t.ttype.lock.Lock()
+	defer t.ttype.lock.Unlock()
+
+	t.ttype.responses = []string{name}
+	t.ttype.capabilities = parseMTTS(t.ttype.responses)
+}
+
+// terminalTypeResponses returns the number of answers to TTYPE requests so far
+// and whether the MTTS cycle is over
+func (t *Telnet) terminalTypeResponses() (int, bool) {
+	t.ttype.lock.RLock()
+	defer t.ttype.lock.RUnlock()
+
+	return len(t.ttype.responses), mttsDone(t.ttype.responses)
+}
+
+// requestTerminalType asks the client to send its terminal type, which it
+// will only do once it has agreed with IAC WILL TTYPE
+func (t *Telnet) requestTerminalType() {
+	_ = t.sendSubnegotiation(TT, []byte{ttypeSend})
+}
+
+// awaitNegotiation reads from the client until done returns true, giving up
+// once NegotiationTimeout has passed. Anything the client typed in the
+// meantime is kept for the next Read.
+func (t *Telnet) awaitNegotiation(done func() bool) error {
+	_ = t.conn.SetReadDeadline(time.Now().Add(NegotiationTimeout))
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	for !done() {
+		t.fill()
+		if t.err != nil {
+			err := t.err
+			t.err = nil
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return ErrNegotiationTimeout
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package telnet
+
+/*
+Option negotiation, using the Q method from RFC 1143
+https://tools.ietf.org/html/rfc1143
+
+Both sides of every option are tracked separately. The local side is the
+server's (we send WILL/WONT, the client answers DO/DONT), the remote side is
+the client's (we send DO/DONT, the client answers WILL/WONT). Requests are
+never answered twice and requests made while a negotiation is still pending
+are queued, so neither side can get caught in a negotiation loop.
+*/
+
+import (
+	"sync"
+)
+
+// OptionHandler plugs a telnet option into every connection. Any of its
+// functions may be nil.
+type OptionHandler struct {
+	// AcceptLocal agrees to enable the option on the server's side when the
+	// client asks for it with DO, AcceptRemote agrees to let the client
+	// enable it when it offers with WILL. Options the server asked for itself
+	// are always accepted.
+	AcceptLocal  bool
+	AcceptRemote bool
+
+	// Enabled and Disabled are called once the option is turned on or off,
+	// local tells which side of it changed
+	Enabled  func(t *Telnet, local bool)
+	Disabled func(t *Telnet, local bool)
+
+	// Subnegotiation is called with the data of every subnegotiation the
+	// client sends for the option
+	Subnegotiation func(t *Telnet, data []byte)
+}
+
+var optionHandlers = map[TelnetCode]OptionHandler{}
+var optionHandlersLock sync.RWMutex
+
+// RegisterOption sets the handler for the given option, replacing any
+// handler registered before. Options without a handler are always refused.
+func RegisterOption(option TelnetCode, handler OptionHandler) {
+	optionHandlersLock.Lock()
+	defer optionHandlersLock.Unlock()
+
+	optionHandlers[option] = handler
+}
+
+func getOptionHandler(option TelnetCode) (OptionHandler, bool) {
+	optionHandlersLock.RLock()
+	defer optionHandlersLock.RUnlock()
+
+	handler, found := optionHandlers[option]
+	return handler, found
+}
+
+type qState int
+
+const (
+	qNo      qState = iota
+	qYes     qState = iota
+	qWantNo  qState = iota
+	qWantYes qState = iota
+)
+
+// qOption is the state of one side of an option. opposite is the RFC's queue
+// bit, set when the opposite of the pending negotiation has been requested.
+type qOption struct {
+	state    qState
+	opposite bool
+}
+
+type qReply int
+
+const (
+	replyNone    qReply = iota
+	replyEnable  qReply = iota
+	replyDisable qReply = iota
+)
+
+// receive updates the state for a WILL/DO (enable) or WONT/DONT from the
+// client and returns the reply to send, if any
+func (q *qOption) receive(enable bool, accept bool) qReply {
+	if enable {
+		switch q.state {
+		case qNo:
+			if accept {
+				q.state = qYes
+				return replyEnable
+			}
+			return replyDisable
+		case qWantNo:
+			// The client answered our disable with an enable, which the RFC
+			// treats as an error
+			if q.opposite {
+				q.state = qYes
+				q.opposite = false
+			} else {
+				q.state = qNo
+			}
+		case qWantYes:
+			if q.opposite {
+				q.state = qWantNo
+				q.opposite = false
+				return replyDisable
+			}
+			q.state = qYes
+		}
+		return replyNone
+	}
+
+	switch q.state {
+	case qYes:
+		q.state = qNo
+		return replyDisable
+	case qWantNo:
+		if q.opposite {
+			q.state = qWantYes
+			q.opposite = false
+			return replyEnable
+		}
+		q.state = qNo
+	case qWantYes:
+		q.state = qNo
+		q.opposite = false
+	}
+	return replyNone
+}
+
+// request updates the state when the server wants the option enabled or
+// disabled and returns the request to send, if any
+func (q *qOption) request(enable bool) qReply {
+	wantPending, other, otherPending := qWantYes, qNo, qWantNo
+	reply := replyEnable
+	if !enable {
+		wantPending, other, otherPending = qWantNo, qYes, qWantYes
+		reply = replyDisable
+	}
+
+	switch q.state {
+	case other:
+		q.state = wantPending
+		return reply
+	case otherPending:
+		// Wait for the pending negotiation to finish before asking again
+		q.opposite = true
+	case wantPending:
+		q.opposite = false
+	}
+	return replyNone
+}
+
+type optionState struct {
+	local  qOption
+	remote qOption
+}
+
+// options is the per-connection option table, it is keyed by the option byte
+// so that options this package has no code for can still be refused
+type options struct {
+	lock   sync.Mutex
+	states map[byte]*optionState
+}
+
+func (o *options) get(option byte) *optionState {
+	if o.states == nil {
+		o.states = map[byte]*optionState{}
+	}
+
+	state, found := o.states[option]
+	if !found {
+		state = &optionState{}
+		o.states[option] = state
+	}
+	return state
+}
+
+func (o *options) side(option byte, local bool) *qOption {
+	state := o.get(option)
+	if local {
+		return &state.local
+	}
+	return &state.remote
+}
+
+func (t *Telnet) optionState(option TelnetCode, local bool) qState {
+	t.options.lock.Lock()
+	defer t.options.lock.Unlock()
+
+	return t.options.side(codeToByte[option], local).state
+}
+
+// LocalEnabled returns true if the option is on for the server's side
+func (t *Telnet) LocalEnabled(option TelnetCode) bool {
+	return t.optionState(option, true) == qYes
+}
+
+// RemoteEnabled returns true if the option is on for the client's side
+func (t *Telnet) RemoteEnabled(option TelnetCode) bool {
+	return t.optionState(option, false) == qYes
+}
+
+// remoteRefused returns true if the client's side of the option is off with no
+// negotiation pending, which after EnableRemote means the client refused
+func (t *Telnet) remoteRefused(option TelnetCode) bool {
+	return t.optionState(option, false) == qNo
+}
+
+// EnableLocal asks the client to let the server enable the option (WILL)
+func (t *Telnet) EnableLocal(option TelnetCode) {
+	t.requestOption(option, true, true)
+}
+
+// DisableLocal tells the client the server is disabling the option (WONT)
+func (t *Telnet) DisableLocal(option TelnetCode) {
+	t.requestOption(option, true, false)
+}
+
+// EnableRemote asks the client to enable the option (DO)
+func (t *Telnet) EnableRemote(option TelnetCode) {
+	t.requestOption(option, false, true)
+}
+
+// DisableRemote asks the client to disable the option (DONT)
+func (t *Telnet) DisableRemote(option TelnetCode) {
+	t.requestOption(option, false, false)
+}
+
+func (t *Telnet) requestOption(option TelnetCode, local bool, enable bool) {
+	b := codeToByte[option]
+
+	t.options.lock.Lock()
+	q := t.options.side(b, local)
+	wasEnabled := q.state == qYes
+	reply := q.request(enable)
+	enabled := q.state == qYes
+	t.options.lock.Unlock()
+
+	t.sendOptionReply(b, local, reply)
+	t.optionChanged(option, local, wasEnabled, enabled)
+}
+
+// negotiate is called by the processor whenever the client sends a
+// WILL/WONT/DO/DONT command.
+func (t *Telnet) negotiate(command TelnetCode, b byte) {
+	option := byteToCode[b]
+	if codeToByte[option] != b {
+		// Not an option this package knows about
+		option = NUL
+	}
+	handler, found := getOptionHandler(option)
+
+	local := command == DO || command == DONT
+	enable := command == WILL || command == DO
+	accept := found && ((local && handler.AcceptLocal) || (!local && handler.AcceptRemote))
+
+	t.options.lock.Lock()
+	q := t.options.side(b, local)
+	wasEnabled := q.state == qYes
+	reply := q.receive(enable, accept)
+	enabled := q.state == qYes
+	t.options.lock.Unlock()
+
+	t.sendOptionReply(b, local, reply)
+	if found {
+		t.optionChanged(option, local, wasEnabled, enabled)
+	}
+}
+
+func (t *Telnet) sendOptionReply(option byte, local bool, reply qReply) {
+	var command TelnetCode
+	switch {
+	case reply == replyNone:
+		return
+	case local && reply == replyEnable:
+		command = WILL
+	case local && reply == replyDisable:
+		command = WONT
+	case reply == replyEnable:
+		command = DO
+	default:
+		command = DONT
+	}
+
+	_, _ = t.Write([]byte{codeToByte[IAC], codeToByte[command], option})
+}
+
+func (t *Telnet) optionChanged(option TelnetCode, local bool, wasEnabled bool, enabled bool) {
+	if wasEnabled == enabled {
+		return
+	}
+
+	handler, found := getOptionHandler(option)
+	if !found {
+		return
+	}
+
+	if enabled && handler.Enabled != nil {
+		handler.Enabled(t, local)
+	} else if !enabled && handler.Disabled != nil {
+		handler.Disabled(t, local)
+	}
+}
+
+// subnegotiation is called by the processor once the client has finished
+// sending subnegotiation data for an option.
+func (t *Telnet) subnegotiation(code TelnetCode, data []byte) {
+	if handler, found := getOptionHandler(code); found && handler.Subnegotiation != nil {
+		handler.Subnegotiation(t, data)
+	}
+
+	if t.listenFunc != nil {
+		t.listenFunc(code, data)
+	}
+}
@@ -4,11 +4,19 @@ import (
 	"errors"
 	"github.com/yamamushi/kmud-2020/color"
 	"github.com/yamamushi/kmud-2020/utils"
+	"io"
 	"log"
+	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrConnectionNotFound is returned for a connection that isn't in the pool
+var ErrConnectionNotFound = errors.New("connection not found in pool")
+
 type ConnectionPool struct {
 	pool     []*ConnectionHandler
 	messages chan PoolMessage
@@ -22,6 +30,16 @@ type PoolMessage struct {
 	Args     []string
 }
 
+// ConnectionInfo describes a connection in the pool
+type ConnectionInfo struct {
+	ID            string
+	RemoteAddr    string
+	Username      string
+	Authenticated bool
+	Connected     time.Time
+	Idle          time.Duration
+}
+
 func NewConnectionPool() (pool *ConnectionPool) {
 	pool = &ConnectionPool{}
 	pool.messages = make(chan PoolMessage)
@@ -41,21 +59,86 @@ func (p *ConnectionPool) AddToPool(c *ConnectionHandler) error {
 	return nil
 }
 
+// Count returns the number of connections currently in the pool
+func (p *ConnectionPool) Count() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return len(p.pool)
+}
+
+// RemoveFromPool removes a connection from the pool without closing it
 func (p *ConnectionPool) RemoveFromPool(c *ConnectionHandler) error {
 	p.locker.Lock()
 	defer p.locker.Unlock()
 
-	removeWrappedConnection(p.pool, c)
+	count := len(p.pool)
+	p.pool = removeWrappedConnection(p.pool, c)
+	if len(p.pool) == count {
+		return ErrConnectionNotFound
+	}
 	return nil
 }
 
+// CloseConnection closes the connection with the given ID and removes it from
+// the pool
 func (p *ConnectionPool) CloseConnection(id string) error {
+	c := p.Find(id)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+
+	err := p.RemoveFromPool(c)
+	c.Close()
+	return err
+}
+
+// Find returns the connection with the given ID, or nil if it isn't in the pool
+func (p *ConnectionPool) Find(id string) *ConnectionHandler {
 	p.locker.Lock()
 	defer p.locker.Unlock()
 
+	for _, conn := range p.pool {
+		if conn.id == id {
+			return conn
+		}
+	}
 	return nil
 }
 
+// Connections describes the connections in the pool, oldest first
+func (p *ConnectionPool) Connections() []ConnectionInfo {
+	conns := p.snapshot()
+	infos := make([]ConnectionInfo, len(conns))
+
+	for i, conn := range conns {
+		infos[i] = ConnectionInfo{
+			ID:            conn.id,
+			Username:      conn.Username(),
+			Authenticated: conn.Authenticated(),
+			Connected:     conn.connected,
+			Idle:          conn.conn.IdleTime(),
+		}
+		if addr := conn.conn.RemoteAddr(); addr != nil {
+			infos[i].RemoteAddr = addr.String()
+		}
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Connected.Before(infos[j].Connected)
+	})
+	return infos
+}
+
+// snapshot returns a copy of the connections in the pool, so that they can be
+// written to without holding the lock
+func (p *ConnectionPool) snapshot() []*ConnectionHandler {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return append([]*ConnectionHandler(nil), p.pool...)
+}
+
 func removeWrappedConnection(s []*ConnectionHandler, r *ConnectionHandler) []*ConnectionHandler {
 	for i, v := range s {
 		if v == r {
@@ -65,9 +148,49 @@ func removeWrappedConnection(s []*ConnectionHandler, r *ConnectionHandler) []*Co
 	return s
 }
 
-func (p *ConnectionPool) BroadcastMessage(message string, c *ConnectionHandler) error {
+// BroadcastMessage sends a message to every connection that filter returns
+// true for, or to all of them if filter is nil, and returns how many it
+// reached. A slow client doesn't hold up the others, and is given up on after
+// KeepaliveTimeout.
+func (p *ConnectionPool) BroadcastMessage(message string, filter func(c *ConnectionHandler) bool) int {
+	return p.broadcastWithin(KeepaliveTimeout, message, filter)
+}
+
+// broadcastWithin is BroadcastMessage, giving up on clients after timeout
+func (p *ConnectionPool) broadcastWithin(timeout time.Duration, message string, filter func(c *ConnectionHandler) bool) int {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sent := 0
 
-	return nil
+	for _, conn := range p.snapshot() {
+		if filter != nil && !filter(conn) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(conn *ConnectionHandler) {
+			defer wg.Done()
+
+			err := conn.conn.writeWithin(timeout, func() error {
+				err := utils.WriteLine(conn.conn, message, color.ModeNone)
+				if err == nil {
+					err = utils.Write(conn.conn, "> ", color.ModeNone)
+				}
+				return err
+			})
+			if err != nil {
+				p.HandlePoolError(conn, err)
+				return
+			}
+
+			lock.Lock()
+			sent++
+			lock.Unlock()
+		}(conn)
+	}
+
+	wg.Wait()
+	return sent
 }
 
 func (p *ConnectionPool) Run() {
@@ -85,36 +208,59 @@ func (p *ConnectionPool) ParseMessage(message PoolMessage) {
 	}
 
 	message.Type = strings.ToLower(message.Type)
-	if message.Type == "disconnect" {
-		if len(p.pool) > 0 {
-			for _, conn := range p.pool {
-				if conn.id == message.TargetID {
-					p.HandlePoolError(conn, conn.conn.Close())
-				}
-			}
+	switch message.Type {
+	case "disconnect":
+		err := p.CloseConnection(message.TargetID)
+		if err != nil && err != ErrConnectionNotFound {
+			log.Println("Pool Error: " + err.Error())
 		}
-	}
-	if message.Type == "broadcast" {
+	case "disconnected":
+		// The connection has already closed itself, it may have been removed
+		// by CloseConnection too
+		if conn := p.Find(message.TargetID); conn != nil {
+			_ = p.RemoveFromPool(conn)
+		}
+	case "idlewarning":
+		if conn := p.Find(message.TargetID); conn != nil && len(message.Args) > 0 {
+			go p.writeTo(conn, message.Args[0])
+		}
+	case "timeout":
+		// Removed straight away so that it isn't timed out twice while the
+		// goodbye is written
+		if conn := p.Find(message.TargetID); conn != nil {
+			_ = p.RemoveFromPool(conn)
+			go func() {
+				p.writeTo(conn, "You have been idle for too long, goodbye.")
+				conn.Close()
+			}()
+		}
+	case "broadcast":
+		// Not waited for, Run has to keep handling messages while it is sent
 		if len(message.Args) > 0 {
-			if len(p.pool) > 0 {
-				for _, conn := range p.pool {
-					if conn != nil {
-						err := utils.WriteLine(conn.conn, message.Args[0], color.ModeNone)
-						//conn.conn.Telnet.Write([]byte("\033[H\033[2J"))
-						p.HandlePoolError(conn, err)
-						err = utils.Write(conn.conn, "> ", color.ModeNone)
-						p.HandlePoolError(conn, err)
-					}
-				}
-			}
+			go p.BroadcastMessage(message.Args[0], nil)
 		}
 	}
 }
 
+// writeTo writes a line to a connection, giving up on it if that takes longer
+// than KeepaliveTimeout
+func (p *ConnectionPool) writeTo(conn *ConnectionHandler, line string) {
+	err := conn.conn.writeWithin(KeepaliveTimeout, func() error {
+		return utils.WriteLine(conn.conn, line, color.ModeNone)
+	})
+	p.HandlePoolError(conn, err)
+}
+
 func (p *ConnectionPool) HandlePoolError(conn *ConnectionHandler, err error) {
 	if err != nil {
-		if strings.Contains(err.Error(), "use of closed network connection") {
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) ||
+			strings.Contains(err.Error(), "use of closed network connection") {
+			_ = p.RemoveFromPool(conn)
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			// The client stopped reading, it is as good as gone
+			utils.Error("write timed out for " + conn.id)
 			_ = p.RemoveFromPool(conn)
+			conn.Close()
 		} else {
 			log.Println("Pool Error: " + err.Error())
 		}
@@ -0,0 +1,208 @@
+package telnet
+
+/*
+PROXY protocol (v1 and v2)
+https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+Load balancers that speak it start each connection with a header giving the
+address of the client they are passing on:
+
+	v1: PROXY TCP4 192.0.2.1 198.51.100.1 56324 4200\r\n
+	v2: a 16 byte binary header starting \r\n\r\n\0\r\nQUIT\n, then the
+	    addresses
+
+The header is only looked for on connections from trusted proxies, anyone
+else could claim to be any address. It is read when the connection is first
+read from or asked for its address, so that a slow proxy can't hold up the
+accept loop.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2Local        = 0x0
+	proxyV2Proxy        = 0x1
+	proxyV2Inet         = 0x1
+	proxyV2Inet6        = 0x2
+)
+
+// proxyListener expects a PROXY protocol header on connections from trusted
+// proxies
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyListener(listener net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(hostOf(conn.RemoteAddr().String())); ip != nil && matchCIDRs(l.trusted, ip) {
+		return &proxyConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+// proxyConn reports the client address from the PROXY protocol header as its
+// remote address
+type proxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the header the first time it is called, for at most
+// NegotiationTimeout
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(NegotiationTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.reader)
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client's address as the proxy gave it, or the
+// proxy's own for connections it makes itself, such as health checks
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyHeaderError returns the error reading the PROXY protocol header of a
+// connection, if it should have had one
+func proxyHeaderError(conn net.Conn) error {
+	if netConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = netConn.NetConn()
+	}
+
+	if proxied, ok := conn.(*proxyConn); ok {
+		proxied.readHeader()
+		return proxied.err
+	}
+	return nil
+}
+
+// readProxyHeader reads a v1 or v2 header, returning a nil address for
+// connections that don't carry a client's. Only as much is peeked as the
+// header must have, a v1 header can be shorter than the v2 signature.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if string(prefix) == proxyV1Prefix {
+		return readProxyV1(reader)
+	}
+
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil || !bytes.Equal(signature, proxyV2Signature) {
+		return nil, ErrInvalidProxyHeader
+	}
+	return readProxyV2(reader)
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := reader.ReadByte()
+		if err != nil || len(line) >= proxyV1MaxLength {
+			return nil, ErrInvalidProxyHeader
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	version, command := header[12]>>4, header[12]&0xf
+	family := header[13] >> 4
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if version != 2 || (command != proxyV2Local && command != proxyV2Proxy) {
+		return nil, ErrInvalidProxyHeader
+	}
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if command == proxyV2Local {
+		return nil, nil
+	}
+
+	// Source address, destination address, source port, destination port,
+	// anything after that is extensions
+	switch family {
+	case proxyV2Inet:
+		if len(data) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case proxyV2Inet6:
+		if len(data) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+
+	// Unix sockets and unspecified families don't give an address worth using
+	return nil, nil
+}
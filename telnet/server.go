@@ -1,33 +1,150 @@
 package telnet
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/yamamushi/kmud-2020/config"
 	"github.com/yamamushi/kmud-2020/utils"
+	"golang.org/x/crypto/ssh"
 )
 
 type Server struct {
-	listener net.Listener
-	config   *config.Config
-	pool     *ConnectionPool
+	listener          net.Listener
+	tlsListener       net.Listener
+	webSocketListener net.Listener
+	sshListener       net.Listener
+	sshConfig         *ssh.ServerConfig
+	sshAuth           SSHAuthenticator
+	config            *config.Config
+	pool              *ConnectionPool
+	access            *AccessControl
+	started           time.Time
+
+	// listeners are the listening sockets by name, before any PROXY protocol
+	// or TLS wrapping, which are kept open across a copyover
+	listeners    map[string]net.Listener
+	copyover     *copyoverState
+	copyoverLock sync.Mutex
+
+	shutdown      ShutdownSettings
+	shutdownLock  sync.Mutex
+	shutdownHooks []func(ctx context.Context)
+	closing       chan struct{}
 }
 
 func NewServer(config *config.Config) (s *Server) {
-	s = &Server{config: config}
+	s = &Server{
+		config:    config,
+		started:   time.Now(),
+		listeners: map[string]net.Listener{},
+		closing:   make(chan struct{}),
+	}
 	return s
 }
 
 func (s *Server) Setup() (err error) {
+	s.access, err = NewAccessControl(s.config)
+	if err != nil {
+		return err
+	}
+
+	s.shutdown, err = ShutdownSettingsFromConfig(s.config)
+	if err != nil {
+		return err
+	}
+
+	s.copyover, err = loadCopyoverState()
+	if err != nil {
+		return err
+	}
+
 	address := s.config.Server.Interface + ":" + s.config.Server.Port
 	log.Println("Establishing Connection on " + address)
-	s.listener, err = net.Listen("tcp", address)
+	s.listener, err = s.listen(listenerTelnet, address)
 	if err != nil {
 		return err
 	}
+
+	if s.config.Server.TLSPort != "" {
+		if err = s.setupTLS(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Server.WebSocketPort != "" {
+		address = s.config.Server.Interface + ":" + s.config.Server.WebSocketPort
+		log.Println("Establishing WebSocket Connection on " + address)
+		s.webSocketListener, err = s.listen(listenerWebSocket, address)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.Server.SSHPort != "" {
+		if err = s.setupSSH(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens a listener on address, or takes over the one with the given
+// name from before a copyover, expecting a PROXY protocol header from trusted
+// proxies if the config says to
+func (s *Server) listen(name string, address string) (net.Listener, error) {
+	listener := s.inheritedListener(name)
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+	}
+	s.listeners[name] = listener
+
+	if !s.config.Server.ProxyProtocol {
+		return listener, nil
+	}
+
+	trusted, err := parseCIDRs(s.config.Server.TrustedProxies)
+	if err == nil && len(trusted) == 0 {
+		err = errors.New("proxy_protocol needs trusted_proxies")
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, errors.New("invalid trusted_proxies: " + err.Error())
+	}
+
+	return newProxyListener(listener, trusted), nil
+}
+
+// setupTLS opens the TLS listener using the configured certificate and key
+func (s *Server) setupTLS() error {
+	cert, err := tls.LoadX509KeyPair(s.config.Server.TLSCert, s.config.Server.TLSKey)
+	if err != nil {
+		return errors.New("could not load tls certificate: " + err.Error())
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	address := s.config.Server.Interface + ":" + s.config.Server.TLSPort
+	log.Println("Establishing TLS Connection on " + address)
+	listener, err := s.listen(listenerTLS, address)
+	if err != nil {
+		return err
+	}
+
+	// Any PROXY protocol header comes before the TLS handshake
+	s.tlsListener = tls.NewListener(listener, tlsConfig)
 	return nil
 }
 
@@ -35,43 +152,197 @@ func (s *Server) Bootstrap() {
 
 }
 
+// Listen accepts connections on the plain listener, and on the TLS, WebSocket
+// and SSH listeners if there are any, until they are closed. They all feed the
+// same pool and runner.
 func (s *Server) Listen(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	if s.tlsListener != nil {
+		go s.accept(s.tlsListener, runner, conf)
+	}
+	if s.webSocketListener != nil {
+		go s.serveWebSocket(runner, conf)
+	}
+	if s.sshListener != nil {
+		go s.acceptSSH(runner, conf)
+	}
+
+	s.accept(s.listener, runner, conf)
+}
+
+func (s *Server) accept(listener net.Listener, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
 	for {
-		conn, err := s.listener.Accept()
-		utils.HandleError(err)
-		log.Println("Client connected:", conn.RemoteAddr())
-		t := NewTelnet(conn)
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			utils.HandleError(err)
+			continue
+		}
+		// Reading a PROXY protocol header and negotiation wait on the
+		// client, so they mustn't hold up the accept loop
+		go s.admitConnection(conn, runner, conf)
+	}
+}
+
+// admitConnection checks that a newly accepted client may connect, by its
+// address as given by the proxy if it came through one, and handles it if so
+func (s *Server) admitConnection(conn net.Conn, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	if err := proxyHeaderError(conn); err != nil {
+		utils.Error("proxy header from " + conn.RemoteAddr().String() + ": " + err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	release, err := s.access.Admit(conn.RemoteAddr().String())
+	if err != nil {
+		log.Println("Refused client:", conn.RemoteAddr(), "-", err)
+		refuse(conn, err)
+		return
+	}
+	log.Println("Client connected:", conn.RemoteAddr())
+
+	s.handleConnection(conn, release, true, runner, conf)
+}
+
+// refuse tells a client why it wasn't let in and hangs up
+func refuse(conn net.Conn, reason error) {
+	_ = conn.SetWriteDeadline(time.Now().Add(NegotiationTimeout))
+	_, _ = conn.Write([]byte(reason.Error() + "\r\n"))
+	_ = conn.Close()
+}
+
+// Access returns what decides which clients may connect, nil until Setup has
+// been called
+func (s *Server) Access() *AccessControl {
+	return s.access
+}
 
-		wc := utils.NewWatchableReadWriter(t)
+// admittedConn gives up its place with the access control once it is closed
+type admittedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
 
-		id, err := utils.GetUUID()
+// handleConnection negotiates the terminal settings of a newly accepted
+// connection and hands it to the runner. Any failure only drops this connection.
+// Connections that can't speak telnet skip negotiation and get the defaults.
+// release is called once the connection is closed.
+func (s *Server) handleConnection(conn net.Conn, release func(), negotiate bool, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Finish the handshake up front so a client that never sends one
+		// can't hang the first write
+		_ = conn.SetDeadline(time.Now().Add(NegotiationTimeout))
+		err := tlsConn.Handshake()
+		_ = conn.SetDeadline(time.Time{})
 		if err != nil {
-			utils.HandleError(errors.New("utils.GetUUID - " + err.Error()))
+			utils.Error("tls handshake failed: " + err.Error())
 			_ = conn.Close()
+			release()
 			return
 		}
+	}
+	session, isSSH := conn.(*sshConn)
+	conn = &admittedConn{Conn: conn, release: release}
 
-		ch := ConnectionHandler{
-			id:     id,
-			config: s.config,
-			conn:   &WrappedConnection{Telnet: *t, watcher: wc},
-			pool:   s.pool.messages,
-		}
-		err = s.pool.AddToPool(&ch)
+	t := NewTelnet(conn)
+	t.SetMSSPSource(s.MSSPVariables)
+
+	id, err := utils.GetUUID()
+	if err != nil {
+		utils.HandleError(errors.New("utils.GetUUID - " + err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	term := &Terminal{telnet: t}
+	term.setSize(DefaultColumns, DefaultRows)
+	if negotiate {
+		term, err = GetTermInfo(t)
 		if err != nil {
-			utils.Error("server listen() add to pool failure: " + err.Error())
+			utils.Error("could not get terminal iac response: " + err.Error())
 			_ = conn.Close()
 			return
-		} else {
-			term, err := GetTermInfo(t)
-			if err != nil {
-				utils.Error("could not get terminal iac response: " + err.Error())
+		}
+
+		// Only clients that took part in the negotiation above are worth
+		// waiting on, raw clients would only hold things up
+		if t.RemoteEnabled(TT) || t.RemoteEnabled(WS) {
+			err = t.OfferCharset()
+			if err == nil || negotiationFailed(err) {
+				err = t.OfferCharacterMode()
+			}
+			if err != nil && !negotiationFailed(err) {
+				utils.Error("could not negotiate with client: " + err.Error())
 				_ = conn.Close()
 				return
 			}
-
-			ch.Handle(runner, term, conf)
 		}
+	} else {
+		// Connections that skip negotiation are WebSockets and SSH sessions,
+		// which carry UTF-8
+		t.SetCharset(CharsetUTF8)
+	}
+
+	wc := newWrappedConnection(t)
+	wc.access = s.access
+	wc.recordingDir = s.config.Server.RecordingDir
+	wc.recordingLimit = recordingLimitFromConfig(s.config)
+
+	authToken := ""
+	if isSSH {
+		wc.pty = session.setupTerminal(t, term)
+		authToken = session.authToken
+	}
+
+	ch := ConnectionHandler{
+		id:        id,
+		config:    s.config,
+		conn:      wc,
+		pool:      s.pool.messages,
+		connected: time.Now(),
+		authToken: authToken,
+		term:      term,
+	}
+	if s.ShuttingDown() {
+		refuse(conn, ErrShuttingDown)
+		return
+	}
+	err = s.pool.AddToPool(&ch)
+	if err != nil {
+		utils.Error("server listen() add to pool failure: " + err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	if negotiate {
+		t.OfferCompression()
+		t.OfferGMCP()
+		t.OfferMSDP()
+		t.OfferMSSP()
+		t.OfferMXP()
+	}
+	ch.Handle(runner, term, conf)
+}
+
+// MSSPVariables returns the server status reported to MUD crawlers
+func (s *Server) MSSPVariables() []MSSPVariable {
+	players := 0
+	if s.pool != nil {
+		players = s.pool.Count()
+	}
+
+	return []MSSPVariable{
+		{Name: "NAME", Value: s.config.Game.ServerName},
+		{Name: "PLAYERS", Value: strconv.Itoa(players)},
+		{Name: "UPTIME", Value: strconv.FormatInt(s.started.Unix(), 10)},
+		{Name: "CODEBASE", Value: "kmud-2020"},
+		{Name: "PORT", Value: s.config.Server.Port},
 	}
 }
 
@@ -80,7 +351,25 @@ func (s *Server) CreateConnectionPool() {
 	go s.pool.Run()
 }
 
+// watchIdle starts disconnecting idle connections and sending keepalives, if
+// the config asks for either
+func (s *Server) watchIdle() error {
+	settings, err := IdleSettingsFromConfig(s.config)
+	if err != nil {
+		return err
+	}
+
+	go s.pool.WatchIdle(settings)
+	return nil
+}
+
 func (s *Server) Run(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) (err error) {
+	return s.RunContext(context.Background(), runner, conf)
+}
+
+// RunContext runs the server like Run until ctx is done, then shuts it down,
+// returning once everyone has been disconnected
+func (s *Server) RunContext(ctx context.Context, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) (err error) {
 	log.Println("Starting Service")
 	err = s.Setup()
 	if err != nil {
@@ -89,12 +378,30 @@ func (s *Server) Run(runner func(c *ConnectionHandler, term *Terminal, conf *con
 
 	log.Println("Creating Connection Pool")
 	s.CreateConnectionPool()
+	if err = s.watchIdle(); err != nil {
+		return err
+	}
+	s.restoreConnections(runner, conf)
 
 	//go s.TestBroadcastLoop()
 
 	log.Println("Listening for Connections...")
-	s.Listen(runner, conf)
-	return nil
+	listening := make(chan struct{})
+	go func() {
+		s.Listen(runner, conf)
+		close(listening)
+	}()
+
+	select {
+	case <-ctx.Done():
+		// ctx is already done, the shutdown gets the time it is set to take
+		// and no longer
+		shutdown, cancel := context.WithTimeout(context.Background(), s.shutdown.Countdown+s.shutdown.Drain)
+		defer cancel()
+		return s.Shutdown(shutdown)
+	case <-listening:
+		return nil
+	}
 }
 
 func (s *Server) TestBroadcastLoop() {
@@ -0,0 +1,233 @@
+package telnet
+
+/*
+Graceful shutdown
+
+Shutting down stops the listeners first, so that nobody new connects, then
+counts down through the pool so that players can finish what they are doing.
+Once the drain deadline has started, everyone is said goodbye to and their
+connections closed. Closing a connection ends its runner, which is where the
+frontend logs the account out and sessions log their players out. The server
+waits for the pool to empty, up to the drain deadline, before it is done, and
+the OnShutdown hooks log out anyone whose session is still running then.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/color"
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+const (
+	DefaultShutdownCountdown = 30 * time.Second
+	DefaultShutdownDrain     = 10 * time.Second
+)
+
+var ErrShuttingDown = errors.New("the server is shutting down, try again later")
+
+// ShutdownWarnings are how long before disconnecting everyone they are warned,
+// along with once when the countdown starts
+var ShutdownWarnings = []time.Duration{5 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second, 5 * time.Second}
+
+// ShutdownWriteTimeout is how long a shutdown warning may take to write before
+// the connection is given up on, short enough not to hold up the next warning
+var ShutdownWriteTimeout = 5 * time.Second
+
+// drainPollInterval is how often the pool is checked for having emptied
+var drainPollInterval = 50 * time.Millisecond
+
+// ShutdownSettings say how long players are warned before being disconnected,
+// and how long their connections then have to close
+type ShutdownSettings struct {
+	Countdown time.Duration
+	Drain     time.Duration
+}
+
+// ShutdownSettingsFromConfig reads the shutdown settings from the server config
+func ShutdownSettingsFromConfig(conf *config.Config) (ShutdownSettings, error) {
+	settings := ShutdownSettings{Countdown: DefaultShutdownCountdown, Drain: DefaultShutdownDrain}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"shutdown_countdown", conf.Server.ShutdownCountdown, &settings.Countdown},
+		{"shutdown_drain", conf.Server.ShutdownDrain, &settings.Drain},
+	}
+
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value < 0 {
+			return ShutdownSettings{}, errors.New("invalid " + duration.name + ": " + duration.value)
+		}
+		*duration.dest = value
+	}
+
+	return settings, nil
+}
+
+// OnShutdown adds a function to call once every connection has been closed,
+// with a context that is done at the drain deadline. Services use it to save
+// anything their runners didn't get to.
+func (s *Server) OnShutdown(hook func(ctx context.Context)) {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// ShuttingDown returns whether Shutdown has been called
+func (s *Server) ShuttingDown() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting connections, warns everyone still connected for
+// the shutdown countdown and then disconnects them. It returns once their
+// runners have all finished, or with an error if the drain deadline passes or
+// ctx is done first. A copyover can't start once it has been called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.copyoverLock.Lock()
+	defer s.copyoverLock.Unlock()
+
+	s.shutdownLock.Lock()
+	if s.ShuttingDown() {
+		s.shutdownLock.Unlock()
+		return errors.New("already shutting down")
+	}
+	close(s.closing)
+	hooks := s.shutdownHooks
+	s.shutdownLock.Unlock()
+
+	log.Println("Shutting down")
+	s.closeListeners()
+
+	if s.pool != nil && s.shutdown.Countdown > 0 {
+		s.countdown(ctx, s.shutdown.Countdown)
+	}
+
+	drain, cancel := context.WithTimeout(ctx, s.shutdown.Drain)
+	defer cancel()
+
+	if s.pool != nil {
+		s.sayGoodbye(drain)
+	}
+	for _, hook := range hooks {
+		hook(drain)
+	}
+
+	if s.pool != nil && !s.waitForEmptyPool(drain, time.Time{}) {
+		return fmt.Errorf("shutdown drain deadline passed with %v connections open", s.pool.Count())
+	}
+	log.Println("Shutdown complete")
+	return nil
+}
+
+// closeListeners stops every listener, ending the accept loops
+func (s *Server) closeListeners() {
+	listeners := []net.Listener{s.listener, s.tlsListener, s.webSocketListener, s.sshListener}
+	for _, listener := range listeners {
+		if listener != nil {
+			_ = listener.Close()
+		}
+	}
+}
+
+// countdown warns everyone that the server is shutting down until countdown
+// has passed, stopping early if they have all left or ctx is done
+func (s *Server) countdown(ctx context.Context, countdown time.Duration) {
+	end := time.Now().Add(countdown)
+	s.announceShutdown(countdown)
+
+	for _, warning := range ShutdownWarnings {
+		if warning >= countdown {
+			continue
+		}
+		if s.waitForEmptyPool(ctx, end.Add(-warning)) || ctx.Err() != nil {
+			return
+		}
+		s.announceShutdown(warning)
+	}
+
+	s.waitForEmptyPool(ctx, end)
+}
+
+// announceShutdown tells everyone how long is left. Clients that don't take
+// the message within ShutdownWriteTimeout, or before the countdown ends, are
+// disconnected.
+func (s *Server) announceShutdown(remaining time.Duration) {
+	timeout := ShutdownWriteTimeout
+	if remaining < timeout {
+		timeout = remaining
+	}
+
+	message := "The server is shutting down in " + formatDuration(remaining) + "."
+	s.pool.broadcastWithin(timeout, message, nil)
+}
+
+// sayGoodbye tells everyone still connected that the server is shutting down
+// now and closes their connections. Clients are written to at once and only
+// until ctx's deadline, so no one client can hold up the drain.
+func (s *Server) sayGoodbye(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.shutdown.Drain)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range s.pool.snapshot() {
+		wg.Add(1)
+		go func(c *ConnectionHandler) {
+			defer wg.Done()
+
+			_ = c.conn.writeWithin(time.Until(deadline), func() error {
+				return utils.WriteLine(c.conn, "The server is shutting down now, goodbye.", color.ModeNone)
+			})
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+}
+
+// waitForEmptyPool waits until the pool is empty, returning true, or until
+// ctx is done or deadline has passed, returning false. A zero deadline waits
+// on ctx alone.
+func (s *Server) waitForEmptyPool(ctx context.Context, deadline time.Time) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for s.pool.Count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,402 @@
+package telnet
+
+/*
+SSH server, for players who would rather not send their password in the clear.
+
+Clients log in with their account password or a public key registered with
+the account, checked by the SSHAuthenticator, and skip the login menu's own
+login. Each connection gets one session, which runs the same runner as telnet
+clients once it asks for a shell:
+
+	pty-req       - the terminal type and window size, and the client sends
+	                key presses as they are typed, like telnet character mode
+	window-change - the new window size, passed on as NAWS would be
+	shell         - starts the runner
+
+Sessions without a pty are line based. Telnet commands are stripped from the
+output, exec and subsystem requests are refused.
+*/
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHLoginTimeout is how long an SSH client has to finish the handshake and
+// log in, which includes typing a password
+var SSHLoginTimeout = 2 * time.Minute
+
+const (
+	sshAuthTokenExtension = "kmud-auth-token"
+	sshPublicKeyExtension = "kmud-public-key"
+)
+
+// SSHAuthenticator checks the credentials SSH clients log in with, returning
+// the auth token of the account they log in to. Clients may ask whether a key
+// would be accepted without proving they hold it, so PublicKeyRegistered only
+// checks the key and PublicKeyLogin is called once they have.
+type SSHAuthenticator interface {
+	PasswordLogin(username string, password string) (string, error)
+	PublicKeyRegistered(username string, key ssh.PublicKey) error
+	PublicKeyLogin(username string, key ssh.PublicKey) (string, error)
+}
+
+// SetSSHAuthenticator sets what SSH logins are checked with, it must be set
+// before Setup if an SSH port is configured
+func (s *Server) SetSSHAuthenticator(auth SSHAuthenticator) {
+	s.sshAuth = auth
+}
+
+// setupSSH opens the SSH listener, loading or generating the host key
+func (s *Server) setupSSH() error {
+	if s.sshAuth == nil {
+		return errors.New("ssh_port needs an SSH authenticator")
+	}
+
+	path := s.config.Server.SSHHostKey
+	if path == "" {
+		path = "ssh_host_key"
+	}
+	hostKey, err := loadSSHHostKey(path)
+	if err != nil {
+		return errors.New("could not load ssh host key: " + err.Error())
+	}
+
+	s.sshConfig = &ssh.ServerConfig{
+		PasswordCallback:  s.sshPasswordLogin,
+		PublicKeyCallback: s.sshPublicKeyLogin,
+	}
+	s.sshConfig.AddHostKey(hostKey)
+
+	address := s.config.Server.Interface + ":" + s.config.Server.SSHPort
+	log.Println("Establishing SSH Connection on " + address)
+	s.sshListener, err = s.listen(listenerSSH, address)
+	return err
+}
+
+// loadSSHHostKey reads the host key at path, generating an ed25519 key there
+// if there isn't one
+func loadSSHHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Println("Generated SSH host key " + path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// sshPasswordLogin checks a password, counting failures against the client's
+// address the way the login menu does
+func (s *Server) sshPasswordLogin(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	addr := meta.RemoteAddr().String()
+	if delay := s.access.LoginDelay(addr); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	token, err := s.sshAuth.PasswordLogin(meta.User(), string(password))
+	if err != nil {
+		s.access.LoginFailed(addr)
+		return nil, err
+	}
+
+	s.access.LoginSucceeded(addr)
+	return sshPermissions(token), nil
+}
+
+// sshPublicKeyLogin checks that a key is registered with the account, the
+// client logs in with it once the handshake has checked its signature. Clients
+// offer every key they have, so a key that isn't doesn't count as a failed
+// login.
+func (s *Server) sshPublicKeyLogin(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if err := s.sshAuth.PublicKeyRegistered(meta.User(), key); err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{sshPublicKeyExtension: string(key.Marshal())}}, nil
+}
+
+func sshPermissions(token string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{sshAuthTokenExtension: token}}
+}
+
+// sshAuthToken returns the auth token of a client that has finished the
+// handshake, logging in with its public key if it used one
+func (s *Server) sshAuthToken(conn *ssh.ServerConn) (string, error) {
+	marshaled, ok := conn.Permissions.Extensions[sshPublicKeyExtension]
+	if !ok {
+		return conn.Permissions.Extensions[sshAuthTokenExtension], nil
+	}
+
+	key, err := ssh.ParsePublicKey([]byte(marshaled))
+	if err != nil {
+		return "", err
+	}
+	return s.sshAuth.PublicKeyLogin(conn.User(), key)
+}
+
+func (s *Server) acceptSSH(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	for {
+		conn, err := s.sshListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			utils.HandleError(err)
+			continue
+		}
+		go s.admitSSH(conn, runner, conf)
+	}
+}
+
+// admitSSH checks that a newly accepted SSH client may connect, logs it in
+// and serves its session
+func (s *Server) admitSSH(conn net.Conn, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	if err := proxyHeaderError(conn); err != nil {
+		utils.Error("proxy header from " + conn.RemoteAddr().String() + ": " + err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	release, err := s.access.Admit(conn.RemoteAddr().String())
+	if err != nil {
+		log.Println("Refused SSH client:", conn.RemoteAddr(), "-", err)
+		refuse(conn, err)
+		return
+	}
+	// The session closes the connection when it ends, this covers clients
+	// that never start one
+	defer release()
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(SSHLoginTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Println("SSH login failed:", conn.RemoteAddr(), "-", err)
+		return
+	}
+	authToken, err := s.sshAuthToken(serverConn)
+	if err != nil {
+		log.Println("SSH login failed:", conn.RemoteAddr(), "-", err)
+		_ = serverConn.Close()
+		return
+	}
+	log.Println("SSH client connected:", conn.RemoteAddr(), "as", serverConn.User())
+	go ssh.DiscardRequests(requests)
+
+	started := false
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		if started {
+			_ = newChannel.Reject(ssh.Prohibited, "only one session per connection")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		started = true
+
+		session := &sshConn{
+			Channel:   channel,
+			conn:      conn,
+			ssh:       serverConn,
+			authToken: authToken,
+		}
+		go s.serveSSHSession(session, channelRequests, release, runner, conf)
+	}
+}
+
+// serveSSHSession answers a session's requests, handing it to the runner once
+// it asks for a shell
+func (s *Server) serveSSHSession(session *sshConn, requests <-chan *ssh.Request, release func(), runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			_ = req.Reply(session.requestPTY(req.Payload), nil)
+		case "window-change":
+			session.windowChange(req.Payload)
+		case "shell":
+			_ = req.Reply(!started, nil)
+			if !started {
+				started = true
+				s.handleConnection(session, release, false, runner, conf)
+			}
+		default:
+			// There is nothing to run but the game
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// sshConn adapts an SSH session channel to a net.Conn so that it can be
+// wrapped by Telnet like any other connection
+type sshConn struct {
+	ssh.Channel
+	conn      net.Conn
+	ssh       *ssh.ServerConn
+	authToken string
+
+	lock     sync.Mutex
+	pty      bool
+	termType string
+	width    int
+	height   int
+	telnet   *Telnet
+
+	closeOnce sync.Once
+}
+
+type sshPTYRequest struct {
+	Term          string
+	Columns       uint32
+	Rows          uint32
+	WidthPixels   uint32
+	HeightPixels  uint32
+	TerminalModes string
+}
+
+type sshWindowChange struct {
+	Columns      uint32
+	Rows         uint32
+	WidthPixels  uint32
+	HeightPixels uint32
+}
+
+// requestPTY records the terminal type and window size the client asked for,
+// only before the shell has started
+func (c *sshConn) requestPTY(payload []byte) bool {
+	var req sshPTYRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.telnet != nil {
+		return false
+	}
+	c.pty = true
+	c.termType = req.Term
+	c.width, c.height = int(req.Columns), int(req.Rows)
+	return true
+}
+
+func (c *sshConn) windowChange(payload []byte) {
+	var req sshWindowChange
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.width, c.height = int(req.Columns), int(req.Rows)
+	t := c.telnet
+	c.lock.Unlock()
+
+	if t != nil {
+		t.setWindowSize(int(req.Columns), int(req.Rows))
+	}
+}
+
+// setupTerminal applies what the client said about its terminal to t and
+// term, keeping term's size current as the window changes, and returns
+// whether the client has a pty
+func (c *sshConn) setupTerminal(t *Telnet, term *Terminal) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.telnet = t
+	if !c.pty {
+		return false
+	}
+
+	t.OnWindowSize(term.setSize)
+	t.setTerminalType(c.termType)
+	if c.width > 0 && c.height > 0 {
+		t.setWindowSize(c.width, c.height)
+	}
+
+	term.Type = c.termType
+	term.VT100 = c.termType != "" && c.termType != "dumb"
+	term.Capabilities = t.Capabilities()
+	return true
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	data := stripTelnetCommands(p)
+	if len(data) == 0 {
+		return len(p), nil
+	}
+
+	if _, err := c.Channel.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the session with a zero exit status and closes the connection
+func (c *sshConn) Close() error {
+	c.closeOnce.Do(func() {
+		_, _ = c.Channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		_ = c.Channel.Close()
+		_ = c.ssh.Close()
+	})
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline only sets the write deadline, see SetReadDeadline
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline does nothing, a read timing out on the connection
+// underneath would break the whole SSH connection. Nothing negotiates with
+// SSH clients, so nothing needs one.
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the connection underneath,
+// which only carries this session
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -1,8 +1,10 @@
 package telnet
 
 import (
+	"compress/zlib"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -34,6 +36,7 @@ func init() {
 	codeToByte[RFC] = '\x21'
 	codeToByte[LM] = '\x22'
 	codeToByte[EV] = '\x24'
+	codeToByte[CHARSET] = '\x2a'
 	codeToByte[SE] = '\xf0'
 	codeToByte[NOP] = '\xf1'
 	codeToByte[DM] = '\xf2'
@@ -56,6 +59,9 @@ func init() {
 	codeToByte[AARD] = '\x66'
 	codeToByte[ATCP] = '\xc8'
 	codeToByte[GMCP] = '\xc9'
+	codeToByte[MSDP] = '\x45'
+	codeToByte[MSSP] = '\x46'
+	codeToByte[MXP] = '\x5b'
 
 	for enum, code := range codeToByte {
 		byteToCode[code] = enum
@@ -71,16 +77,51 @@ type Telnet struct {
 	err  error
 
 	processor *telnetProcessor
+
+	writeLock  sync.Mutex
+	compressor *zlib.Writer
+
+	// withinLock lets one writeWithin run at a time
+	withinLock sync.Mutex
+
+	options    options
+	gmcp       gmcpState
+	msdp       msdpState
+	naws       nawsState
+	ttype      ttypeState
+	charset    charsetState
+	msspSource func() []MSSPVariable
+	listenFunc func(TelnetCode, []byte)
+
+	inputLock sync.RWMutex
+	lastInput time.Time
 }
 
 func NewTelnet(conn net.Conn) *Telnet {
 	var t Telnet
 	t.conn = conn
 	t.processor = newTelnetProcessor()
+	t.processor.negotiateFunc = t.negotiate
+	t.processor.listenFunc = t.subnegotiation
+	t.lastInput = time.Now()
 	return &t
 }
 
+// Write sends p to the client, compressing it first if MCCP2 is active. The
+// compressed stream is flushed after every write so that partial lines such
+// as prompts reach the client immediately rather than sitting in the buffer.
 func (t *Telnet) Write(p []byte) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if t.compressor != nil {
+		n, err := t.compressor.Write(p)
+		if err != nil {
+			return n, err
+		}
+		return n, t.compressor.Flush()
+	}
+
 	return t.conn.Write(p)
 }
 
@@ -93,17 +134,32 @@ func (t *Telnet) Read(p []byte) (int, error) {
 
 		n, err := t.processor.Read(p)
 		if n > 0 {
+			t.inputLock.Lock()
+			t.lastInput = time.Now()
+			t.inputLock.Unlock()
+
 			return n, err
 		}
 	}
 }
 
+// IdleTime returns how long it has been since the client last sent any text,
+// telnet commands don't count
+func (t *Telnet) IdleTime() time.Duration {
+	t.inputLock.RLock()
+	defer t.inputLock.RUnlock()
+
+	return time.Since(t.lastInput)
+}
+
 func (t *Telnet) Data(code TelnetCode) []byte {
 	return t.processor.subdata[code]
 }
 
+// Listen registers a function to be called with the data of every
+// subnegotiation the client sends, after any built in handling has run.
 func (t *Telnet) Listen(listenFunc func(TelnetCode, []byte)) {
-	t.processor.listenFunc = listenFunc
+	t.listenFunc = listenFunc
 }
 
 // Idea/name for this function shamelessly stolen from bufio
@@ -114,7 +170,10 @@ func (t *Telnet) fill() {
 	t.processor.addBytes(buf[:n])
 }
 
+// Close terminates the compressed stream, if any, so the client sees a clean
+// end of stream before the underlying connection is closed.
 func (t *Telnet) Close() error {
+	t.EndCompression()
 	return t.conn.Close()
 }
 
@@ -146,6 +205,7 @@ const (
 	stateInSB   processorState = iota
 	stateCapSB  processorState = iota
 	stateEscIAC processorState = iota
+	stateInCmd  processorState = iota
 )
 
 // telnetProcessor implements a state machine that reads input one byte at a time
@@ -154,13 +214,15 @@ const (
 // The processor can then be read from with all of the telnet codes removed, leaving
 // the pure user input stream.
 type telnetProcessor struct {
-	state     processorState
-	currentSB TelnetCode
+	state      processorState
+	currentSB  TelnetCode
+	currentCmd TelnetCode
 
 	capturedBytes []byte
 	subdata       map[TelnetCode][]byte
-	cleanData     string
+	cleanData     []byte
 	listenFunc    func(TelnetCode, []byte)
+	negotiateFunc func(TelnetCode, byte)
 
 	debug bool
 }
@@ -175,21 +237,8 @@ func newTelnetProcessor() *telnetProcessor {
 }
 
 func (tp *telnetProcessor) Read(p []byte) (int, error) {
-	maxLen := len(p)
-
-	n := 0
-
-	if maxLen >= len(tp.cleanData) {
-		n = len(tp.cleanData)
-	} else {
-		n = maxLen
-	}
-
-	for i := 0; i < n; i++ {
-		p[i] = tp.cleanData[i]
-	}
-
-	tp.cleanData = tp.cleanData[n:] // TODO: Memory leak?
+	n := copy(p, tp.cleanData)
+	tp.cleanData = tp.cleanData[n:]
 
 	return n, nil
 }
@@ -203,7 +252,8 @@ func (tp *telnetProcessor) capture(b byte) {
 }
 
 func (tp *telnetProcessor) dontCapture(b byte) {
-	tp.cleanData = tp.cleanData + string(b)
+	// Kept as bytes, the character set is decoded further up
+	tp.cleanData = append(tp.cleanData, b)
 }
 
 func (tp *telnetProcessor) resetSubDataField(code TelnetCode) {
@@ -246,7 +296,8 @@ func (tp *telnetProcessor) addByte(b byte) {
 
 	case stateInIAC:
 		if code == WILL || code == WONT || code == DO || code == DONT {
-			// Stay in this state
+			tp.currentCmd = code
+			tp.state = stateInCmd
 		} else if code == SB {
 			tp.state = stateInSB
 		} else {
@@ -254,6 +305,11 @@ func (tp *telnetProcessor) addByte(b byte) {
 		}
 		tp.capture(b)
 
+	case stateInCmd:
+		tp.capture(b)
+		tp.state = stateBase
+		tp.commandFinished(tp.currentCmd, b)
+
 	case stateInSB:
 		tp.capture(b)
 		tp.currentSB = code
@@ -281,6 +337,12 @@ func (tp *telnetProcessor) addByte(b byte) {
 	}
 }
 
+func (tp *telnetProcessor) commandFinished(command TelnetCode, option byte) {
+	if tp.negotiateFunc != nil {
+		tp.negotiateFunc(command, option)
+	}
+}
+
 func (tp *telnetProcessor) subDataFinished(code TelnetCode) {
 	if tp.listenFunc != nil {
 		tp.listenFunc(code, tp.subdata[code])
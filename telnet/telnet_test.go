@@ -2,9 +2,35 @@ package telnet
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yamamushi/kmud-2020/color"
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/utils"
+	"golang.org/x/crypto/ssh"
 )
 
 type fakeConn struct {
@@ -53,6 +79,37 @@ func (s *fakeConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// fakeClient keeps what the client sends separate from what the server writes
+// back to it, so that output can be inspected the way a real client would see it.
+// Every Send is delivered by a separate Read, the way separate packets would be.
+type fakeClient struct {
+	fakeConn
+	input  [][]byte
+	output bytes.Buffer
+}
+
+func (c *fakeClient) Send(p []byte) {
+	c.input = append(c.input, p)
+}
+
+func (c *fakeClient) Read(p []byte) (int, error) {
+	if len(c.input) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.input[0])
+	c.input[0] = c.input[0][n:]
+	if len(c.input[0]) == 0 {
+		c.input = c.input[1:]
+	}
+
+	return n, nil
+}
+
+func (c *fakeClient) Write(p []byte) (int, error) {
+	return c.output.Write(p)
+}
+
 func compareData(d1 []byte, d2 []byte) bool {
 	if len(d1) != len(d2) {
 		return false
@@ -182,3 +239,2416 @@ func Test_Processor(t *testing.T) {
 		t.Errorf("Bufio failure %v != %v", bytes, data)
 	}
 }
+
+func Test_Compression(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	readBuffer := make([]byte, 1024)
+
+	telnet.OfferCompression()
+	if !compareData(client.output.Bytes(), BuildCommand(WILL, CMP2)) {
+		t.Errorf("OfferCompression() wrote %v, want %v", client.output.Bytes(), BuildCommand(WILL, CMP2))
+	}
+	client.output.Reset()
+
+	// Nothing is compressed until the client agrees
+	telnet.Write([]byte("plain"))
+	if client.output.String() != "plain" {
+		t.Errorf("Uncompressed write == %q, want %q", client.output.String(), "plain")
+	}
+	client.output.Reset()
+
+	client.Send(append(BuildCommand(DO, CMP2), []byte("look\n")...))
+	n, _ := telnet.Read(readBuffer)
+	if string(readBuffer[:n]) != "look\n" {
+		t.Errorf("Read() == %q, want %q", readBuffer[:n], "look\n")
+	}
+
+	if !telnet.Compressed() {
+		t.Fatalf("Compression should be active after IAC DO COMPRESS2")
+	}
+
+	start := BuildCommand(SB, CMP2, IAC, SE)
+	if !bytes.HasPrefix(client.output.Bytes(), start) {
+		t.Fatalf("Compressed stream should begin with %v, got %v", start, client.output.Bytes())
+	}
+	client.output.Next(len(start))
+
+	// Prompts don't end in a newline, they must still be decodable as soon as they're written
+	prompt := "Password: "
+	telnet.Write([]byte(prompt))
+
+	reader, err := zlib.NewReader(&client.output)
+	if err != nil {
+		t.Fatalf("Failed to read zlib header: %v", err)
+	}
+
+	result := make([]byte, len(prompt))
+	_, err = io.ReadFull(reader, result)
+	if err != nil || string(result) != prompt {
+		t.Errorf("Decompressed %q (%v), want %q", result, err, prompt)
+	}
+
+	telnet.SendCommand(WONT, ECHO)
+	telnet.Close()
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Errorf("Stream was not terminated cleanly: %v", err)
+	}
+	if !compareData(rest, BuildCommand(WONT, ECHO)) {
+		t.Errorf("Decompressed %v, want %v", rest, BuildCommand(WONT, ECHO))
+	}
+
+	if telnet.Compressed() {
+		t.Errorf("Compression should end when the connection is closed")
+	}
+}
+
+func gmcpMessage(message string) []byte {
+	data := BuildCommand(SB, GMCP)
+	data = append(data, []byte(message)...)
+	return append(data, BuildCommand(SE)...)
+}
+
+func Test_GMCP(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	readBuffer := make([]byte, 1024)
+
+	var received []string
+	unsubscribe := SubscribeGMCP("char.login", func(conn *Telnet, pkg string, data []byte) {
+		if conn == telnet {
+			received = append(received, pkg+" "+string(data))
+		}
+	})
+	defer unsubscribe()
+
+	// Nothing goes out until the client agrees to GMCP
+	if err := telnet.SendGMCP("Core.Goodbye", nil); err != nil || client.output.Len() != 0 {
+		t.Errorf("SendGMCP() before negotiation wrote %q (%v)", client.output.String(), err)
+	}
+
+	telnet.OfferGMCP()
+	if !compareData(client.output.Bytes(), BuildCommand(WILL, GMCP)) {
+		t.Errorf("OfferGMCP() wrote %v, want %v", client.output.Bytes(), BuildCommand(WILL, GMCP))
+	}
+	client.output.Reset()
+
+	data := BuildCommand(DO, GMCP)
+	data = append(data, gmcpMessage(`Core.Hello {"client":"Mudlet","version":"4.10"}`)...)
+	data = append(data, gmcpMessage(`Core.Supports.Set ["Char 1", "Room 1", "Comm 1"]`)...)
+	data = append(data, gmcpMessage(`Core.Supports.Remove ["Comm"]`)...)
+	data = append(data, gmcpMessage(`Char.Login {"name":"test"}`)...)
+	data = append(data, []byte("look\n")...)
+	client.Send(data)
+
+	n, _ := telnet.Read(readBuffer)
+	if string(readBuffer[:n]) != "look\n" {
+		t.Errorf("Read() == %q, want %q", readBuffer[:n], "look\n")
+	}
+
+	if !telnet.GMCPEnabled() {
+		t.Fatalf("GMCP should be enabled after IAC DO GMCP")
+	}
+
+	name, version := telnet.GMCPClient()
+	if name != "Mudlet" || version != "4.10" {
+		t.Errorf("GMCPClient() == %q, %q, want %q, %q", name, version, "Mudlet", "4.10")
+	}
+
+	if !telnet.GMCPSupports("Char.Vitals") || !telnet.GMCPSupports("room.info") {
+		t.Errorf("Char and Room should be supported")
+	}
+	if telnet.GMCPSupports("Comm.Channel") {
+		t.Errorf("Comm should have been removed")
+	}
+
+	// A client may ask for just one package of a module
+	client.Send(append(gmcpMessage(`Core.Supports.Add ["Comm.Channel 1"]`), []byte("look\n")...))
+	telnet.Read(readBuffer)
+	if !telnet.GMCPSupports("Comm.Channel") || !telnet.GMCPSupports("comm.channel.text") {
+		t.Errorf("Comm.Channel should be supported after subscribing to it")
+	}
+	if telnet.GMCPSupports("Comm.Tell") || telnet.GMCPSupports("Comm") {
+		t.Errorf("Only Comm.Channel should be supported, not the rest of Comm")
+	}
+	client.output.Reset()
+	telnet.SendGMCP("Comm.Channel.Text", "hello")
+	if !bytes.Contains(client.output.Bytes(), []byte(`Comm.Channel.Text "hello"`)) {
+		t.Errorf("SendGMCP() to a subscribed package wrote %q", client.output.Bytes())
+	}
+	client.Send(append(gmcpMessage(`Core.Supports.Remove ["Comm.Channel"]`), []byte("look\n")...))
+	telnet.Read(readBuffer)
+	client.output.Reset()
+
+	if len(received) != 1 || received[0] != `Char.Login {"name":"test"}` {
+		t.Errorf("Subscribed handler received %q", received)
+	}
+
+	unsubscribe()
+	client.Send(append(gmcpMessage(`Char.Login {"name":"again"}`), []byte("look\n")...))
+	telnet.Read(readBuffer)
+	if len(received) != 1 {
+		t.Errorf("Unsubscribed handler received %q", received)
+	}
+
+	telnet.SendGMCP("Char.Vitals", map[string]int{"hp": 10})
+	want := gmcpMessage(`Char.Vitals {"hp":10}`)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("SendGMCP() wrote %q, want %q", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	telnet.SendGMCP("Comm.Channel", map[string]string{"chan": "say"})
+	if client.output.Len() != 0 {
+		t.Errorf("SendGMCP() for an unsupported module wrote %q", client.output.String())
+	}
+}
+
+func msdpMessage(data ...interface{}) []byte {
+	message := BuildCommand(SB, MSDP)
+	for _, d := range data {
+		switch v := d.(type) {
+		case byte:
+			message = append(message, v)
+		case string:
+			message = append(message, []byte(v)...)
+		}
+	}
+	return append(message, BuildCommand(SE)...)
+}
+
+func Test_MSDP(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	readBuffer := make([]byte, 1024)
+
+	RegisterMSDPVariable("HEALTH", "ROOM_EXITS")
+
+	if err := telnet.SetMSDPVariable("UNKNOWN", 1); err == nil {
+		t.Errorf("Setting an unregistered variable should fail")
+	}
+
+	// Values are kept but not sent before the client asks for them
+	telnet.SetMSDPVariable("HEALTH", 100)
+	if client.output.Len() != 0 {
+		t.Errorf("Unreported variable was sent: %q", client.output.String())
+	}
+
+	telnet.OfferMSDP()
+	client.output.Reset()
+
+	data := BuildCommand(DO, MSDP)
+	data = append(data, msdpMessage(msdpVar, "REPORT", msdpVal, msdpArrayOpen, msdpVal, "HEALTH", msdpVal, "ROOM_EXITS", msdpArrayClose)...)
+	data = append(data, []byte("\n")...)
+	client.Send(data)
+	telnet.Read(readBuffer)
+
+	if !telnet.MSDPEnabled() || !telnet.MSDPReported("HEALTH") || !telnet.MSDPReported("ROOM_EXITS") {
+		t.Fatalf("HEALTH and ROOM_EXITS should be reported after REPORT")
+	}
+
+	// REPORT sends the current value straight away
+	want := msdpMessage(msdpVar, "HEALTH", msdpVal, "100")
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("REPORT wrote %v, want %v", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	// Unchanged values aren't pushed again
+	telnet.SetMSDPVariable("HEALTH", 100)
+	if client.output.Len() != 0 {
+		t.Errorf("Unchanged variable was sent: %q", client.output.String())
+	}
+
+	telnet.SetMSDPVariable("ROOM_EXITS", map[string]string{"north": "1", "east": "2"})
+	want = msdpMessage(msdpVar, "ROOM_EXITS", msdpVal, msdpTableOpen,
+		msdpVar, "east", msdpVal, "2",
+		msdpVar, "north", msdpVal, "1",
+		msdpTableClose)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("SetMSDPVariable() wrote %v, want %v", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	client.Send(append(msdpMessage(msdpVar, "LIST", msdpVal, "REPORTED_VARIABLES"), '\n'))
+	telnet.Read(readBuffer)
+	want = msdpMessage(msdpVar, "REPORTED_VARIABLES", msdpVal, msdpArrayOpen, msdpVal, "HEALTH", msdpVal, "ROOM_EXITS", msdpArrayClose)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("LIST wrote %v, want %v", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	client.Send(append(msdpMessage(msdpVar, "UNREPORT", msdpVal, "HEALTH"), '\n'))
+	telnet.Read(readBuffer)
+	telnet.SetMSDPVariable("HEALTH", 50)
+	if client.output.Len() != 0 || telnet.MSDPReported("HEALTH") {
+		t.Errorf("HEALTH should not be reported after UNREPORT")
+	}
+
+	client.Send(append(msdpMessage(msdpVar, "SEND", msdpVal, "HEALTH"), '\n'))
+	telnet.Read(readBuffer)
+	want = msdpMessage(msdpVar, "HEALTH", msdpVal, "50")
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("SEND wrote %v, want %v", client.output.Bytes(), want)
+	}
+}
+
+func Test_MSSP(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	telnet.SetMSSPSource(func() []MSSPVariable {
+		return []MSSPVariable{{Name: "NAME", Value: "kmud"}, {Name: "PLAYERS", Value: "3"}}
+	})
+
+	telnet.OfferMSSP()
+	client.output.Reset()
+
+	client.Send(append(BuildCommand(DO, MSSP), []byte("\n")...))
+	telnet.Read(make([]byte, 1024))
+
+	want := BuildCommand(SB, MSSP)
+	want = append(want, msspVar)
+	want = append(want, []byte("NAME")...)
+	want = append(want, msspVal)
+	want = append(want, []byte("kmud")...)
+	want = append(want, msspVar)
+	want = append(want, []byte("PLAYERS")...)
+	want = append(want, msspVal)
+	want = append(want, []byte("3")...)
+	want = append(want, BuildCommand(SE)...)
+
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("IAC DO MSSP wrote %v, want %v", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	// Plain text requests are answered at the prompt and don't count as input
+	ch := ConnectionHandler{conn: newWrappedConnection(telnet)}
+	client.Send([]byte("MSSP-REQUEST\r\n"))
+	client.Send([]byte("l\r\n"))
+
+	input := ch.GetInput("> ")
+	if input != "l" {
+		t.Errorf("GetInput() == %q, want %q", input, "l")
+	}
+
+	reply := "MSSP-REPLY-START\r\nNAME\tkmud\r\nPLAYERS\t3\r\nMSSP-REPLY-END\r\n"
+	if !strings.Contains(client.output.String(), reply) {
+		t.Errorf("Plain text MSSP reply %q not found in %q", reply, client.output.String())
+	}
+}
+
+func Test_MXP(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	link := color.Link("north", "n", "Go north")
+
+	utils.Write(telnet, link, color.ModeNone)
+	if client.output.String() != "north" {
+		t.Errorf("Write(%q) without MXP wrote %q, want %q", link, client.output.String(), "north")
+	}
+	client.output.Reset()
+
+	telnet.OfferMXP()
+	client.output.Reset()
+
+	client.Send(append(BuildCommand(DO, MXP), []byte("\n")...))
+	telnet.Read(make([]byte, 1024))
+
+	want := append(BuildCommand(SB, MXP), BuildCommand(SE)...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("IAC DO MXP wrote %v, want %v", client.output.Bytes(), want)
+	}
+	if !telnet.MXPEnabled() {
+		t.Errorf("MXPEnabled() == false after IAC DO MXP")
+	}
+	client.output.Reset()
+
+	utils.Write(telnet, ">>> "+link, color.ModeNone)
+	want = []byte("&gt;&gt;&gt; \033[4z<send href=\"n\" hint=\"Go north\">north\033[4z</send>")
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("Write(%q) with MXP wrote %q, want %q", link, client.output.String(), want)
+	}
+	client.output.Reset()
+
+	// Only tags from color.Link are sent as tags
+	forged := "\033[4z<send href=\"quit\">north\033[1z"
+	utils.Write(telnet, forged, color.ModeNone)
+	want = []byte("&lt;send href=\"quit\"&gt;north")
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("Write(%q) with MXP wrote %q, want %q", forged, client.output.String(), want)
+	}
+}
+
+func Test_WatchConnection(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	wc := newWrappedConnection(telnet)
+
+	client.Send(append(BuildCommand(DO, SGA), BuildCommand(DO, ECHO)...))
+	if err := telnet.OfferCharacterMode(); err != nil {
+		t.Fatalf("OfferCharacterMode() failed: %v", err)
+	}
+
+	var watcher bytes.Buffer
+	wc.AddWatcher(&watcher)
+	line := make([]byte, 1024)
+
+	// Watchers see the edited line once, not every key press and its echo
+	wc.Write([]byte("> "))
+	client.Send([]byte("lk\x1b[Doo\r\x00"))
+	wc.Read(line)
+	if watcher.String() != "> look\n" {
+		t.Errorf("Watcher saw %q, want %q", watcher.String(), "> look\n")
+	}
+	watcher.Reset()
+
+	wc.Write([]byte("Password: "))
+	wc.WillEcho()
+	client.Send([]byte("secret\r\x00"))
+	wc.Read(line)
+	wc.WontEcho()
+	if watcher.String() != "Password: " {
+		t.Errorf("Watcher saw %q around a password, want %q", watcher.String(), "Password: ")
+	}
+	wc.RemoveWatcher(&watcher)
+
+	if _, err := wc.StartRecording("bob"); err != ErrRecordingOff {
+		t.Errorf("StartRecording() with no recording_dir == %v, want ErrRecordingOff", err)
+	}
+
+	wc.recordingDir = t.TempDir()
+	path, err := wc.StartRecording("../Bob the Brave")
+	if err != nil {
+		t.Fatalf("StartRecording() failed: %v", err)
+	}
+	if filepath.Dir(path) != wc.recordingDir || !strings.HasPrefix(filepath.Base(path), "BobtheBrave-") {
+		t.Errorf("StartRecording() recorded to %v", path)
+	}
+	if _, err := wc.StartRecording("bob"); err != ErrAlreadyRecording {
+		t.Errorf("StartRecording() twice == %v, want ErrAlreadyRecording", err)
+	}
+
+	wc.Write([]byte("> "))
+	client.Send([]byte("north\r\x00"))
+	wc.Read(line)
+	wc.Close()
+
+	if wc.Recording() {
+		t.Errorf("Recording() == true after Close()")
+	}
+	if err := wc.StopRecording(); err != ErrNotRecording {
+		t.Errorf("StopRecording() after Close() == %v, want ErrNotRecording", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading the recording failed: %v", err)
+	}
+	var output bytes.Buffer
+	if err := utils.ReplayTtyrec(bytes.NewReader(data), &output, 1, func(time.Duration) {}); err != nil {
+		t.Fatalf("ReplayTtyrec() failed: %v", err)
+	}
+	if output.String() != "> north\r\n" {
+		t.Errorf("Recording played back %q, want %q", output.String(), "> north\r\n")
+	}
+}
+
+func Test_RecordingLimit(t *testing.T) {
+	var client fakeClient
+	wc := newWrappedConnection(NewTelnet(&client))
+	wc.recordingDir = t.TempDir()
+	wc.recordingLimit = 100
+
+	path, err := wc.StartRecording("bob")
+	if err != nil {
+		t.Fatalf("StartRecording() failed: %v", err)
+	}
+
+	// Each write is a frame of its own, twelve bytes of header and the data
+	for i := 0; i < 10; i++ {
+		wc.Write([]byte("0123456789"))
+	}
+	waitFor(t, "the recording to stop at its limit", func() bool { return !wc.Recording() })
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading the recording failed: %v", err)
+	}
+	if len(data) != 4*22 {
+		t.Errorf("Recording with a 100 byte limit is %v bytes, want the %v of the frames that fit", len(data), 4*22)
+	}
+	if err := utils.ReplayTtyrec(bytes.NewReader(data), io.Discard, 1, func(time.Duration) {}); err != nil {
+		t.Errorf("ReplayTtyrec() of a recording stopped at its limit failed: %v", err)
+	}
+
+	if _, err := wc.StartRecording("bob"); err != nil {
+		t.Errorf("StartRecording() after reaching the limit failed: %v", err)
+	}
+	wc.Close()
+}
+
+func Test_CharacterMode(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	wc := newWrappedConnection(telnet)
+
+	client.Send(append(BuildCommand(DO, SGA), BuildCommand(DO, ECHO)...))
+	if err := telnet.OfferCharacterMode(); err != nil {
+		t.Fatalf("OfferCharacterMode() failed: %v", err)
+	}
+	if !telnet.CharacterMode() {
+		t.Fatalf("CharacterMode() == false after IAC DO SGA, IAC DO ECHO")
+	}
+	client.output.Reset()
+
+	readLine := func() string {
+		line := make([]byte, 1024)
+		n, _ := wc.Read(line)
+		return string(line[:n])
+	}
+
+	// Key presses are edited and echoed by the server
+	client.Send([]byte("lk\x1b[Doo\r\x00"))
+	if line := readLine(); line != "look\n" {
+		t.Errorf("Read() in character mode == %q, want %q", line, "look\n")
+	}
+	if !strings.HasPrefix(client.output.String(), "lk") {
+		t.Errorf("Read() in character mode echoed %q", client.output.String())
+	}
+	client.output.Reset()
+
+	// Passwords are hidden without renegotiating echo
+	wc.WillEcho()
+	client.Send([]byte("secret\r\x00"))
+	if line := readLine(); line != "secret\n" {
+		t.Errorf("Read() with echo off == %q, want %q", line, "secret\n")
+	}
+	wc.WontEcho()
+	if client.output.Len() != 0 {
+		t.Errorf("Read() with echo off wrote %q", client.output.String())
+	}
+
+	// Clients that refuse stay in line mode
+	var refusing fakeClient
+	telnet = NewTelnet(&refusing)
+	refusing.Send(append(BuildCommand(DO, SGA), BuildCommand(DONT, ECHO)...))
+	if err := telnet.OfferCharacterMode(); err != ErrNegotiationRefused {
+		t.Errorf("OfferCharacterMode() refused returned %v, want %v", err, ErrNegotiationRefused)
+	}
+	if telnet.CharacterMode() || telnet.LocalEnabled(SGA) {
+		t.Errorf("Refused character mode left SGA enabled")
+	}
+}
+
+func Test_Charset(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+
+	accepted := append(BuildCommand(SB, CHARSET), charsetAccepted)
+	accepted = append(accepted, "utf-8"...)
+	accepted = append(accepted, BuildCommand(SE)...)
+	client.Send(BuildCommand(DO, CHARSET))
+	client.Send(accepted)
+
+	if err := telnet.OfferCharset(); err != nil {
+		t.Fatalf("OfferCharset() failed: %v", err)
+	}
+
+	want := BuildCommand(WILL, CHARSET)
+	want = append(want, BuildCommand(SB, CHARSET)...)
+	want = append(want, charsetRequest)
+	want = append(want, ";UTF-8;ISO-8859-1;US-ASCII"...)
+	want = append(want, BuildCommand(SE)...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("OfferCharset() wrote %q, want %q", client.output.Bytes(), want)
+	}
+	if telnet.Charset() != CharsetUTF8 {
+		t.Errorf("Charset() == %q after ACCEPTED utf-8, want %q", telnet.Charset(), CharsetUTF8)
+	}
+
+	// Requests from the client are answered with the first supported charset
+	client.output.Reset()
+	request := append(BuildCommand(SB, CHARSET), charsetRequest)
+	request = append(request, " KOI8-R latin1 UTF-8"...)
+	request = append(request, BuildCommand(SE)...)
+	client.Send(append(request, '\n'))
+	telnet.Read(make([]byte, 1024))
+
+	want = append(BuildCommand(SB, CHARSET), charsetAccepted)
+	want = append(want, "latin1"...)
+	want = append(want, BuildCommand(SE)...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("CHARSET REQUEST got %q, want %q", client.output.Bytes(), want)
+	}
+	if telnet.Charset() != CharsetLatin1 {
+		t.Errorf("Charset() == %q after REQUEST, want %q", telnet.Charset(), CharsetLatin1)
+	}
+
+	// Clients that refuse are legacy clients
+	var refusing fakeClient
+	telnet = NewTelnet(&refusing)
+	refusing.Send(BuildCommand(DONT, CHARSET))
+	if err := telnet.OfferCharset(); err != nil || telnet.Charset() != "" {
+		t.Errorf("OfferCharset() refused == %v, charset %q", err, telnet.Charset())
+	}
+}
+
+func Test_CharsetConversion(t *testing.T) {
+	tests := []struct {
+		charset string
+		text    string
+		encoded string
+	}{
+		{CharsetUTF8, "Zoë says “hi” 日本", "Zoë says “hi” 日本"},
+		{CharsetLatin1, "Zoë says “hi” ÿ", "Zo\xeb says \"hi\" \xff\xff"},
+		{CharsetASCII, "Zoë says “hi”", "Zoe says \"hi\""},
+		{"", "Zoë says “hi”", "Zoe says \"hi\""},
+	}
+
+	for _, test := range tests {
+		if encoded := encodeText([]byte(test.text), test.charset); string(encoded) != test.encoded {
+			t.Errorf("encodeText(%q, %q) == %q, want %q", test.text, test.charset, encoded, test.encoded)
+		}
+	}
+
+	decodeTests := []struct {
+		charset string
+		input   string
+		decoded string
+	}{
+		{CharsetUTF8, "Zoë", "Zoë"},
+		{CharsetUTF8, "Zo\xeb", "Zo\uFFFD"},
+		{CharsetLatin1, "Zo\xeb", "Zoë"},
+		{"", "Zoë", "Zoë"},
+		{"", "Zo\xeb!", "Zoë!"},
+	}
+
+	for _, test := range decodeTests {
+		decoded, partial := decodeText([]byte(test.input), test.charset, false)
+		if string(decoded) != test.decoded || len(partial) != 0 {
+			t.Errorf("decodeText(%q, %q) == %q, %q, want %q", test.input, test.charset, decoded, partial, test.decoded)
+		}
+	}
+
+	// A character split between reads comes through whole
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	telnet.SetCharset(CharsetUTF8)
+	conn := newCharsetConn(telnet)
+
+	client.Send([]byte("Zo\xc3"))
+	client.Send([]byte("\xab\n"))
+	data, _ := io.ReadAll(conn)
+	if string(data) != "Zoë\n" {
+		t.Errorf("Read() of a split character == %q, want %q", data, "Zoë\n")
+	}
+}
+
+func Test_ColorDepth(t *testing.T) {
+	var client fakeClient
+	var wc *WrappedConnection
+
+	tests := []struct {
+		responses []string
+		depth     color.ColorDepth
+	}{
+		{nil, color.Depth16},
+		{[]string{"ANSI"}, color.Depth16},
+		{[]string{"XTERM-256COLOR"}, color.Depth256},
+		{[]string{"xterm-direct"}, color.DepthTrueColor},
+		{[]string{"TINTIN++", "ANSI", "MTTS 1"}, color.Depth16},
+		{[]string{"TINTIN++", "ANSI", "MTTS 9"}, color.Depth256},
+		{[]string{"TINTIN++", "ANSI", "MTTS 265"}, color.DepthTrueColor},
+	}
+
+	for _, test := range tests {
+		wc = newWrappedConnection(NewTelnet(&client))
+		for _, response := range test.responses {
+			wc.handleTerminalType(append([]byte{ttypeIs}, response...))
+		}
+		if depth := wc.ColorDepth(); depth != test.depth {
+			t.Errorf("ColorDepth() for %q == %v, want %v", test.responses, depth, test.depth)
+		}
+	}
+
+	wc.SetColorDepth(color.Depth256)
+	if depth := wc.ColorDepth(); depth != color.Depth256 {
+		t.Errorf("ColorDepth() after SetColorDepth == %v, want %v", depth, color.Depth256)
+	}
+}
+
+func Test_NAWS(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+
+	nawsMessage := func(data ...byte) []byte {
+		message := append(BuildCommand(SB, WS), data...)
+		return append(message, BuildCommand(SE)...)
+	}
+
+	client.Send(append(BuildCommand(WILL, WS), nawsMessage(0, 80, 0, 24)...))
+	width, height, err := telnet.DoWindowSize()
+	if err != nil || width != 80 || height != 24 {
+		t.Errorf("DoWindowSize() == %v, %v, %v, want 80, 24, nil", width, height, err)
+	}
+
+	var terminal Terminal
+	telnet.OnWindowSize(terminal.setSize)
+
+	// A width of 255 has to be sent as an escaped IAC
+	client.Send(append(nawsMessage(0, 255, 255, 0, 50), '\n'))
+	telnet.Read(make([]byte, 1024))
+
+	width, height = telnet.WindowSize()
+	if width != 255 || height != 50 {
+		t.Errorf("WindowSize() == %v, %v after resize, want 255, 50", width, height)
+	}
+
+	columns, rows := terminal.Size()
+	if columns != 255 || rows != 50 || terminal.Columns != "255" {
+		t.Errorf("Terminal.Size() == %v, %v after resize, want 255, 50", columns, rows)
+	}
+}
+
+// silentClient returns a connection whose client reads everything the server
+// sends but never answers, like netcat or a port scanner would
+func silentClient() net.Conn {
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	return server
+}
+
+func Test_GetTermInfoSilentClient(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 50 * time.Millisecond
+
+	conn := silentClient()
+	defer conn.Close()
+
+	start := time.Now()
+	term, err := GetTermInfo(NewTelnet(conn))
+	if err != nil {
+		t.Fatalf("GetTermInfo() returned %v for a silent client, want defaults", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetTermInfo() took %v for a silent client", elapsed)
+	}
+
+	columns, rows := term.Size()
+	if columns != DefaultColumns || rows != DefaultRows || term.VT100 {
+		t.Errorf("GetTermInfo() == %vx%v (vt100 %v), want %vx%v", columns, rows, term.VT100, DefaultColumns, DefaultRows)
+	}
+}
+
+func Test_MTTS(t *testing.T) {
+	ttypeIsMessage := func(response string) []byte {
+		message := append(BuildCommand(SB, TT), ttypeIs)
+		message = append(message, response...)
+		return append(message, BuildCommand(SE)...)
+	}
+	ttypeSendMessage := append(append(BuildCommand(SB, TT), ttypeSend), BuildCommand(SE)...)
+
+	var client fakeClient
+	client.Send(BuildCommand(WILL, TT))
+	client.Send(ttypeIsMessage("MUDLET"))
+	client.Send(ttypeIsMessage("XTERM-256COLOR"))
+	client.Send(ttypeIsMessage("MTTS 2397"))
+	client.Send(BuildCommand(WONT, WS))
+
+	telnet := NewTelnet(&client)
+	term, err := GetTermInfo(telnet)
+	if err != nil {
+		t.Fatalf("GetTermInfo() failed: %v", err)
+	}
+
+	want := BuildCommand(DO, TT)
+	for i := 0; i < 3; i++ {
+		want = append(want, ttypeSendMessage...)
+	}
+	want = append(want, BuildCommand(DO, WS)...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("MTTS cycle wrote %v, want %v", client.output.Bytes(), want)
+	}
+
+	wantCaps := Capabilities{
+		ClientName:   "MUDLET",
+		TerminalType: "xterm-256color",
+		MTTS:         true,
+		ANSI:         true,
+		UTF8:         true,
+		Colors256:    true,
+		Mouse:        true,
+		ScreenReader: true,
+		TrueColor:    true,
+		TLS:          true,
+	}
+	if term.Capabilities != wantCaps {
+		t.Errorf("Capabilities == %+v, want %+v", term.Capabilities, wantCaps)
+	}
+	if !term.VT100 || term.Type != "xterm-256color" {
+		t.Errorf("Terminal type == %q (vt100 %v), want xterm-256color", term.Type, term.VT100)
+	}
+	if telnet.textCharset() != CharsetUTF8 {
+		t.Errorf("Charset for an MTTS UTF-8 client == %q, want %q", telnet.textCharset(), CharsetUTF8)
+	}
+
+	// Clients without MTTS repeat their terminal type and are asked twice
+	client = fakeClient{}
+	client.Send(BuildCommand(WILL, TT))
+	client.Send(ttypeIsMessage("ANSI"))
+	client.Send(ttypeIsMessage("ANSI"))
+
+	telnet = NewTelnet(&client)
+	termtype, err := telnet.DoTerminalType()
+	if err != nil || termtype != "ansi" {
+		t.Errorf("DoTerminalType() == %q, %v, want ansi", termtype, err)
+	}
+	if caps := telnet.Capabilities(); caps.MTTS || caps.ClientName != "" {
+		t.Errorf("Capabilities without MTTS == %+v", caps)
+	}
+	want = append(BuildCommand(DO, TT), ttypeSendMessage...)
+	want = append(want, ttypeSendMessage...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("TTYPE without MTTS wrote %v, want %v", client.output.Bytes(), want)
+	}
+}
+
+func Test_GetTermInfoRefused(t *testing.T) {
+	var client fakeClient
+	client.Send(BuildCommand(WONT, TT))
+	client.Send(BuildCommand(WONT, WS))
+
+	term, err := GetTermInfo(NewTelnet(&client))
+	if err != nil {
+		t.Fatalf("GetTermInfo() returned %v for a client that refused, want defaults", err)
+	}
+
+	columns, rows := term.Size()
+	if columns != DefaultColumns || rows != DefaultRows {
+		t.Errorf("GetTermInfo() == %vx%v, want %vx%v", columns, rows, DefaultColumns, DefaultRows)
+	}
+}
+
+func Test_ListenSilentClients(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 200 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+
+	server := NewServer(&config.Config{})
+	server.listener = listener
+	server.CreateConnectionPool()
+
+	handled := make(chan *Terminal)
+	runner := func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		handled <- term
+	}
+
+	done := make(chan bool)
+	go func() {
+		server.Listen(runner, &config.Config{})
+		done <- true
+	}()
+
+	// Neither client ever answers, the second must not wait on the first
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() failed: %v", err)
+		}
+		defer conn.Close()
+		go io.Copy(io.Discard, conn)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case term := <-handled:
+			if columns, rows := term.Size(); columns != DefaultColumns || rows != DefaultRows {
+				t.Errorf("Silent client got a %vx%v terminal, want %vx%v", columns, rows, DefaultColumns, DefaultRows)
+			}
+		case <-timeout:
+			t.Fatalf("Only %v of 2 silent clients were handed to the runner", i)
+		}
+	}
+
+	listener.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Listen() didn't return after the listener was closed")
+	}
+}
+
+func Test_OptionNegotiation(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	readBuffer := make([]byte, 1024)
+
+	// Options nobody registered are refused with the option byte the client sent
+	client.Send([]byte{'\xff', '\xfd', '\x99', '\xff', '\xfb', '\x98', '\n'})
+	telnet.Read(readBuffer)
+	want := []byte{'\xff', '\xfc', '\x99', '\xff', '\xfe', '\x98'}
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("Unknown options got %v, want %v", client.output.Bytes(), want)
+	}
+	client.output.Reset()
+
+	// A request the client makes is agreed to once, repeating it doesn't loop
+	client.Send(append(append(BuildCommand(DO, GMCP), BuildCommand(DO, GMCP)...), '\n'))
+	telnet.Read(readBuffer)
+	if !compareData(client.output.Bytes(), BuildCommand(WILL, GMCP)) {
+		t.Errorf("IAC DO GMCP twice got %v, want %v", client.output.Bytes(), BuildCommand(WILL, GMCP))
+	}
+	if !telnet.LocalEnabled(GMCP) || telnet.RemoteEnabled(GMCP) {
+		t.Errorf("Only the server's side of GMCP should be enabled")
+	}
+	client.output.Reset()
+
+	// Asking for the opposite while a negotiation is pending waits for the
+	// answer, then asks again
+	telnet.WillEcho()
+	telnet.WontEcho()
+	if !compareData(client.output.Bytes(), BuildCommand(WILL, ECHO)) {
+		t.Errorf("WillEcho() WontEcho() wrote %v, want %v", client.output.Bytes(), BuildCommand(WILL, ECHO))
+	}
+	client.output.Reset()
+
+	client.Send(append(BuildCommand(DO, ECHO), '\n'))
+	telnet.Read(readBuffer)
+	if !compareData(client.output.Bytes(), BuildCommand(WONT, ECHO)) {
+		t.Errorf("IAC DO ECHO after WontEcho() got %v, want %v", client.output.Bytes(), BuildCommand(WONT, ECHO))
+	}
+	client.output.Reset()
+
+	client.Send(append(BuildCommand(DONT, ECHO), '\n'))
+	telnet.Read(readBuffer)
+	if client.output.Len() != 0 || telnet.LocalEnabled(ECHO) {
+		t.Errorf("IAC DONT ECHO got %v, echo enabled %v", client.output.Bytes(), telnet.LocalEnabled(ECHO))
+	}
+
+	// Registered handlers see the option change and its subnegotiations
+	var events []string
+	previous, _ := getOptionHandler(SGA)
+	RegisterOption(SGA, OptionHandler{
+		AcceptRemote: true,
+		Enabled: func(conn *Telnet, local bool) {
+			events = append(events, "enabled")
+		},
+		Disabled: func(conn *Telnet, local bool) {
+			events = append(events, "disabled")
+		},
+		Subnegotiation: func(conn *Telnet, data []byte) {
+			events = append(events, string(data))
+		},
+	})
+	defer RegisterOption(SGA, previous)
+
+	data := BuildCommand(WILL, SGA)
+	data = append(data, BuildCommand(SB, SGA)...)
+	data = append(data, []byte("data")...)
+	data = append(data, BuildCommand(SE)...)
+	data = append(data, BuildCommand(WONT, SGA)...)
+	client.Send(append(data, '\n'))
+	telnet.Read(readBuffer)
+
+	want = append(BuildCommand(DO, SGA), BuildCommand(DONT, SGA)...)
+	if !compareData(client.output.Bytes(), want) {
+		t.Errorf("IAC WILL SGA, IAC WONT SGA got %v, want %v", client.output.Bytes(), want)
+	}
+	if strings.Join(events, " ") != "enabled data disabled" {
+		t.Errorf("Handler saw %v, want [enabled data disabled]", events)
+	}
+}
+
+// writeTestCertificate generates a self-signed certificate for 127.0.0.1 and
+// writes it and its key to dir, returning their paths and a pool trusting it
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kmud test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPem)
+	return certFile, keyFile, pool
+}
+
+func Test_ListenTLS(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 200 * time.Millisecond
+
+	certFile, keyFile, roots := writeTestCertificate(t, t.TempDir())
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = "0"
+	conf.Server.TLSPort = "0"
+	conf.Server.TLSCert = certFile
+	conf.Server.TLSKey = keyFile
+
+	server := NewServer(conf)
+	if err := server.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	defer server.listener.Close()
+	defer server.tlsListener.Close()
+	server.CreateConnectionPool()
+
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		c.WriteLine("welcome")
+	}, conf)
+
+	readWelcome := func(conn net.Conn) {
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		var received []byte
+		buffer := make([]byte, 1024)
+		for !bytes.Contains(received, []byte("welcome")) {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				t.Errorf("Didn't receive the welcome from %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+			received = append(received, buffer[:n]...)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", server.tlsListener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("tls.Dial() failed: %v", err)
+	}
+	readWelcome(conn)
+
+	// The plain listener keeps working next to the TLS one
+	plain, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	readWelcome(plain)
+}
+
+func Test_WebSocket(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 100 * time.Millisecond
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = "0"
+	conf.Server.WebSocketPort = "0"
+	conf.Server.WebSocketPath = "/play"
+
+	server := NewServer(conf)
+	if err := server.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	defer server.listener.Close()
+	defer server.webSocketListener.Close()
+	server.CreateConnectionPool()
+
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		c.GetConn().WillEcho()
+		input := c.GetInput("> ")
+		c.WriteLine("you said %s", input)
+	}, conf)
+
+	url := "ws://" + server.webSocketListener.Addr().String() + "/play"
+
+	// readUntil reads messages until one contains want, returning everything read
+	readUntil := func(ws *websocket.Conn, want string) []byte {
+		_ = ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		var received []byte
+		for !bytes.Contains(received, []byte(want)) {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Didn't receive %q, got %q: %v", want, received, err)
+			}
+			received = append(received, data...)
+		}
+		return received
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"text"}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() with the text subprotocol failed: %v", err)
+	}
+	defer ws.Close()
+
+	received := readUntil(ws, "> ")
+	if bytes.IndexByte(received, codeToByte[IAC]) != -1 {
+		t.Errorf("Text client was sent telnet commands: %v", received)
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte("look"))
+	readUntil(ws, "you said look")
+
+	dialer = websocket.Dialer{Subprotocols: []string{"telnet"}}
+	ws, _, err = dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() with the telnet subprotocol failed: %v", err)
+	}
+	defer ws.Close()
+
+	// Negotiation goes out as it would over telnet, and silence gets defaults
+	readUntil(ws, string(BuildCommand(DO, TT)))
+	readUntil(ws, string(BuildCommand(WILL, ECHO)))
+
+	ws.WriteMessage(websocket.BinaryMessage, []byte("look\r\n"))
+	readUntil(ws, "you said look")
+}
+
+func Test_StripTelnetCommands(t *testing.T) {
+	data := []byte("a")
+	data = append(data, BuildCommand(WILL, ECHO)...)
+	data = append(data, 'b', codeToByte[IAC], codeToByte[IAC])
+	data = append(data, BuildCommand(SB, MSDP)...)
+	data = append(data, 1, codeToByte[IAC], codeToByte[IAC], codeToByte[SE])
+	data = append(data, BuildCommand(SE)...)
+	data = append(data, 'c')
+
+	want := []byte{'a', 'b', codeToByte[IAC], 'c'}
+	if result := stripTelnetCommands(data); !compareData(result, want) {
+		t.Errorf("stripTelnetCommands(%v) == %v, want %v", data, result, want)
+	}
+}
+
+// newPoolConnection adds a connection to pool whose client end is returned,
+// everything written to the client is copied into received
+func newPoolConnection(t *testing.T, pool *ConnectionPool, id string, received *bytes.Buffer, lock *sync.Mutex) (*ConnectionHandler, net.Conn) {
+	server, client := net.Pipe()
+	ch := &ConnectionHandler{
+		id:        id,
+		config:    &config.Config{},
+		conn:      newWrappedConnection(NewTelnet(server)),
+		pool:      pool.messages,
+		connected: time.Now(),
+	}
+	if err := pool.AddToPool(ch); err != nil {
+		t.Errorf("AddToPool(%v) failed: %v", id, err)
+	}
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := client.Read(buf)
+			lock.Lock()
+			received.Write(buf[:n])
+			lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return ch, client
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ConnectionPool(t *testing.T) {
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	received := map[string]*bytes.Buffer{"a": {}, "b": {}, "c": {}}
+	handlers := map[string]*ConnectionHandler{}
+	for _, id := range []string{"a", "b", "c"} {
+		handlers[id], _ = newPoolConnection(t, pool, id, received[id], &lock)
+	}
+
+	if err := pool.AddToPool(handlers["a"]); err == nil {
+		t.Errorf("Adding a connection twice didn't fail")
+	}
+
+	handlers["b"].SetAuthToken("token")
+	infos := pool.Connections()
+	if len(infos) != 3 {
+		t.Fatalf("Connections() returned %v connections, want 3", len(infos))
+	}
+	for _, info := range infos {
+		if info.Authenticated != (info.ID == "b") {
+			t.Errorf("Connection %v Authenticated == %v", info.ID, info.Authenticated)
+		}
+		if info.RemoteAddr == "" {
+			t.Errorf("Connection %v has no remote address", info.ID)
+		}
+	}
+
+	// Broadcasts reach everyone, or only those the filter picks
+	if sent := pool.BroadcastMessage("hello all", nil); sent != 3 {
+		t.Errorf("BroadcastMessage() to all reached %v connections, want 3", sent)
+	}
+	sent := pool.BroadcastMessage("hello users", func(c *ConnectionHandler) bool {
+		return c.Authenticated()
+	})
+	if sent != 1 {
+		t.Errorf("BroadcastMessage() to authenticated connections reached %v, want 1", sent)
+	}
+
+	contains := func(id string, text string) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Contains(received[id].String(), text)
+	}
+	for id := range received {
+		waitFor(t, id+" to get the broadcast", func() bool { return contains(id, "hello all") })
+		if contains(id, "hello users") != (id == "b") {
+			t.Errorf("Filtered broadcast reached %v", id)
+		}
+	}
+
+	// Closing by ID closes and removes only that connection
+	if err := pool.CloseConnection("a"); err != nil {
+		t.Errorf("CloseConnection(a) failed: %v", err)
+	}
+	if err := pool.CloseConnection("a"); err != ErrConnectionNotFound {
+		t.Errorf("CloseConnection() of a closed connection == %v, want %v", err, ErrConnectionNotFound)
+	}
+	if pool.Find("a") != nil || pool.Count() != 2 {
+		t.Errorf("CloseConnection(a) left %v connections, want 2", pool.Count())
+	}
+
+	// So do the messages sent through the pool
+	pool.messages <- PoolMessage{TargetID: "b", Type: "disconnect"}
+	waitFor(t, "the disconnect message", func() bool { return pool.Find("b") == nil })
+
+	pool.messages <- PoolMessage{TargetID: "c", Type: "disconnected"}
+	waitFor(t, "the disconnected message", func() bool { return pool.Count() == 0 })
+
+	if err := pool.RemoveFromPool(handlers["c"]); err != ErrConnectionNotFound {
+		t.Errorf("RemoveFromPool() of a removed connection == %v, want %v", err, ErrConnectionNotFound)
+	}
+}
+
+func Test_BroadcastStalledClient(t *testing.T) {
+	defer func(timeout time.Duration) { KeepaliveTimeout = timeout }(KeepaliveTimeout)
+	KeepaliveTimeout = 100 * time.Millisecond
+
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	var received bytes.Buffer
+	newPoolConnection(t, pool, "reading", &received, &lock)
+
+	// Nothing ever reads from the other end of this one
+	server, client := net.Pipe()
+	defer client.Close()
+	stalled := &ConnectionHandler{id: "stalled", config: &config.Config{}, conn: newWrappedConnection(NewTelnet(server)), pool: pool.messages}
+	pool.AddToPool(stalled)
+
+	start := time.Now()
+	if sent := pool.BroadcastMessage("hello", nil); sent != 1 {
+		t.Errorf("BroadcastMessage() reached %v connections, want 1", sent)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("BroadcastMessage() took %v with a stalled client", elapsed)
+	}
+	if pool.Find("stalled") != nil {
+		t.Errorf("The stalled client was left in the pool")
+	}
+	client.Close()
+
+	server, client = net.Pipe()
+	defer client.Close()
+	stalled = &ConnectionHandler{id: "stalled", config: &config.Config{}, conn: newWrappedConnection(NewTelnet(server)), pool: pool.messages}
+	pool.AddToPool(stalled)
+
+	// Broadcasts through the pool don't hold up its other messages
+	done := make(chan bool)
+	go func() {
+		pool.messages <- PoolMessage{Type: "broadcast", Args: []string{"again"}}
+		pool.messages <- PoolMessage{TargetID: "reading", Type: "disconnect"}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(KeepaliveTimeout / 2):
+		t.Errorf("The pool stopped handling messages during a broadcast")
+	}
+	waitFor(t, "the disconnect message", func() bool { return pool.Find("reading") == nil })
+	waitFor(t, "the stalled client to be dropped", func() bool { return pool.Count() == 0 })
+}
+
+func Test_TellCopyoverStalledClient(t *testing.T) {
+	defer func(timeout time.Duration) { ShutdownWriteTimeout = timeout }(ShutdownWriteTimeout)
+	ShutdownWriteTimeout = 100 * time.Millisecond
+
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	var received bytes.Buffer
+	reading, _ := newPoolConnection(t, pool, "reading", &received, &lock)
+
+	// Nothing ever reads from the other end of this one
+	server, client := net.Pipe()
+	defer client.Close()
+	stalled := &ConnectionHandler{id: "stalled", config: &config.Config{}, conn: newWrappedConnection(NewTelnet(server)), pool: pool.messages}
+
+	start := time.Now()
+	left := tellCopyover([]*ConnectionHandler{reading, stalled}, "Copyover in progress, please wait...", true)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("tellCopyover() took %v with a stalled client", elapsed)
+	}
+	if len(left) != 1 || left[0] != stalled {
+		t.Errorf("tellCopyover() returned %v, want only the stalled client", left)
+	}
+	waitFor(t, "the copyover message", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Contains(received.String(), "Copyover in progress")
+	})
+}
+
+func Test_SaveStateCopies(t *testing.T) {
+	var client fakeClient
+	telnet := NewTelnet(&client)
+	telnet.gmcp.supports = map[string]int{"char": 1}
+	telnet.msdp.values = map[string][]byte{"HEALTH": []byte("10")}
+
+	state := telnet.saveState()
+	telnet.gmcp.supports["room"] = 1
+	telnet.msdp.values["HEALTH"][0] = '9'
+	telnet.msdp.values["MANA"] = []byte("5")
+
+	if len(state.GMCPSupports) != 1 || state.GMCPSupports["char"] != 1 {
+		t.Errorf("Saved GMCP supports changed with the connection's: %v", state.GMCPSupports)
+	}
+	if len(state.MSDPValues) != 1 || string(state.MSDPValues["HEALTH"]) != "10" {
+		t.Errorf("Saved MSDP values changed with the connection's: %q", state.MSDPValues)
+	}
+}
+
+func Test_ConnectionPoolConcurrency(t *testing.T) {
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	var received bytes.Buffer
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := strconv.Itoa(i)
+			ch, _ := newPoolConnection(t, pool, id, &received, &lock)
+			ch.SetAuthToken(id)
+			pool.BroadcastMessage("hello "+id, nil)
+			pool.Connections()
+
+			if i%2 == 0 {
+				_ = pool.CloseConnection(id)
+			} else {
+				pool.messages <- PoolMessage{TargetID: id, Type: "disconnected"}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	waitFor(t, "every connection to be removed", func() bool { return pool.Count() == 0 })
+}
+
+func Test_IdleSettingsFromConfig(t *testing.T) {
+	conf := &config.Config{}
+	conf.Server.LoginIdleTimeout = "10m"
+	conf.Server.GameIdleTimeout = "1h"
+	conf.Server.IdleWarning = "1m"
+	conf.Server.KeepaliveCommand = "AYT"
+
+	settings, err := IdleSettingsFromConfig(conf)
+	want := IdleSettings{LoginTimeout: 10 * time.Minute, GameTimeout: time.Hour, Warning: time.Minute, KeepaliveCommand: AYT}
+	if err != nil || settings != want {
+		t.Errorf("IdleSettingsFromConfig() == %+v, %v, want %+v", settings, err, want)
+	}
+
+	conf.Server.KeepaliveInterval = "often"
+	if _, err := IdleSettingsFromConfig(conf); err == nil {
+		t.Errorf("IdleSettingsFromConfig() accepted an invalid keepalive_interval")
+	}
+
+	settings, err = IdleSettingsFromConfig(&config.Config{})
+	if err != nil || settings.enabled() || settings.KeepaliveCommand != NOP {
+		t.Errorf("IdleSettingsFromConfig() of an empty config == %+v, %v", settings, err)
+	}
+}
+
+func Test_IdleTimeout(t *testing.T) {
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	var loginOutput, gameOutput bytes.Buffer
+	login, _ := newPoolConnection(t, pool, "login", &loginOutput, &lock)
+	game, _ := newPoolConnection(t, pool, "game", &gameOutput, &lock)
+	game.SetAuthToken("token")
+
+	idleFor := func(c *ConnectionHandler, d time.Duration) {
+		c.conn.inputLock.Lock()
+		c.conn.lastInput = time.Now().Add(-d)
+		c.conn.inputLock.Unlock()
+	}
+	output := func(buffer *bytes.Buffer) string {
+		lock.Lock()
+		defer lock.Unlock()
+		return buffer.String()
+	}
+
+	settings := IdleSettings{LoginTimeout: 10 * time.Minute, GameTimeout: time.Hour, Warning: time.Minute}
+	warned := map[string]bool{}
+
+	// Only the login menu limit has nearly run out, and the warning isn't repeated
+	idleFor(login, 9*time.Minute+30*time.Second)
+	idleFor(game, 9*time.Minute+30*time.Second)
+	pool.checkIdle(settings, warned)
+	pool.checkIdle(settings, warned)
+
+	want := "You will be disconnected for inactivity in 30 seconds."
+	waitFor(t, "the idle warning", func() bool { return strings.Contains(output(&loginOutput), want) })
+	if count := strings.Count(output(&loginOutput), want); count != 1 {
+		t.Errorf("Idle warning was sent %v times, want 1", count)
+	}
+	if output(&gameOutput) != "" {
+		t.Errorf("Logged in connection was warned: %q", output(&gameOutput))
+	}
+
+	// Doing something resets the warning
+	idleFor(login, 0)
+	pool.checkIdle(settings, warned)
+	if warned["login"] {
+		t.Errorf("Warning wasn't reset by activity")
+	}
+
+	idleFor(login, 11*time.Minute)
+	pool.checkIdle(settings, warned)
+	waitFor(t, "the idle connection to be closed", func() bool {
+		return strings.Contains(output(&loginOutput), "You have been idle for too long, goodbye.") &&
+			pool.Find("login") == nil
+	})
+
+	if _, err := login.conn.Write([]byte("still there?")); err == nil {
+		t.Errorf("Timed out connection wasn't closed")
+	}
+	if pool.Find("game") == nil {
+		t.Errorf("Logged in connection was timed out with the login menu limit")
+	}
+}
+
+func Test_Keepalive(t *testing.T) {
+	pool := NewConnectionPool()
+	go pool.Run()
+
+	var lock sync.Mutex
+	var aliveOutput, deadOutput bytes.Buffer
+	newPoolConnection(t, pool, "alive", &aliveOutput, &lock)
+	_, deadClient := newPoolConnection(t, pool, "dead", &deadOutput, &lock)
+	deadClient.Close()
+
+	pool.sendKeepalives(NOP)
+
+	waitFor(t, "the keepalive", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return compareData(aliveOutput.Bytes(), BuildCommand(NOP))
+	})
+	waitFor(t, "the dead connection to be removed", func() bool { return pool.Find("dead") == nil })
+
+	if pool.Find("alive") == nil {
+		t.Errorf("Live connection was removed")
+	}
+}
+
+func Test_WriteWithin(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	telnet := NewTelnet(server)
+
+	// Nothing reads from the client, every write is stuck. None may undo the
+	// deadline of another, or leave the plain write stuck for good.
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := telnet.Write([]byte("plain"))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- telnet.writeWithin(100*time.Millisecond, func() error {
+				_, err := telnet.Write([]byte("hello"))
+				return err
+			})
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Writes to a stuck client didn't give up")
+	}
+
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Write to a stuck client returned %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	}
+
+	// The deadline is gone afterwards
+	go io.ReadAll(client)
+	if _, err := telnet.Write([]byte("later")); err != nil {
+		t.Errorf("Write() after writeWithin failed: %v", err)
+	}
+}
+
+func Test_AccessControl(t *testing.T) {
+	conf := &config.Config{}
+	conf.Security.MaxConnectionsPerIP = 2
+	conf.Security.ConnectionsPerMinute = 3
+	conf.Security.Deny = []string{"10.0.0.0/8"}
+	conf.Security.StateFile = filepath.Join(t.TempDir(), "access.json")
+
+	access, err := NewAccessControl(conf)
+	if err != nil {
+		t.Fatalf("NewAccessControl() failed: %v", err)
+	}
+
+	if _, err := access.Admit("10.1.2.3:4000"); err != ErrAccessDenied {
+		t.Errorf("Admit() of a denied address == %v, want %v", err, ErrAccessDenied)
+	}
+
+	// Two at once, and three a minute
+	release1, err1 := access.Admit("192.168.0.1:4000")
+	_, err2 := access.Admit("192.168.0.1:4001")
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Admit() failed: %v, %v", err1, err2)
+	}
+	if _, err := access.Admit("192.168.0.1:4002"); err != ErrTooManyConnections {
+		t.Errorf("Admit() over the connection limit == %v, want %v", err, ErrTooManyConnections)
+	}
+	release1()
+	release1()
+	if _, err := access.Admit("192.168.0.1:4003"); err != ErrConnectingTooOften {
+		t.Errorf("Admit() over the rate limit == %v, want %v", err, ErrConnectingTooOften)
+	}
+	if _, err := access.Admit("192.168.0.2:4000"); err != nil {
+		t.Errorf("Admit() of another address failed: %v", err)
+	}
+
+	// Rules added at runtime
+	if err := access.Deny("192.168.0.3"); err != nil {
+		t.Errorf("Deny() failed: %v", err)
+	}
+	if err := access.Allow("172.16.0.0/12"); err != nil {
+		t.Errorf("Allow() failed: %v", err)
+	}
+	if err := access.Allow("nonsense"); err != ErrInvalidAddressOrCIDR {
+		t.Errorf("Allow() of nonsense == %v, want %v", err, ErrInvalidAddressOrCIDR)
+	}
+	if _, err := access.Admit("192.168.0.4:4000"); err != ErrAccessDenied {
+		t.Errorf("Admit() outside the allow list == %v, want %v", err, ErrAccessDenied)
+	}
+	if _, err := access.Admit("172.16.5.5:4000"); err != nil {
+		t.Errorf("Admit() inside the allow list failed: %v", err)
+	}
+	if err := access.RemoveRule("10.0.0.0/8"); err != ErrRuleInConfig {
+		t.Errorf("RemoveRule() of a config rule == %v, want %v", err, ErrRuleInConfig)
+	}
+	if err := access.RemoveRule("172.16.0.0/12"); err != nil {
+		t.Errorf("RemoveRule() failed: %v", err)
+	}
+
+	// Rules that can't be saved don't take effect
+	stateFile := access.stateFile
+	access.stateFile = filepath.Join(t.TempDir(), "missing", "access.json")
+	if err := access.Deny("192.168.0.7"); err == nil {
+		t.Errorf("Deny() with a state file that can't be saved didn't fail")
+	}
+	if err := access.RemoveRule("192.168.0.3"); err == nil {
+		t.Errorf("RemoveRule() with a state file that can't be saved didn't fail")
+	}
+	if access.Denied("192.168.0.7:4000") || !access.Denied("192.168.0.3:4000") {
+		t.Errorf("Rules changed although they couldn't be saved")
+	}
+	if _, deny := access.Rules(); len(deny) != 2 {
+		t.Errorf("Deny rules after failed saves == %v, want the config's and 192.168.0.3", deny)
+	}
+	access.stateFile = stateFile
+
+	// Failed logins back off exponentially
+	access.loginBackoff = time.Minute
+	access.LoginFailed("192.168.0.5:4000")
+	if delay := access.LoginDelay("192.168.0.5:5000"); delay <= 59*time.Second || delay > time.Minute {
+		t.Errorf("LoginDelay() after one failure == %v, want a minute", delay)
+	}
+	access.LoginFailed("192.168.0.5:4000")
+	access.LoginFailed("192.168.0.5:4000")
+	if delay := access.LoginDelay("192.168.0.5:4000"); delay <= 3*time.Minute || delay > 4*time.Minute {
+		t.Errorf("LoginDelay() after three failures == %v, want four minutes", delay)
+	}
+	access.LoginFailed("192.168.0.5:4000")
+	if delay := access.LoginDelay("192.168.0.5:4000"); delay > defaultMaxLoginBackoff {
+		t.Errorf("LoginDelay() == %v, more than the maximum %v", delay, defaultMaxLoginBackoff)
+	}
+
+	// Everything but open connections survives a restart
+	access.LoginFailed("192.168.0.6:4000")
+	access.LoginSucceeded("192.168.0.6:4000")
+
+	restarted, err := NewAccessControl(conf)
+	if err != nil {
+		t.Fatalf("NewAccessControl() with a state file failed: %v", err)
+	}
+	allow, deny := restarted.Rules()
+	if len(allow) != 0 || len(deny) != 2 || deny[0] != "10.0.0.0/8" || deny[1] != "192.168.0.3/32" {
+		t.Errorf("Rules() after a restart == %v, %v", allow, deny)
+	}
+	if restarted.LoginDelay("192.168.0.5:4000") == 0 {
+		t.Errorf("Failed logins were forgotten on restart")
+	}
+	if restarted.LoginDelay("192.168.0.6:4000") != 0 {
+		t.Errorf("A successful login didn't clear the failures")
+	}
+}
+
+func Test_AdminMenu(t *testing.T) {
+	conf := &config.Config{}
+	conf.Security.Admins = []string{"Admin"}
+	conf.Security.StateFile = filepath.Join(t.TempDir(), "access.json")
+
+	server := NewServer(conf)
+	server.access, _ = NewAccessControl(conf)
+	server.CreateConnectionPool()
+
+	var lock sync.Mutex
+	var adminOutput, playerOutput bytes.Buffer
+	admin, adminClient := newPoolConnection(t, server.pool, "admin", &adminOutput, &lock)
+	player, _ := newPoolConnection(t, server.pool, "player", &playerOutput, &lock)
+	admin.config, player.config = conf, conf
+	admin.SetAuthToken("admin:secret")
+	player.SetAuthToken("player:secret")
+
+	if player.Admin() || !admin.Admin() {
+		t.Errorf("Admin() == %v for the player and %v for the admin", player.Admin(), admin.Admin())
+	}
+	if _, err := server.Snoop(player, "admin"); err != ErrNotAdmin {
+		t.Errorf("Snoop() by a player == %v, want %v", err, ErrNotAdmin)
+	}
+	if _, err := server.Snoop(admin, "admin"); err != ErrSnoopSelf {
+		t.Errorf("Snoop() on yourself == %v, want %v", err, ErrSnoopSelf)
+	}
+
+	adminSaw := func(text string) func() bool {
+		return func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return strings.Contains(adminOutput.String(), text)
+		}
+	}
+	// Each line is sent once there is a new prompt for it
+	prompts := 0
+	countPrompts := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Count(adminOutput.String(), "> ") + strings.Count(adminOutput.String(), "range: ")
+	}
+	send := func(line string) {
+		waitFor(t, "a prompt", func() bool { return countPrompts() > prompts })
+		prompts = countPrompts()
+		adminClient.Write([]byte(line + "\r\n"))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.AdminMenu(admin)
+	}()
+
+	send("d")
+	send("10.1.0.0/16")
+	waitFor(t, "the deny rule", func() bool {
+		_, deny := server.access.Rules()
+		return len(deny) == 1 && deny[0] == "10.1.0.0/16"
+	})
+
+	// The player is the only one listed to snoop on
+	send("s")
+	waitFor(t, "the connection list", adminSaw("player from pipe"))
+	send("1")
+	waitFor(t, "the snoop to start", adminSaw("Snooping"))
+	utils.WriteLine(player.GetConn(), "You see a troll.", color.ModeNone)
+	waitFor(t, "the snooped line", adminSaw("You see a troll."))
+
+	adminClient.Write([]byte("x\r\n"))
+	waitFor(t, "the snoop to end", adminSaw("Snoop ended"))
+	utils.WriteLine(player.GetConn(), "The troll hits you.", color.ModeNone)
+
+	send("x")
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("AdminMenu() didn't return")
+	}
+	if adminSaw("The troll hits you.")() {
+		t.Errorf("The snoop carried on after it ended")
+	}
+
+	// Clients already connected from a denied range are disconnected
+	deniedConn, deniedClient := net.Pipe()
+	defer deniedClient.Close()
+	remote := &restoredConn{Conn: deniedConn, remote: copyoverAddr("10.1.2.3:4000")}
+	server.pool.AddToPool(&ConnectionHandler{id: "denied", config: conf, conn: newWrappedConnection(NewTelnet(remote)), pool: server.pool.messages})
+	if closed := server.disconnectDenied(admin); closed != 1 {
+		t.Errorf("disconnectDenied() closed %v connections, want 1", closed)
+	}
+	if _, err := deniedClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Denied client wasn't disconnected: %v", err)
+	}
+
+	// Nobody else gets the menu, it returns straight away
+	server.AdminMenu(player)
+}
+
+func Test_ListenRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer listener.Close()
+
+	conf := &config.Config{}
+	conf.Security.Deny = []string{"127.0.0.1"}
+
+	server := NewServer(conf)
+	server.listener = listener
+	server.CreateConnectionPool()
+	if server.access, err = NewAccessControl(conf); err != nil {
+		t.Fatalf("NewAccessControl() failed: %v", err)
+	}
+
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		t.Errorf("Denied client was handed to the runner")
+	}, conf)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, _ := io.ReadAll(conn)
+	if !strings.Contains(string(reply), ErrAccessDenied.Error()) {
+		t.Errorf("Denied client got %q", reply)
+	}
+}
+
+func Test_ProxyHeader(t *testing.T) {
+	v2 := func(command byte, family byte, addresses []byte) []byte {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family<<4|0x1, byte(len(addresses)>>8), byte(len(addresses)))
+		return append(header, addresses...)
+	}
+
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x10, 0x68}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x04, 0xd2, 0x10, 0x68)
+
+	tests := []struct {
+		header []byte
+		addr   string
+		err    error
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 4200\r\n"), "192.0.2.1:56324", nil},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 4200\r\n"), "[2001:db8::1]:1234", nil},
+		{[]byte("PROXY UNKNOWN\r\n"), "", nil},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 1 4200\r\n"), "", ErrInvalidProxyHeader},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 4200\r\n"), "", ErrInvalidProxyHeader},
+		{[]byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", ErrInvalidProxyHeader},
+		{[]byte("GET / HTTP/1.1\r\n"), "", ErrInvalidProxyHeader},
+		{v2(proxyV2Proxy, proxyV2Inet, ipv4), "192.0.2.1:56324", nil},
+		{v2(proxyV2Proxy, proxyV2Inet6, ipv6), "[2001:db8::1]:1234", nil},
+		{v2(proxyV2Proxy, proxyV2Inet, append(ipv4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:56324", nil},
+		{v2(proxyV2Local, 0, nil), "", nil},
+		{v2(proxyV2Proxy, proxyV2Inet, ipv4[:6]), "", ErrInvalidProxyHeader},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReader(bytes.NewReader(append(test.header, "look"...)))
+		addr, err := readProxyHeader(reader)
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr || err != test.err {
+			t.Errorf("readProxyHeader(%q) == %q, %v, want %q, %v", test.header, got, err, test.addr, test.err)
+			continue
+		}
+
+		if rest, _ := io.ReadAll(reader); err == nil && string(rest) != "look" {
+			t.Errorf("readProxyHeader(%q) left %q to read, want \"look\"", test.header, rest)
+		}
+	}
+
+	// A v1 header shorter than the v2 signature has to be read without waiting
+	// for the client to send anything more
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := readProxyHeader(bufio.NewReader(server))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("readProxyHeader(\"PROXY UNKNOWN\\r\\n\") from a waiting client == %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("readProxyHeader(\"PROXY UNKNOWN\\r\\n\") waited for more than the header")
+	}
+}
+
+func Test_ListenProxyProtocol(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 200 * time.Millisecond
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = "0"
+	conf.Server.ProxyProtocol = true
+	conf.Server.TrustedProxies = []string{"127.0.0.0/8"}
+
+	server := NewServer(conf)
+	if err := server.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	defer server.listener.Close()
+	server.CreateConnectionPool()
+
+	addrs := make(chan string, 1)
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		addrs <- c.GetConn().RemoteAddr().String()
+	}, conf)
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 4200\r\n"))
+
+	select {
+	case addr := <-addrs:
+		if addr != "192.0.2.1:56324" {
+			t.Errorf("Proxied client's RemoteAddr() == %v, want 192.0.2.1:56324", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Proxied client was never handed to the runner")
+	}
+
+	conf.Server.TrustedProxies = nil
+	if _, err := NewServer(conf).listen(listenerTelnet, "127.0.0.1:0"); err == nil {
+		t.Errorf("listen() with the PROXY protocol and no trusted proxies didn't fail")
+	}
+}
+
+func Test_ProxyListenerUntrusted(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	listener := newProxyListener(inner, []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}})
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 4200\r\n"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+	defer conn.Close()
+
+	if host := hostOf(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Untrusted client's RemoteAddr() == %v, want 127.0.0.1", host)
+	}
+	if err := proxyHeaderError(conn); err != nil {
+		t.Errorf("proxyHeaderError() of an untrusted client == %v", err)
+	}
+}
+
+type fakeSSHAuthenticator struct {
+	key       ssh.PublicKey
+	keyLogins atomic.Int32
+}
+
+func (a *fakeSSHAuthenticator) PasswordLogin(username string, password string) (string, error) {
+	if password != "hunter22" {
+		return "", errors.New("invalid password")
+	}
+	return username + ":password", nil
+}
+
+func (a *fakeSSHAuthenticator) PublicKeyRegistered(username string, key ssh.PublicKey) error {
+	if !bytes.Equal(key.Marshal(), a.key.Marshal()) {
+		return errors.New("invalid public key")
+	}
+	return nil
+}
+
+func (a *fakeSSHAuthenticator) PublicKeyLogin(username string, key ssh.PublicKey) (string, error) {
+	if err := a.PublicKeyRegistered(username, key); err != nil {
+		return "", err
+	}
+	a.keyLogins.Add(1)
+	return username + ":key", nil
+}
+
+// forgedSigner offers a registered public key without holding its private key
+type forgedSigner struct {
+	ssh.Signer
+	key ssh.PublicKey
+}
+
+func (s forgedSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+type sshSessionInfo struct {
+	conn  *ConnectionHandler
+	term  *Terminal
+	input string
+}
+
+func Test_SSH(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("ssh.NewSignerFromKey() failed: %v", err)
+	}
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = "0"
+	conf.Server.SSHPort = "0"
+	conf.Server.SSHHostKey = filepath.Join(t.TempDir(), "ssh_host_key")
+
+	server := NewServer(conf)
+	auth := &fakeSSHAuthenticator{key: signer.PublicKey()}
+	server.SetSSHAuthenticator(auth)
+	if err := server.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	defer server.listener.Close()
+	defer server.sshListener.Close()
+	server.CreateConnectionPool()
+
+	if _, err := os.Stat(conf.Server.SSHHostKey); err != nil {
+		t.Errorf("Host key wasn't generated: %v", err)
+	}
+
+	sessions := make(chan sshSessionInfo)
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		input := c.GetInput("> ")
+		sessions <- sshSessionInfo{conn: c, term: term, input: input}
+		c.GetInput("")
+	}, conf)
+
+	dial := func(auth ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.sshListener.Addr().String(), &ssh.ClientConfig{
+			User:            "player",
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	awaitSession := func() sshSessionInfo {
+		select {
+		case info := <-sessions:
+			return info
+		case <-time.After(5 * time.Second):
+			t.Fatalf("SSH session was never handed to the runner")
+		}
+		return sshSessionInfo{}
+	}
+
+	// Password login with a pty
+	client, err := dial(ssh.Password("hunter22"))
+	if err != nil {
+		t.Fatalf("Password login failed: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() failed: %v", err)
+	}
+	if err := session.RequestPty("xterm-256color", 30, 100, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty() failed: %v", err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	var output bytes.Buffer
+	var outputLock sync.Mutex
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, err := stdout.Read(buffer)
+			outputLock.Lock()
+			output.Write(buffer[:n])
+			outputLock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell() failed: %v", err)
+	}
+
+	stdin.Write([]byte("look\r"))
+	info := awaitSession()
+
+	if info.input != "look" {
+		t.Errorf("Input from a pty == %q, want %q", info.input, "look")
+	}
+	if token := info.conn.AuthToken(); token != "player:password" {
+		t.Errorf("AuthToken() after a password login == %q, want %q", token, "player:password")
+	}
+	if columns, rows := info.term.Size(); columns != 100 || rows != 30 {
+		t.Errorf("Terminal size == %vx%v, want 100x30", columns, rows)
+	}
+	if !info.term.VT100 || info.conn.GetConn().TerminalType() != "xterm-256color" {
+		t.Errorf("Terminal type == %q (VT100 %v), want xterm-256color", info.conn.GetConn().TerminalType(), info.term.VT100)
+	}
+	if depth := info.conn.GetConn().ColorDepth(); depth != color.Depth256 {
+		t.Errorf("ColorDepth() == %v, want %v", depth, color.Depth256)
+	}
+	waitFor(t, "the echoed input", func() bool {
+		outputLock.Lock()
+		defer outputLock.Unlock()
+		return strings.Contains(output.String(), "> look")
+	})
+	if strings.Contains(output.String(), "\xff") {
+		t.Errorf("Output to an SSH client contains telnet commands: %q", output.String())
+	}
+
+	if err := session.WindowChange(40, 120); err != nil {
+		t.Fatalf("WindowChange() failed: %v", err)
+	}
+	waitFor(t, "the window size to change", func() bool {
+		columns, rows := info.term.Size()
+		return columns == 120 && rows == 40
+	})
+	if width, height := info.conn.GetWindowSize(); width != 120 || height != 40 {
+		t.Errorf("GetWindowSize() after a window change == %vx%v, want 120x40", width, height)
+	}
+
+	info.conn.Close()
+	if err := session.Wait(); err != nil {
+		t.Errorf("Session didn't end cleanly when the server closed it: %v", err)
+	}
+
+	// Public key login without a pty is line based
+	client, err = dial(ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatalf("Public key login failed: %v", err)
+	}
+	defer client.Close()
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() failed: %v", err)
+	}
+	stdin, _ = session.StdinPipe()
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell() failed: %v", err)
+	}
+	stdin.Write([]byte("look\n"))
+	info = awaitSession()
+
+	if token := info.conn.AuthToken(); token != "player:key" {
+		t.Errorf("AuthToken() after a public key login == %q, want %q", token, "player:key")
+	}
+	if info.input != "look" || info.conn.GetConn().characterMode() || info.term.VT100 {
+		t.Errorf("Session without a pty: input %q, character mode %v, VT100 %v", info.input, info.conn.GetConn().characterMode(), info.term.VT100)
+	}
+	if columns, rows := info.term.Size(); columns != DefaultColumns || rows != DefaultRows {
+		t.Errorf("Terminal size without a pty == %vx%v, want the default", columns, rows)
+	}
+	info.conn.Close()
+
+	// There is nothing to exec
+	client, err = dial(ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatalf("Public key login failed: %v", err)
+	}
+	defer client.Close()
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() failed: %v", err)
+	}
+	if err := session.Run("ls"); err == nil {
+		t.Errorf("Exec request was accepted")
+	}
+
+	// Wrong passwords are refused and count as failed logins
+	if _, err := dial(ssh.Password("wrong")); err == nil {
+		t.Errorf("Login with the wrong password succeeded")
+	}
+	if delay := server.access.LoginDelay("127.0.0.1:1"); delay <= 0 {
+		t.Errorf("LoginDelay() after a failed SSH login == %v, want more than 0", delay)
+	}
+
+	// Only a client that proves it holds the key logs in with it
+	if logins := auth.keyLogins.Load(); logins != 2 {
+		t.Errorf("PublicKeyLogin() called %v times for 2 public key logins", logins)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewSignerFromKey(otherKey)
+	if _, err := dial(ssh.PublicKeys(forgedSigner{Signer: other, key: signer.PublicKey()})); err == nil {
+		t.Errorf("Login with a key the client doesn't hold succeeded")
+	}
+	if logins := auth.keyLogins.Load(); logins != 2 {
+		t.Errorf("PublicKeyLogin() called for a client that doesn't hold the key")
+	}
+}
+
+func Test_ShutdownSettingsFromConfig(t *testing.T) {
+	settings, err := ShutdownSettingsFromConfig(&config.Config{})
+	want := ShutdownSettings{Countdown: DefaultShutdownCountdown, Drain: DefaultShutdownDrain}
+	if err != nil || settings != want {
+		t.Errorf("ShutdownSettingsFromConfig() of an empty config == %+v, %v, want %+v", settings, err, want)
+	}
+
+	conf := &config.Config{}
+	conf.Server.ShutdownCountdown = "1m"
+	conf.Server.ShutdownDrain = "0s"
+	settings, err = ShutdownSettingsFromConfig(conf)
+	want = ShutdownSettings{Countdown: time.Minute}
+	if err != nil || settings != want {
+		t.Errorf("ShutdownSettingsFromConfig() == %+v, %v, want %+v", settings, err, want)
+	}
+
+	conf.Server.ShutdownDrain = "-1s"
+	if _, err := ShutdownSettingsFromConfig(conf); err == nil {
+		t.Errorf("ShutdownSettingsFromConfig() accepted a negative shutdown_drain")
+	}
+}
+
+// shutdownClient collects everything conn is sent until the server hangs up
+func shutdownClient(conn net.Conn) (received func() string, closed chan struct{}) {
+	var lock sync.Mutex
+	var buffer bytes.Buffer
+	closed = make(chan struct{})
+	go func() {
+		defer close(closed)
+		defer conn.Close()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			lock.Lock()
+			buffer.Write(buf[:n])
+			lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		return buffer.String()
+	}, closed
+}
+
+func Test_Shutdown(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	defer func(warnings []time.Duration) { ShutdownWarnings = warnings }(ShutdownWarnings)
+	NegotiationTimeout = 100 * time.Millisecond
+	ShutdownWarnings = []time.Duration{500 * time.Millisecond}
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+	conf.Server.ShutdownCountdown = "1s"
+	conf.Server.ShutdownDrain = "2s"
+
+	started := make(chan string, 2)
+	finished := make(chan string, 2)
+	runner := func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		defer func() { finished <- c.ID() }()
+		started <- c.ID()
+		for {
+			c.GetInput("> ")
+		}
+	}
+
+	server := NewServer(conf)
+	hooked := make(chan bool, 1)
+	server.OnShutdown(func(ctx context.Context) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("Shutdown hook's context has no deadline")
+		}
+		hooked <- true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.RunContext(ctx, runner, conf) }()
+
+	var conns []net.Conn
+	waitFor(t, "the server to listen", func() bool {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conns = append(conns, conn)
+		}
+		return err == nil
+	})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	conns = append(conns, conn)
+
+	var received []func() string
+	var closed []chan struct{}
+	for _, conn := range conns {
+		r, c := shutdownClient(conn)
+		received = append(received, r)
+		closed = append(closed, c)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Clients were never handed to the runner")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RunContext() after cancelling == %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("RunContext() never returned after cancelling")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-finished:
+		default:
+			t.Errorf("RunContext() returned before every runner had finished")
+		}
+		select {
+		case <-closed[i]:
+		case <-time.After(time.Second):
+			t.Errorf("Client %v wasn't disconnected", i)
+		}
+
+		output := received[i]()
+		for _, want := range []string{"shutting down in 1 second", "shutting down now, goodbye"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("Client %v received %q, want it to contain %q", i, output, want)
+			}
+		}
+	}
+
+	select {
+	case <-hooked:
+	default:
+		t.Errorf("Shutdown hook wasn't called")
+	}
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Errorf("Server still accepts connections after shutting down")
+	}
+	if err := server.Shutdown(context.Background()); err == nil {
+		t.Errorf("Second Shutdown() didn't fail")
+	}
+	if err := server.Copyover(); err == nil {
+		t.Errorf("Copyover() after shutting down didn't fail")
+	}
+}
+
+func Test_ShutdownDrainDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { NegotiationTimeout = timeout }(NegotiationTimeout)
+	NegotiationTimeout = 100 * time.Millisecond
+
+	conf := &config.Config{}
+	conf.Server.Interface = "127.0.0.1"
+	conf.Server.Port = "0"
+	conf.Server.ShutdownCountdown = "0s"
+	conf.Server.ShutdownDrain = "200ms"
+
+	server := NewServer(conf)
+	if err := server.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	server.CreateConnectionPool()
+
+	// A runner that doesn't notice its connection closing holds up the drain
+	stuck := make(chan struct{})
+	defer close(stuck)
+	started := make(chan bool, 1)
+	go server.Listen(func(c *ConnectionHandler, term *Terminal, conf *config.Config) {
+		started <- true
+		<-stuck
+	}, conf)
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	_, closed := shutdownClient(conn)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client was never handed to the runner")
+	}
+
+	begun := time.Now()
+	if err := server.Shutdown(context.Background()); err == nil {
+		t.Errorf("Shutdown() with a runner still running didn't fail")
+	}
+	if elapsed := time.Since(begun); elapsed > 2*time.Second {
+		t.Errorf("Shutdown() took %v, want about the 200ms drain", elapsed)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("Client wasn't disconnected")
+	}
+}
+
+func Test_ShutdownStalledClients(t *testing.T) {
+	// Neither the countdown's warnings nor the goodbyes wait on clients that
+	// don't read them for longer than they have to
+	for _, countdown := range []time.Duration{0, time.Second} {
+		conf := &config.Config{}
+		conf.Server.ShutdownCountdown = countdown.String()
+		conf.Server.ShutdownDrain = "200ms"
+
+		server := NewServer(conf)
+		settings, err := ShutdownSettingsFromConfig(conf)
+		if err != nil {
+			t.Fatalf("ShutdownSettingsFromConfig() failed: %v", err)
+		}
+		server.shutdown = settings
+		server.CreateConnectionPool()
+
+		var clients []net.Conn
+		for _, id := range []string{"stalled1", "stalled2"} {
+			conn, client := net.Pipe()
+			defer client.Close()
+			clients = append(clients, client)
+			server.pool.AddToPool(&ConnectionHandler{id: id, config: conf, conn: newWrappedConnection(NewTelnet(conn)), pool: server.pool.messages})
+		}
+
+		done := make(chan error, 1)
+		begun := time.Now()
+		go func() { done <- server.Shutdown(context.Background()) }()
+
+		select {
+		case <-done:
+			if elapsed := time.Since(begun); elapsed > countdown+time.Second {
+				t.Errorf("Shutdown() with a %v countdown took %v with stalled clients", countdown, elapsed)
+			}
+		case <-time.After(countdown + 5*time.Second):
+			t.Fatalf("Shutdown() with a %v countdown never returned with stalled clients", countdown)
+		}
+
+		for i, client := range clients {
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("Stalled client %v wasn't disconnected: %v", i, err)
+			}
+		}
+	}
+}
@@ -5,52 +5,93 @@ import (
 	"github.com/yamamushi/kmud-2020/utils"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Terminal struct {
 	telnet  *Telnet
+	lock    sync.RWMutex
 	Type    string
 	Columns string
 	ColI    int
 	Rows    string
 	RowI    int
 	VT100   bool
+
+	// Capabilities is what the client reported about itself over MTTS
+	Capabilities Capabilities
 }
 
+// Sizes assumed for clients that don't report their window size
+const (
+	DefaultColumns = 80
+	DefaultRows    = 24
+)
+
 func GetTermInfo(telnet *Telnet) (*Terminal, error) {
 	terminal := &Terminal{}
 	return ResetSettings(telnet, terminal)
 }
 
+// ResetSettings asks the client for its terminal type and window size. Clients
+// that refuse or don't answer in time get an unknown terminal type and the
+// default size, an error is only returned if the connection itself failed.
 func ResetSettings(telnet *Telnet, t *Terminal) (*Terminal, error) {
 	termtype, err := telnet.DoTerminalType()
-	if err != nil {
+	if err != nil && !negotiationFailed(err) {
 		utils.Error("server Read IAC error: " + err.Error())
 		return nil, err
 	}
-	var vt100 bool
-	if strings.Contains(termtype, "xterm") {
-		vt100 = true
-	}
+	caps := telnet.Capabilities()
+	vt100 := caps.VT100 || caps.ANSI || strings.Contains(termtype, "xterm")
 	//log.Println(termtype)
 
 	x, y, err := telnet.DoWindowSize()
 	if err != nil {
-		utils.Error("server Read IAC error: " + err.Error())
-		return nil, err
+		if !negotiationFailed(err) {
+			utils.Error("server Read IAC error: " + err.Error())
+			return nil, err
+		}
+		x, y = DefaultColumns, DefaultRows
 	}
 	//log.Println(x, y)
+	if t.telnet != telnet {
+		// Keep the size current as the client resizes its window
+		telnet.OnWindowSize(t.setSize)
+	}
 	t.telnet = telnet
 	t.Type = termtype
-	t.Columns = strconv.Itoa(x)
-	t.ColI = x
-	t.Rows = strconv.Itoa(y)
-	t.RowI = y
 	t.VT100 = vt100
+	t.Capabilities = caps
+	t.setSize(x, y)
 	return t, nil
 }
 
+// negotiationFailed returns true if err means the client just didn't go along
+// with a negotiation, as opposed to the connection having failed
+func negotiationFailed(err error) bool {
+	return err == ErrNegotiationTimeout || err == ErrNegotiationRefused
+}
+
+func (t *Terminal) setSize(columns int, rows int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.Columns = strconv.Itoa(columns)
+	t.ColI = columns
+	t.Rows = strconv.Itoa(rows)
+	t.RowI = rows
+}
+
+// Size returns the current number of columns and rows of the client's window
+func (t *Terminal) Size() (int, int) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.ColI, t.RowI
+}
+
 // VT100 Escape Sequences
 // http://ascii-table.com/ansi-escape-sequences-vt-100.php
 
@@ -164,15 +205,21 @@ func (t *Terminal) ClearLine() {
 
 func (t *Terminal) Refresh() {
 	if t.VT100 {
+		_, rows := t.Size()
 		_, _ = t.telnet.Write([]byte("\u001B8"))
-		for row := 0; row <= t.RowI; row++ {
+		for row := 0; row <= rows; row++ {
 			_, _ = t.telnet.Write([]byte("\u001B[" + strconv.Itoa(row) + ";0H"))
 			_, _ = t.telnet.Write([]byte("\u001B[2K"))
 		}
 	}
 }
 
+// Nyan plays the nyan cat animation, except for clients with screen readers
 func (t *Terminal) Nyan() {
+	if t.Capabilities.ScreenReader {
+		return
+	}
+
 	if t.VT100 {
 		for {
 			var wait time.Duration
@@ -64,6 +64,8 @@ func CodeToString(code TelnetCode) string {
 		return "LM"
 	case EV:
 		return "EV"
+	case CHARSET:
+		return "CHARSET"
 	case SE:
 		return "SE"
 	case NOP:
@@ -106,6 +108,12 @@ func CodeToString(code TelnetCode) string {
 		return "ATCP"
 	case GMCP:
 		return "GMCP"
+	case MSDP:
+		return "MSDP"
+	case MSSP:
+		return "MSSP"
+	case MXP:
+		return "MXP"
 	}
 
 	return ""
@@ -0,0 +1,287 @@
+package telnet
+
+/*
+WebSocket gateway, so that browser clients can connect without a telnet client.
+
+Two subprotocols are offered:
+
+	telnet - every message carries raw telnet bytes in both directions,
+	         negotiation works as it does on the telnet port
+	text   - messages are plain text, each one a line of input, telnet
+	         commands are stripped from the output and the terminal
+	         settings are left at the defaults
+
+Clients that don't ask for a subprotocol get text.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+const (
+	webSocketTelnet = "telnet"
+	webSocketText   = "text"
+)
+
+var webSocketUpgrader = websocket.Upgrader{
+	Subprotocols: []string{webSocketTelnet, webSocketText},
+	// Web clients may be hosted anywhere, and nothing is authenticated by cookie
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// serveWebSocket serves the WebSocket gateway on its listener until it is
+// closed, over TLS if a certificate is configured
+func (s *Server) serveWebSocket(runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	path := s.config.Server.WebSocketPath
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		s.handleWebSocket(w, r, runner, conf)
+	})
+
+	server := &http.Server{Handler: mux}
+
+	var err error
+	if s.config.Server.TLSCert != "" && s.config.Server.TLSKey != "" {
+		err = server.ServeTLS(s.webSocketListener, s.config.Server.TLSCert, s.config.Server.TLSKey)
+	} else {
+		err = server.Serve(s.webSocketListener)
+	}
+
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		utils.HandleError(err)
+	}
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, runner func(c *ConnectionHandler, term *Terminal, conf *config.Config), conf *config.Config) {
+	release, err := s.access.Admit(r.RemoteAddr)
+	if err != nil {
+		log.Println("Refused WebSocket client:", r.RemoteAddr, "-", err)
+		status := http.StatusTooManyRequests
+		if err == ErrAccessDenied {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ws, err := webSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error
+		release()
+		return
+	}
+
+	log.Println("WebSocket client connected:", ws.RemoteAddr())
+
+	telnet := ws.Subprotocol() == webSocketTelnet
+	s.handleConnection(newWebSocketConn(ws, !telnet), release, telnet, runner, conf)
+}
+
+// webSocketConn adapts a WebSocket to a net.Conn so that it can be wrapped by
+// Telnet like any other connection. Messages are read by a separate goroutine
+// so that read deadlines can expire without breaking the socket, which the
+// websocket package doesn't allow.
+type webSocketConn struct {
+	ws   *websocket.Conn
+	text bool
+
+	incoming chan []byte
+	closed   chan struct{}
+	pending  []byte
+
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWebSocketConn(ws *websocket.Conn, text bool) *webSocketConn {
+	c := &webSocketConn{
+		ws:       ws,
+		text:     text,
+		incoming: make(chan []byte),
+		closed:   make(chan struct{}),
+	}
+
+	go c.readMessages()
+	return c
+}
+
+func (c *webSocketConn) readMessages() {
+	defer close(c.incoming)
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if c.text && !bytes.HasSuffix(data, []byte("\n")) {
+			data = append(data, '\n')
+		}
+
+		select {
+		case c.incoming <- data:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case data, ok := <-c.incoming:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.pending = data
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	messageType := websocket.BinaryMessage
+	data := p
+	if c.text {
+		messageType = websocket.TextMessage
+		data = stripTelnetCommands(p)
+		if len(data) == 0 {
+			return len(p), nil
+		}
+	}
+
+	c.deadlineLock.Lock()
+	deadline := c.writeDeadline
+	c.deadlineLock.Unlock()
+	_ = c.ws.SetWriteDeadline(deadline)
+
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes, the WebSocket is only given
+// it by Write since it doesn't expect it to change mid write. The connection
+// underneath gets it straight away, for any write that is already stuck.
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.writeDeadline = t
+	return c.ws.UnderlyingConn().SetWriteDeadline(t)
+}
+
+// stripTelnetCommands removes telnet commands and subnegotiations from output
+// meant for text clients. Commands are always written whole, so a single
+// write never ends partway through one.
+func stripTelnetCommands(p []byte) []byte {
+	iac := codeToByte[IAC]
+	sb := codeToByte[SB]
+	se := codeToByte[SE]
+
+	var text []byte
+	for i := 0; i < len(p); i++ {
+		if p[i] != iac {
+			text = append(text, p[i])
+			continue
+		}
+
+		if i+1 >= len(p) {
+			break
+		}
+
+		code := byteToCode[p[i+1]]
+		switch {
+		case p[i+1] == iac:
+			text = append(text, iac)
+			i++
+		case p[i+1] == sb:
+			// Skip ahead to IAC SE, passing over any escaped IACs
+			for i += 2; i+1 < len(p); i++ {
+				if p[i] == iac {
+					i++
+					if p[i] == se {
+						break
+					}
+				}
+			}
+		case code == WILL || code == WONT || code == DO || code == DONT:
+			i += 2
+		default:
+			i++
+		}
+	}
+
+	return text
+}
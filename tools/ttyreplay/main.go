@@ -0,0 +1,49 @@
+package main
+
+// ttyreplay plays a session recorded with /record back to the terminal at the
+// speed it was recorded
+//
+//	ttyreplay [-speed 2] [-maxdelay 5s] recording.ttyrec
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/utils"
+)
+
+func main() {
+	speed := flag.Float64("speed", 1, "playback speed, 2 plays twice as fast")
+	maxDelay := flag.Duration("maxdelay", 0, "longest pause between frames, 0 for no limit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: ttyreplay [flags] recording.ttyrec")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *speed <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		utils.HandleError(err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	sleep := func(d time.Duration) {
+		if *maxDelay > 0 && d > *maxDelay {
+			d = *maxDelay
+		}
+		time.Sleep(d)
+	}
+
+	if err = utils.ReplayTtyrec(file, os.Stdout, *speed, sleep); err != nil {
+		utils.HandleError(err)
+		os.Exit(1)
+	}
+}
@@ -4,6 +4,7 @@ type AuthRequest struct {
 	Secret     string `json:"secret"`
 	Username   string `json:"username"`
 	HashedPass string `json:"hashedpass"`
+	PublicKey  string `json:"publickey,omitempty"` // Checked instead of the password if set
 }
 
 type AuthResponse struct {
@@ -11,6 +12,17 @@ type AuthResponse struct {
 	Err       string `json:"error,omitempty"` // errors don't JSON-marshal, so we use a string
 }
 
+// PublicKeyRequest is sent to /haskey
+type PublicKeyRequest struct {
+	Secret    string `json:"secret"`
+	Username  string `json:"username"`
+	PublicKey string `json:"publickey"`
+}
+
+type PublicKeyResponse struct {
+	Err string `json:"error,omitempty"` // errors don't JSON-marshal, so we use a string
+}
+
 type AccountInfoRequest struct {
 	Secret string `json:"secret"`
 	Token  string `json:"token"`
@@ -54,3 +66,13 @@ type ModifyResponse struct {
 	Account Account `json:"account"`
 	Err     string  `json:"error,omitempty"` // errors don't JSON-marshal, so we use a string
 }
+
+// TokenRequest is sent to /refresh, /logout and /logout-all
+type TokenRequest struct {
+	Secret string `json:"secret"`
+	Token  string `json:"token"`
+}
+
+type LogoutResponse struct {
+	Err string `json:"error,omitempty"` // errors don't JSON-marshal, so we use a string
+}
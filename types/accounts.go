@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type Account struct {
 	Username             string   `json:"username,omitempty"`
 	Email                string   `json:"email,omitempty"`
@@ -8,6 +10,18 @@ type Account struct {
 	Permissions          []string `json:"permissions,omitempty"`
 	Characters           []string `json:"characters,omitempty"`
 	Locked               string   `json:"locked,omitempty"`
-	Token                string   `json:"token,omitempty"`
+	Token                string   `json:"token,omitempty"` // No longer stored, see Session
 	RequirePasswordReset string   `json:"requirepasswordreset,omitempty"`
+	PublicKeys           []string `json:"publickeys,omitempty"` // SSH keys, in authorized_keys format
+}
+
+// Session is one login to an account. Only the hash of its token is stored,
+// the token itself is given to the client.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	TokenHash string    `json:"tokenhash"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastused"`
+	Expires   time.Time `json:"expires"`
 }
@@ -0,0 +1,41 @@
+package types
+
+// GMCPMessage is a typed GMCP package that knows its own package name
+type GMCPMessage interface {
+	Package() string
+}
+
+// GMCPCharVitals is sent as Char.Vitals
+type GMCPCharVitals struct {
+	HP    int `json:"hp"`
+	MaxHP int `json:"maxhp"`
+}
+
+func (GMCPCharVitals) Package() string {
+	return "Char.Vitals"
+}
+
+// GMCPRoomInfo is sent as Room.Info, Exits maps a direction to the id of the room it leads to
+type GMCPRoomInfo struct {
+	Num         string            `json:"num"`
+	Name        string            `json:"name"`
+	Area        string            `json:"area,omitempty"`
+	Zone        string            `json:"zone,omitempty"`
+	Coordinates []int             `json:"coords"`
+	Exits       map[string]string `json:"exits"`
+}
+
+func (GMCPRoomInfo) Package() string {
+	return "Room.Info"
+}
+
+// GMCPCommChannel is sent as Comm.Channel
+type GMCPCommChannel struct {
+	Channel string `json:"chan"`
+	Message string `json:"msg"`
+	Player  string `json:"player,omitempty"`
+}
+
+func (GMCPCommChannel) Package() string {
+	return "Comm.Channel"
+}
@@ -171,6 +171,16 @@ type Communicable interface {
 	GetWindowSize() (int, int)
 }
 
+// ScreenReaderMode is whether a user is sent output suited to screen readers,
+// ScreenReaderAuto goes by what the client reports
+type ScreenReaderMode int
+
+const (
+	ScreenReaderAuto ScreenReaderMode = iota
+	ScreenReaderOn   ScreenReaderMode = iota
+	ScreenReaderOff  ScreenReaderMode = iota
+)
+
 type User interface {
 	Object
 	Nameable
@@ -184,6 +194,10 @@ type User interface {
 	GetTerminalType() string
 	GetColorMode() color.ColorMode
 	SetColorMode(color.ColorMode)
+	GetColorDepth() color.ColorDepth
+	SetColorDepth(color.ColorDepth)
+	GetScreenReaderMode() ScreenReaderMode
+	SetScreenReaderMode(ScreenReaderMode)
 	IsAdmin() bool
 	SetAdmin(bool)
 }
@@ -8,7 +8,6 @@ import (
 	"github.com/yamamushi/kmud-2020/types"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"strings"
 )
 
 func BsonMapToAccount(input bson.D) (account types.Account) {
@@ -48,6 +47,12 @@ func BsonMapToAccount(input bson.D) (account types.Account) {
 			account.Characters = append(account.Characters, fmt.Sprintf("%v", character))
 		}
 	}
+	if input.Map()["publickeys"] != nil {
+		keys := input.Map()["publickeys"].(primitive.A)
+		for _, key := range keys {
+			account.PublicKeys = append(account.PublicKeys, fmt.Sprintf("%v", key))
+		}
+	}
 	return account
 }
 
@@ -93,6 +98,13 @@ func AccountToBson(input types.Account) (output bson.M) {
 		}
 		output["groups"] = groups
 	}
+	if len(input.PublicKeys) > 0 {
+		keys := primitive.A{}
+		for _, key := range input.PublicKeys {
+			keys = append(keys, key)
+		}
+		output["publickeys"] = keys
+	}
 	return output
 }
 
@@ -102,21 +114,18 @@ func ValidateRequest(secret string, token string, inputgroup string, inputpermis
 		return types.Account{}, errors.New("unauthorized request")
 	}
 
-	tokenFields := strings.Split(token, ":")
-	if len(tokenFields) != 2 {
-		return types.Account{}, errors.New("invalid token format")
+	session, err := ValidateToken(token, conf, DB)
+	if err != nil {
+		return types.Account{}, err
 	}
 
-	result, err := DB.FindOne(bson.M{"username": tokenFields[0]}, conf.DB.MongoDB, "accounts")
+	result, err := DB.FindOne(bson.M{"username": session.Username}, conf.DB.MongoDB, "accounts")
 	if err != nil {
 		output := BsonMapToAccount(result)
 		return output, errors.New("unauthorized request")
 	}
 
 	accountStruct := BsonMapToAccount(result)
-	if accountStruct.Token != tokenFields[1] {
-		return types.Account{}, errors.New("unauthorized request")
-	}
 
 	err = CheckAccountAccess(inputgroup, inputpermission, accountStruct)
 	if err != nil {
@@ -0,0 +1,398 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const maxHistory = 100
+
+// LineEditor edits lines for clients in character mode, where every key press
+// is sent as it is typed and the server does the echoing. It supports the
+// cursor keys, home/end, backspace/delete, a history on up/down and tab
+// completion. Reading from it returns one finished line at a time, so it can
+// stand in for a line buffered connection.
+type LineEditor struct {
+	rw     io.ReadWriter
+	reader *bufio.Reader
+
+	lock      sync.Mutex
+	echo      bool
+	completer func(line string) []string
+	history   []string
+	lastLine  []byte
+
+	pending []byte
+	lastCR  bool
+}
+
+func NewLineEditor(rw io.ReadWriter) *LineEditor {
+	var editor LineEditor
+	editor.rw = rw
+	editor.reader = bufio.NewReader(rw)
+	editor.echo = true
+	return &editor
+}
+
+// SetEcho turns echoing of typed characters on or off, it is turned off while
+// passwords are typed. Lines typed without echo aren't kept in the history.
+func (e *LineEditor) SetEcho(echo bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.echo = echo
+}
+
+// SetCompleter sets the function that returns the possible completions of the
+// last word of the given line when tab is pressed
+func (e *LineEditor) SetCompleter(completer func(line string) []string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.completer = completer
+}
+
+// History returns the lines entered so far, oldest first
+func (e *LineEditor) History() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]string{}, e.history...)
+}
+
+// Write writes p to the connection, remembering the last partial line written
+// (usually the prompt) so that it can be redrawn
+func (e *LineEditor) Write(p []byte) (int, error) {
+	e.lock.Lock()
+	if index := strings.LastIndexAny(string(p), "\r\n"); index != -1 {
+		e.lastLine = append([]byte{}, p[index+1:]...)
+	} else {
+		e.lastLine = append(e.lastLine, p...)
+	}
+	e.lock.Unlock()
+
+	return e.rw.Write(p)
+}
+
+func (e *LineEditor) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 {
+		line, err := e.readLine()
+		if err != nil {
+			return 0, err
+		}
+		e.pending = []byte(line + "\n")
+	}
+
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// lineState is the line being edited
+type lineState struct {
+	line         []rune
+	cursor       int
+	historyIndex int
+	saved        []rune
+}
+
+func (e *LineEditor) readLine() (string, error) {
+	e.lock.Lock()
+	state := lineState{historyIndex: len(e.history)}
+	e.lock.Unlock()
+
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		// Clients send CR LF or CR NUL for enter, only the CR counts
+		if e.lastCR && (r == '\n' || r == 0) {
+			e.lastCR = false
+			continue
+		}
+		e.lastCR = r == '\r'
+
+		switch r {
+		case '\r', '\n':
+			return e.finishLine(&state), nil
+		case 127, '\b':
+			e.backspace(&state)
+		case 1: // ^A
+			e.moveTo(&state, 0)
+		case 5: // ^E
+			e.moveTo(&state, len(state.line))
+		case '\t':
+			e.complete(&state)
+		case 27:
+			e.escape(&state)
+		default:
+			if unicode.IsPrint(r) {
+				e.insert(&state, r)
+			}
+		}
+	}
+}
+
+func (e *LineEditor) finishLine(state *lineState) string {
+	line := string(state.line)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.echo {
+		e.output("\r\n")
+
+		if strings.TrimSpace(line) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+			e.history = append(e.history, line)
+			if len(e.history) > maxHistory {
+				e.history = e.history[1:]
+			}
+		}
+	}
+	e.lastLine = nil
+
+	return line
+}
+
+// escape handles the ANSI sequences sent for the cursor keys, both the
+// ESC [ x and ESC O x forms, and the ESC [ n ~ forms used for home, end and
+// delete by some terminals
+func (e *LineEditor) escape(state *lineState) {
+	r, _, err := e.reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+
+	r, _, err = e.reader.ReadRune()
+	if err != nil {
+		return
+	}
+
+	if unicode.IsDigit(r) {
+		number := string(r)
+		for {
+			r, _, err = e.reader.ReadRune()
+			if err != nil || !unicode.IsDigit(r) {
+				break
+			}
+			number += string(r)
+		}
+
+		if r != '~' {
+			return
+		}
+
+		switch number {
+		case "1", "7":
+			r = 'H'
+		case "4", "8":
+			r = 'F'
+		case "3":
+			e.delete(state)
+			return
+		default:
+			return
+		}
+	}
+
+	switch r {
+	case 'A':
+		e.historyMove(state, -1)
+	case 'B':
+		e.historyMove(state, 1)
+	case 'C':
+		e.moveTo(state, state.cursor+1)
+	case 'D':
+		e.moveTo(state, state.cursor-1)
+	case 'H':
+		e.moveTo(state, 0)
+	case 'F':
+		e.moveTo(state, len(state.line))
+	}
+}
+
+func (e *LineEditor) insert(state *lineState, r rune) {
+	line := append([]rune{}, state.line[:state.cursor]...)
+	line = append(line, r)
+	state.line = append(line, state.line[state.cursor:]...)
+	state.cursor++
+
+	tail := state.line[state.cursor:]
+	e.echoText(string(r) + string(tail) + cursorLeft(runesWidth(tail)))
+}
+
+func (e *LineEditor) backspace(state *lineState) {
+	if state.cursor == 0 {
+		return
+	}
+
+	e.moveTo(state, state.cursor-1)
+	e.delete(state)
+}
+
+func (e *LineEditor) delete(state *lineState) {
+	if state.cursor >= len(state.line) {
+		return
+	}
+
+	removed := RuneWidth(state.line[state.cursor])
+	state.line = append(state.line[:state.cursor], state.line[state.cursor+1:]...)
+
+	tail := state.line[state.cursor:]
+	e.echoText(string(tail) + strings.Repeat(" ", removed) + cursorLeft(runesWidth(tail)+removed))
+}
+
+func (e *LineEditor) moveTo(state *lineState, cursor int) {
+	if cursor < 0 || cursor > len(state.line) || cursor == state.cursor {
+		return
+	}
+
+	if cursor < state.cursor {
+		e.echoText(cursorLeft(runesWidth(state.line[cursor:state.cursor])))
+	} else {
+		e.echoText(cursorRight(runesWidth(state.line[state.cursor:cursor])))
+	}
+	state.cursor = cursor
+}
+
+// replace swaps the whole line for another, leaving the cursor at its end
+func (e *LineEditor) replace(state *lineState, line []rune) {
+	e.echoText(cursorLeft(runesWidth(state.line[:state.cursor])) + "\x1b[K" + string(line))
+	state.line = append([]rune{}, line...)
+	state.cursor = len(state.line)
+}
+
+func (e *LineEditor) historyMove(state *lineState, offset int) {
+	e.lock.Lock()
+	history := e.history
+	e.lock.Unlock()
+
+	index := state.historyIndex + offset
+	if index < 0 || index > len(history) {
+		return
+	}
+
+	if state.historyIndex == len(history) {
+		state.saved = state.line
+	}
+	state.historyIndex = index
+
+	if index == len(history) {
+		e.replace(state, state.saved)
+	} else {
+		e.replace(state, []rune(history[index]))
+	}
+}
+
+func (e *LineEditor) complete(state *lineState) {
+	e.lock.Lock()
+	completer := e.completer
+	e.lock.Unlock()
+
+	if completer == nil {
+		return
+	}
+
+	before := string(state.line[:state.cursor])
+	word := before[strings.LastIndex(before, " ")+1:]
+
+	var matches []string
+	for _, candidate := range completer(before) {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(word)) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	if len(matches) == 0 {
+		return
+	}
+
+	completion := commonPrefix(matches)
+	if len(matches) == 1 {
+		completion += " "
+	}
+
+	if len([]rune(completion)) > len([]rune(word)) {
+		if !strings.HasPrefix(completion, word) {
+			// The case differs, retype the word the way the completion has it
+			for range []rune(word) {
+				e.backspace(state)
+			}
+			word = ""
+		}
+
+		for _, r := range []rune(completion)[len([]rune(word)):] {
+			e.insert(state, r)
+		}
+		return
+	}
+
+	// Nothing more to fill in, list the possibilities and redraw the line
+	sort.Strings(matches)
+
+	e.lock.Lock()
+	prompt := string(e.lastLine)
+	e.lock.Unlock()
+
+	tail := state.line[state.cursor:]
+	e.echoText(fmt.Sprintf("\r\n%s\r\n%s%s%s", strings.Join(matches, "  "), prompt, string(state.line), cursorLeft(runesWidth(tail))))
+}
+
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(word)
+		i := 0
+		for i < len(prefix) && i < len(runes) && unicode.ToLower(prefix[i]) == unicode.ToLower(runes[i]) {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return string(prefix)
+}
+
+// echoText writes text to the client if echo is on
+func (e *LineEditor) echoText(text string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.echo {
+		e.output(text)
+	}
+}
+
+func (e *LineEditor) output(text string) {
+	if text != "" {
+		_, _ = e.rw.Write([]byte(text))
+	}
+}
+
+// runesWidth returns the number of columns the runes take up on a terminal
+func runesWidth(runes []rune) int {
+	total := 0
+	for _, r := range runes {
+		total += RuneWidth(r)
+	}
+	return total
+}
+
+func cursorLeft(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("\x1b[%dD", n)
+}
+
+func cursorRight(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("\x1b[%dC", n)
+}
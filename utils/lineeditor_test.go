@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type editorConn struct {
+	*strings.Reader
+	bytes.Buffer
+}
+
+func (c *editorConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func (c *editorConn) Write(p []byte) (int, error) {
+	return c.Buffer.Write(p)
+}
+
+func readLines(editor *LineEditor) []string {
+	var lines []string
+	scanner := bufio.NewScanner(editor)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func Test_LineEditor(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"look\r\n", []string{"look"}},
+		{"look\r\x00get\r\x00", []string{"look", "get"}},
+		{"lok\x7f\x7fook\n", []string{"look"}},
+		{"ok\x1b[D\x1b[Dlo\r", []string{"look"}},
+		{"ook\x1b[Hl\x1b[Fs\r", []string{"looks"}},
+		{"ook\x01l\x05s\r", []string{"looks"}},
+		{"lxook\x1b[1~\x1b[C\x1b[3~\r", []string{"look"}},
+		{"\x1b[Dx\x1b[C\x1b[C\r", []string{"x"}},
+		{"héllo\x7f\x7fo\r", []string{"hélo"}},
+		{"look\rget\r\x1b[A\x1b[A\r", []string{"look", "get", "look"}},
+		{"look\rge\x1b[A\x1b[B\r", []string{"look", "ge"}},
+	}
+
+	for _, test := range tests {
+		editor := NewLineEditor(&editorConn{Reader: strings.NewReader(test.input)})
+		got := readLines(editor)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("LineEditor(%q) == %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func Test_LineEditorEcho(t *testing.T) {
+	conn := &editorConn{Reader: strings.NewReader("ab\x1b[Dc\x7f\r")}
+	editor := NewLineEditor(conn)
+	readLines(editor)
+
+	want := "a" + "b" + "\x1b[1D" + "cb\x1b[1D" + "\x1b[1D" + "b \x1b[2D" + "\r\n"
+	if conn.String() != want {
+		t.Errorf("LineEditor echoed %q, want %q", conn.String(), want)
+	}
+
+	conn = &editorConn{Reader: strings.NewReader("secret\r")}
+	editor = NewLineEditor(conn)
+	editor.SetEcho(false)
+	lines := readLines(editor)
+
+	if len(lines) != 1 || lines[0] != "secret" {
+		t.Errorf("LineEditor without echo read %q, want [secret]", lines)
+	}
+	if conn.Buffer.Len() != 0 {
+		t.Errorf("LineEditor without echo echoed %q", conn.String())
+	}
+	if len(editor.History()) != 0 {
+		t.Errorf("LineEditor without echo kept %q in its history", editor.History())
+	}
+}
+
+func Test_LineEditorCompletion(t *testing.T) {
+	completer := func(line string) []string {
+		if strings.Contains(line, " ") {
+			return []string{"sword", "shield", "Bob"}
+		}
+		return []string{"look", "get", "go"}
+	}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"lo\t\r", "look "},
+		{"get sw\t\r", "get sword "},
+		{"get b\t\r", "get Bob "},
+		{"get s\thi\t\r", "get shield "},
+		{"x\t\r", "x"},
+	}
+
+	for _, test := range tests {
+		editor := NewLineEditor(&editorConn{Reader: strings.NewReader(test.input)})
+		editor.SetCompleter(completer)
+		got := readLines(editor)
+		if len(got) != 1 || got[0] != test.want {
+			t.Errorf("LineEditor(%q) == %q, want [%q]", test.input, got, test.want)
+		}
+	}
+
+	// Ambiguous completions are listed, followed by the prompt and the line
+	conn := &editorConn{Reader: strings.NewReader("g\t\r")}
+	editor := NewLineEditor(conn)
+	editor.SetCompleter(completer)
+	_, _ = editor.Write([]byte("Welcome\r\n> "))
+	readLines(editor)
+
+	want := "Welcome\r\n> " + "g" + "\r\nget  go\r\n> g" + "\r\n"
+	if conn.String() != want {
+		t.Errorf("LineEditor listed %q, want %q", conn.String(), want)
+	}
+}
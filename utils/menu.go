@@ -150,7 +150,17 @@ func filterActions(actions []action, filter string) []action {
 	return filtered
 }
 
+// screenReaderUser is implemented by whoever a menu is shown to if they can
+// tell whether the user has a screen reader
+type screenReaderUser interface {
+	ScreenReader() bool
+}
+
 func (m *Menu) Print(comm types.Communicable, page int, filter string) int {
+	if user, ok := comm.(screenReaderUser); ok && user.ScreenReader() {
+		return m.printSentences(comm, filter)
+	}
+
 	border := color.Colorize(color.White, decorator)
 	title := color.Colorize(color.Blue, m.title)
 	header := fmt.Sprintf("%s %s %s", border, title, border)
@@ -203,3 +213,27 @@ func (m *Menu) Print(comm types.Communicable, page int, filter string) int {
 
 	return len(pages)
 }
+
+// printSentences prints the menu as a list of sentences for screen readers,
+// each saying what to type for the item, with no decoration and on a single page
+func (m *Menu) printSentences(comm types.Communicable, filter string) int {
+	header := fmt.Sprintf("%s menu.", color.StripColors(m.title))
+	if filter != "" {
+		header = fmt.Sprintf("%s Showing items matching %s.", header, filter)
+	}
+
+	comm.WriteLine(header)
+
+	filteredActions := filterActions(m.actions, filter)
+	if len(filteredActions) == 0 && filter != "" {
+		comm.WriteLine("No items match your search")
+		return 1
+	}
+
+	for _, action := range filteredActions {
+		text := color.StripColors(action.text)
+		comm.WriteLine("%s, type %s.", text, strings.ToUpper(action.key))
+	}
+
+	return 1
+}
@@ -62,3 +62,37 @@ func Test_Search(t *testing.T) {
 	testutils.Assert(comm1.Wrote == comm2.Wrote, t, fmt.Sprintf("Failed to correctly filter menu, got: \n%s, expected: \n%s",
 		color.StripColors(comm2.Wrote), color.StripColors(comm1.Wrote)))
 }
+
+type screenReaderCommunicable struct {
+	testutils.TestCommunicable
+}
+
+func (s *screenReaderCommunicable) ScreenReader() bool {
+	return true
+}
+
+func Test_ScreenReaderMenu(t *testing.T) {
+	var comm screenReaderCommunicable
+	var menu Menu
+
+	menu.SetTitle(color.Colorize(color.Blue, "Main"))
+	menu.AddAction("l", "Login", func() {})
+	menu.AddActionI(4, "Create a character", func() {})
+
+	pages := menu.Print(&comm, 0, "")
+
+	expected := "Main menu.\n" +
+		"Login, type L.\n" +
+		"Create a character, type 5.\n"
+
+	testutils.Assert(pages == 1, t, fmt.Sprintf("Screen reader menu had %v pages", pages))
+	testutils.Assert(comm.Wrote == expected, t, fmt.Sprintf("Screen reader menu was:\n%q, expected:\n%q", comm.Wrote, expected))
+
+	comm.Wrote = ""
+	menu.Print(&comm, 0, "xyz")
+
+	expected = "Main menu. Showing items matching xyz.\n" +
+		"No items match your search\n"
+
+	testutils.Assert(comm.Wrote == expected, t, fmt.Sprintf("Filtered screen reader menu was:\n%q, expected:\n%q", comm.Wrote, expected))
+}
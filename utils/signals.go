@@ -1,16 +1,53 @@
 package utils
 
 import (
+	"context"
+	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 )
 
+var (
+	interruptLock    sync.Mutex
+	interruptCancels []context.CancelFunc
+)
+
+// InterruptContext returns a context that is cancelled when the process is
+// interrupted or terminated, for services that shut down gracefully. Once
+// there is one, InterruptSignalHandler only exits on the next signal.
+func InterruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	interruptLock.Lock()
+	defer interruptLock.Unlock()
+
+	interruptCancels = append(interruptCancels, cancel)
+	return ctx
+}
+
+// InterruptSignalHandler exits on SIGINT or SIGTERM, unless there are contexts
+// from InterruptContext to cancel first
 func InterruptSignalHandler() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	for {
 		<-c
-		os.Exit(0)
+
+		interruptLock.Lock()
+		cancels := interruptCancels
+		interruptCancels = nil
+		interruptLock.Unlock()
+
+		if len(cancels) == 0 {
+			os.Exit(0)
+		}
+
+		log.Println("Shutting down, interrupt again to exit now")
+		for _, cancel := range cancels {
+			cancel()
+		}
 	}
 }
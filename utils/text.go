@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/yamamushi/kmud-2020/color"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// RuneWidth returns the number of columns r takes up on a terminal: two for
+// wide East Asian characters, none for combining marks, format and control
+// characters and one for everything else
+func RuneWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) || unicode.IsControl(r) {
+		return 0
+	}
+
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// DisplayWidth returns the number of columns text takes up on a terminal,
+// ignoring color codes
+func DisplayWidth(text string) int {
+	total := 0
+	for _, r := range color.StripColors(text) {
+		total += RuneWidth(r)
+	}
+	return total
+}
+
+// transliterations are ASCII stand-ins for characters that don't decompose
+// into an ASCII letter and combining marks
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'þ': "th", 'Þ': "Th", 'ð': "d", 'Ð': "D", 'ı': "i",
+	'‘': "'", '’': "'", '‚': ",", '“': "\"", '”': "\"", '„': "\"",
+	'«': "<<", '»': ">>", '‹': "<", '›': ">",
+	'–': "-", '—': "-", '‐': "-", '−': "-", '…': "...", '•': "*", '·': ".",
+	'×': "x", '÷': "/", '©': "(c)", '®': "(r)", '™': "(tm)", '°': "deg",
+	'¡': "!", '¿': "?", '€': "EUR", '£': "GBP", '¥': "JPY",
+	'\u00a0': " ", '\u2009': " ", '\u200b': "",
+}
+
+// Transliterate replaces every non-ASCII character in text with its closest
+// ASCII equivalent, dropping accents and using '?' where there is none
+func Transliterate(text string) string {
+	var result strings.Builder
+
+	for _, r := range norm.NFD.String(text) {
+		switch {
+		case r < unicode.MaxASCII+1:
+			result.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Accents left over from the decomposition
+		default:
+			if replacement, found := transliterations[r]; found {
+				result.WriteString(replacement)
+			} else {
+				result.WriteRune('?')
+			}
+		}
+	}
+
+	return result.String()
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"github.com/yamamushi/kmud-2020/crypt"
+	"github.com/yamamushi/kmud-2020/database"
+	"github.com/yamamushi/kmud-2020/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultTokenLifetime    = 7 * 24 * time.Hour
+	DefaultTokenIdleTimeout = 24 * time.Hour
+)
+
+// sessionsCollection holds a types.Session for every token in use
+const sessionsCollection = "sessions"
+
+var (
+	ErrInvalidToken = errors.New("unauthorized request")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// TokenSettings say how long auth tokens last
+type TokenSettings struct {
+	Lifetime    time.Duration
+	IdleTimeout time.Duration
+}
+
+// TokenSettingsFromConfig reads the token settings from the crypt config
+func TokenSettingsFromConfig(conf *config.Config) (TokenSettings, error) {
+	settings := TokenSettings{Lifetime: DefaultTokenLifetime, IdleTimeout: DefaultTokenIdleTimeout}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"token_lifetime", conf.Crypt.TokenLifetime, &settings.Lifetime},
+		{"token_idle_timeout", conf.Crypt.TokenIdleTimeout, &settings.IdleTimeout},
+	}
+
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value <= 0 {
+			return TokenSettings{}, errors.New("invalid " + duration.name + ": " + duration.value)
+		}
+		*duration.dest = value
+	}
+
+	return settings, nil
+}
+
+// HashToken returns what a token is stored as
+func HashToken(token string) string {
+	return hex.EncodeToString(crypt.Sha256Sum(token))
+}
+
+// NewSession returns a session for username starting at now, along with the
+// token that is given to the client for it
+func NewSession(username string, settings TokenSettings, now time.Time) (types.Session, string, error) {
+	id, err := GetUUID()
+	if err != nil {
+		return types.Session{}, "", err
+	}
+	secret, err := GetRandomToken()
+	if err != nil {
+		return types.Session{}, "", err
+	}
+
+	token := username + ":" + secret
+	session := types.Session{
+		ID:        id,
+		Username:  username,
+		TokenHash: HashToken(token),
+		Created:   now,
+		LastUsed:  now,
+		Expires:   now.Add(settings.Lifetime),
+	}
+	return session, token, nil
+}
+
+// CheckSession returns an error if session can't be used at now
+func CheckSession(session types.Session, settings TokenSettings, now time.Time) error {
+	if !now.Before(session.Expires) || now.Sub(session.LastUsed) >= settings.IdleTimeout {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// CreateToken starts a new session for username, returning its token
+func CreateToken(username string, conf *config.Config, DB *database.DatabaseHandler) (string, error) {
+	settings, err := TokenSettingsFromConfig(conf)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	// Expired sessions are only ever looked at to be turned away, this is as
+	// good a time as any to clear them out
+	_ = DB.DeleteMany(bson.M{"username": username, "expires": bson.M{"$lte": now}}, conf.DB.MongoDB, sessionsCollection)
+
+	session, token, err := NewSession(username, settings, now)
+	if err != nil {
+		return "", errors.New("error creating user token: " + err.Error())
+	}
+
+	err = DB.Insert(SessionToBson(session), conf.DB.MongoDB, sessionsCollection)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ValidateToken returns the session a token belongs to, if it is still
+// valid, and marks it used
+func ValidateToken(token string, conf *config.Config, DB *database.DatabaseHandler) (types.Session, error) {
+	settings, err := TokenSettingsFromConfig(conf)
+	if err != nil {
+		return types.Session{}, err
+	}
+
+	username, _, found := strings.Cut(token, ":")
+	if !found {
+		return types.Session{}, errors.New("invalid token format")
+	}
+
+	filter := bson.M{"tokenhash": HashToken(token)}
+	result, err := DB.FindOne(filter, conf.DB.MongoDB, sessionsCollection)
+	if err != nil {
+		return types.Session{}, ErrInvalidToken
+	}
+
+	session := BsonMapToSession(result)
+	if session.Username != username {
+		return types.Session{}, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if err = CheckSession(session, settings, now); err != nil {
+		_ = DB.DeleteOne(filter, conf.DB.MongoDB, sessionsCollection)
+		return types.Session{}, err
+	}
+
+	session.LastUsed = now
+	err = DB.UpdateOne(filter, bson.M{"lastused": now}, conf.DB.MongoDB, sessionsCollection)
+	return session, err
+}
+
+// RevokeToken ends the session a token belongs to
+func RevokeToken(token string, conf *config.Config, DB *database.DatabaseHandler) error {
+	return DB.DeleteOne(bson.M{"tokenhash": HashToken(token)}, conf.DB.MongoDB, sessionsCollection)
+}
+
+// RevokeAllTokens ends every session of an account
+func RevokeAllTokens(username string, conf *config.Config, DB *database.DatabaseHandler) error {
+	return DB.DeleteMany(bson.M{"username": username}, conf.DB.MongoDB, sessionsCollection)
+}
+
+func BsonMapToSession(input bson.D) (session types.Session) {
+	fields := input.Map()
+	if fields["id"] != nil {
+		session.ID = fields["id"].(string)
+	}
+	if fields["username"] != nil {
+		session.Username = fields["username"].(string)
+	}
+	if fields["tokenhash"] != nil {
+		session.TokenHash = fields["tokenhash"].(string)
+	}
+	session.Created = bsonTime(fields["created"])
+	session.LastUsed = bsonTime(fields["lastused"])
+	session.Expires = bsonTime(fields["expires"])
+	return session
+}
+
+func SessionToBson(input types.Session) bson.M {
+	return bson.M{
+		"id":        input.ID,
+		"username":  input.Username,
+		"tokenhash": input.TokenHash,
+		"created":   input.Created,
+		"lastused":  input.LastUsed,
+		"expires":   input.Expires,
+	}
+}
+
+// bsonTime reads a time that has been stored, which comes back from the
+// database as a primitive.DateTime
+func bsonTime(value interface{}) time.Time {
+	switch t := value.(type) {
+	case primitive.DateTime:
+		return t.Time()
+	case time.Time:
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamamushi/kmud-2020/config"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func Test_TokenSettingsFromConfig(t *testing.T) {
+	settings, err := TokenSettingsFromConfig(&config.Config{})
+	want := TokenSettings{Lifetime: DefaultTokenLifetime, IdleTimeout: DefaultTokenIdleTimeout}
+	if err != nil || settings != want {
+		t.Errorf("TokenSettingsFromConfig() of an empty config == %+v, %v, want %+v", settings, err, want)
+	}
+
+	conf := &config.Config{}
+	conf.Crypt.TokenLifetime = "1h"
+	conf.Crypt.TokenIdleTimeout = "10m"
+	settings, err = TokenSettingsFromConfig(conf)
+	want = TokenSettings{Lifetime: time.Hour, IdleTimeout: 10 * time.Minute}
+	if err != nil || settings != want {
+		t.Errorf("TokenSettingsFromConfig() == %+v, %v, want %+v", settings, err, want)
+	}
+
+	conf.Crypt.TokenLifetime = "0s"
+	if _, err := TokenSettingsFromConfig(conf); err == nil {
+		t.Errorf("TokenSettingsFromConfig() accepted a token_lifetime of 0s")
+	}
+}
+
+func Test_NewSession(t *testing.T) {
+	settings := TokenSettings{Lifetime: time.Hour, IdleTimeout: 10 * time.Minute}
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	session, token, err := NewSession("player", settings, now)
+	if err != nil {
+		t.Fatalf("NewSession() failed: %v", err)
+	}
+	if !strings.HasPrefix(token, "player:") || len(token) <= len("player:") {
+		t.Errorf("NewSession() token == %q, want player:<secret>", token)
+	}
+	if session.TokenHash != HashToken(token) || strings.Contains(session.TokenHash, token[len("player:"):]) {
+		t.Errorf("NewSession() stores %q for token %q, want only its hash", session.TokenHash, token)
+	}
+	if session.Username != "player" || session.ID == "" || !session.Created.Equal(now) || !session.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("NewSession() == %+v", session)
+	}
+
+	other, otherToken, _ := NewSession("player", settings, now)
+	if otherToken == token || other.ID == session.ID {
+		t.Errorf("NewSession() gave two sessions the same token or ID")
+	}
+
+	tests := []struct {
+		name string
+		used time.Duration // After login
+		at   time.Duration
+		err  error
+	}{
+		{"just logged in", 0, 0, nil},
+		{"recently used", 55 * time.Minute, 59 * time.Minute, nil},
+		{"idle", 0, 10 * time.Minute, ErrTokenExpired},
+		{"expired", 59 * time.Minute, time.Hour, ErrTokenExpired},
+	}
+	for _, test := range tests {
+		used := session
+		used.LastUsed = now.Add(test.used)
+		if err := CheckSession(used, settings, now.Add(test.at)); err != test.err {
+			t.Errorf("CheckSession() of a session %v == %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func Test_SessionBson(t *testing.T) {
+	now := time.Now()
+	session, _, _ := NewSession("player", TokenSettings{Lifetime: time.Hour, IdleTimeout: time.Hour}, now)
+
+	// Stored times come back from the database to the millisecond
+	data, err := bson.Marshal(SessionToBson(session))
+	if err != nil {
+		t.Fatalf("bson.Marshal() failed: %v", err)
+	}
+	var stored bson.D
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		t.Fatalf("bson.Unmarshal() failed: %v", err)
+	}
+
+	read := BsonMapToSession(stored)
+	if read.ID != session.ID || read.Username != session.Username || read.TokenHash != session.TokenHash {
+		t.Errorf("BsonMapToSession() == %+v, want %+v", read, session)
+	}
+	if !read.Expires.Equal(session.Expires.Truncate(time.Millisecond)) || !read.LastUsed.Equal(now.Truncate(time.Millisecond)) {
+		t.Errorf("BsonMapToSession() times == %v, %v, want %v, %v", read.LastUsed, read.Expires, now, session.Expires)
+	}
+}
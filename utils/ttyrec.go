@@ -0,0 +1,134 @@
+package utils
+
+/*
+ttyrec recordings
+
+A ttyrec file is a series of frames, each one a header of three little endian
+uint32s (seconds, microseconds and the length of the data) followed by the
+data, which is played back to a terminal as it was at that time.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTtyrecFrame = errors.New("invalid ttyrec frame")
+
+const (
+	ttyrecHeaderLength = 12
+
+	// maxTtyrecFrame keeps a corrupt length from allocating gigabytes
+	maxTtyrecFrame = 1 << 20
+)
+
+// TtyrecFrame is one write to a recorded terminal
+type TtyrecFrame struct {
+	Time time.Time
+	Data []byte
+}
+
+// TtyrecWriter records everything written to it as ttyrec frames, stamped
+// with the time they were written. Line feeds without a carriage return get
+// one, so that input lines, which end in a bare line feed, play back properly.
+type TtyrecWriter struct {
+	lock   sync.Mutex
+	w      io.Writer
+	lastCR bool
+	now    func() time.Time
+}
+
+func NewTtyrecWriter(w io.Writer) *TtyrecWriter {
+	return &TtyrecWriter{w: w, now: time.Now}
+}
+
+func (t *TtyrecWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	data := make([]byte, 0, len(p))
+	for _, b := range p {
+		if b == '\n' && !t.lastCR {
+			data = append(data, '\r')
+		}
+		data = append(data, b)
+		t.lastCR = b == '\r'
+	}
+
+	if err := WriteTtyrecFrame(t.w, TtyrecFrame{Time: t.now(), Data: data}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteTtyrecFrame writes a single frame
+func WriteTtyrecFrame(w io.Writer, frame TtyrecFrame) error {
+	header := make([]byte, ttyrecHeaderLength)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(frame.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(frame.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(frame.Data)))
+
+	_, err := w.Write(append(header, frame.Data...))
+	return err
+}
+
+// ReadTtyrecFrame reads the next frame, returning io.EOF at the end of the
+// recording
+func ReadTtyrecFrame(r io.Reader) (TtyrecFrame, error) {
+	header := make([]byte, ttyrecHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return TtyrecFrame{}, io.EOF
+		}
+		return TtyrecFrame{}, ErrInvalidTtyrecFrame
+	}
+
+	seconds := binary.LittleEndian.Uint32(header[0:4])
+	micros := binary.LittleEndian.Uint32(header[4:8])
+	length := binary.LittleEndian.Uint32(header[8:12])
+	if micros >= 1000000 || length > maxTtyrecFrame {
+		return TtyrecFrame{}, ErrInvalidTtyrecFrame
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return TtyrecFrame{}, ErrInvalidTtyrecFrame
+	}
+
+	return TtyrecFrame{Time: time.Unix(int64(seconds), int64(micros)*1000), Data: data}, nil
+}
+
+// ReplayTtyrec writes a recording to w, waiting between frames as long as
+// passed between them when it was recorded, divided by speed
+func ReplayTtyrec(r io.Reader, w io.Writer, speed float64, sleep func(time.Duration)) error {
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var last time.Time
+	for {
+		frame, err := ReadTtyrecFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !last.IsZero() && frame.Time.After(last) {
+			sleep(time.Duration(float64(frame.Time.Sub(last)) / speed))
+		}
+		last = frame.Time
+
+		if _, err := w.Write(frame.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_TtyrecWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	start := time.Unix(1600000000, 250000000)
+	now := start
+
+	recorder := NewTtyrecWriter(&buffer)
+	recorder.now = func() time.Time { return now }
+
+	recorder.Write([]byte("> "))
+	now = now.Add(1500 * time.Millisecond)
+	recorder.Write([]byte("look\n"))
+	now = now.Add(time.Second)
+	recorder.Write([]byte("A room\r\n"))
+
+	want := []TtyrecFrame{
+		{start, []byte("> ")},
+		{start.Add(1500 * time.Millisecond), []byte("look\r\n")},
+		{start.Add(2500 * time.Millisecond), []byte("A room\r\n")},
+	}
+
+	reader := bytes.NewReader(buffer.Bytes())
+	for i, w := range want {
+		frame, err := ReadTtyrecFrame(reader)
+		if err != nil {
+			t.Fatalf("ReadTtyrecFrame() of frame %v failed: %v", i, err)
+		}
+		if !frame.Time.Equal(w.Time) || !bytes.Equal(frame.Data, w.Data) {
+			t.Errorf("Frame %v == %v %q, want %v %q", i, frame.Time, frame.Data, w.Time, w.Data)
+		}
+	}
+	if _, err := ReadTtyrecFrame(reader); err != io.EOF {
+		t.Errorf("ReadTtyrecFrame() at the end == %v, want io.EOF", err)
+	}
+
+	var output bytes.Buffer
+	var slept []time.Duration
+	err := ReplayTtyrec(bytes.NewReader(buffer.Bytes()), &output, 2, func(d time.Duration) {
+		slept = append(slept, d)
+	})
+	if err != nil {
+		t.Fatalf("ReplayTtyrec() failed: %v", err)
+	}
+	if output.String() != "> look\r\nA room\r\n" {
+		t.Errorf("ReplayTtyrec() wrote %q", output.String())
+	}
+	if len(slept) != 2 || slept[0] != 750*time.Millisecond || slept[1] != 500*time.Millisecond {
+		t.Errorf("ReplayTtyrec() at double speed slept %v, want [750ms 500ms]", slept)
+	}
+
+	truncated := buffer.Bytes()[:ttyrecHeaderLength+1]
+	if _, err := ReadTtyrecFrame(bytes.NewReader(truncated)); err != ErrInvalidTtyrecFrame {
+		t.Errorf("ReadTtyrecFrame() of a truncated frame == %v, want ErrInvalidTtyrecFrame", err)
+	}
+}
@@ -13,10 +13,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/yamamushi/kmud-2020/types"
+	"golang.org/x/text/unicode/norm"
 )
 
 type Prompter interface {
@@ -38,8 +41,33 @@ func SimplePrompter(prompt string) Prompter {
 	return &prompter
 }
 
+// mxpWriter is implemented by connections that may have negotiated MXP
+type mxpWriter interface {
+	MXPEnabled() bool
+}
+
+// colorDepther is implemented by connections that know how many colors the
+// client can show
+type colorDepther interface {
+	ColorDepth() color.ColorDepth
+}
+
+// Write converts the color codes in text for the given color mode and writes it
+// to conn. MXP markup is only kept if conn has negotiated MXP, and extended
+// colors are reduced to what conn can show.
 func Write(conn io.Writer, text string, cm color.ColorMode) error {
-	_, err := conn.Write([]byte(color.ProcessColors(text, cm)))
+	depth := color.Depth16
+	if depther, ok := conn.(colorDepther); ok {
+		depth = depther.ColorDepth()
+	}
+
+	if writer, ok := conn.(mxpWriter); ok && writer.MXPEnabled() {
+		text = color.ProcessMXPDepth(text, cm, depth)
+	} else {
+		text = color.ProcessColorsDepth(text, cm, depth)
+	}
+
+	_, err := conn.Write([]byte(text))
 	return err
 }
 
@@ -55,7 +83,7 @@ func ClearLine(conn io.Writer) error {
 }
 
 func Simplify(str string) string {
-	simpleStr := strings.TrimSpace(str)
+	simpleStr := strings.TrimSpace(norm.NFC.String(str))
 	simpleStr = strings.ToLower(simpleStr)
 	return simpleStr
 }
@@ -79,7 +107,9 @@ func GetRawUserInputSuffixP(conn io.ReadWriter, prompter Prompter, suffix string
 			panic(err)
 		}
 
-		input := scanner.Text()
+		// Accented letters may arrive composed or decomposed, settle on one
+		input := norm.NFC.String(strings.ToValidUTF8(scanner.Text(), string(utf8.RuneError)))
+		input = StripControls(input)
 		Write(conn, suffix, cm)
 
 		if input == "x" || input == "X" {
@@ -90,6 +120,17 @@ func GetRawUserInputSuffixP(conn io.ReadWriter, prompter Prompter, suffix string
 	}
 }
 
+// StripControls removes control characters other than tab from input, so that
+// players can't send escape sequences (or MXP tags) to each other's terminals
+func StripControls(input string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, input)
+}
+
 func GetRawUserInputP(conn io.ReadWriter, prompter Prompter, cm color.ColorMode) string {
 	return GetRawUserInputSuffixP(conn, prompter, "", cm)
 }
@@ -149,7 +190,7 @@ func Argify(data string) (string, string) {
 	}
 
 	command := Simplify(fields[0])
-	params := strings.TrimSpace(data[len(command):])
+	params := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(data), fields[0]))
 
 	return command, params
 }
@@ -196,19 +237,63 @@ func ValidateName(name string) error {
 	const MinSize = 3
 	const MaxSize = 12
 
-	if len(name) < MinSize || len(name) > MaxSize {
+	length := utf8.RuneCountInString(norm.NFC.String(name))
+	if length < MinSize || length > MaxSize {
 		return errors.New(fmt.Sprintf("Names must be between %v and %v letters long", MinSize, MaxSize))
 	}
 
-	regex := regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9]*$")
+	regex := regexp.MustCompile(`^\p{L}\p{M}*[\p{L}\p{M}\p{Nd}]*$`)
 
 	if !regex.MatchString(name) {
-		return errors.New("Names may only contain letters or numbers (A-Z, 0-9), and must begin with a letter")
+		return errors.New("Names may only contain letters or numbers, and must begin with a letter")
+	}
+
+	if !singleScript(name) {
+		return errors.New("Names may not mix letters from different alphabets")
 	}
 
 	return nil
 }
 
+// nameScriptSets are the mixes of scripts that are allowed in one name, the
+// "highly restrictive" profile of UTS #39. Any one script on its own is fine.
+var nameScriptSets = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// singleScript returns true if name is written in a single script, so that
+// names such as "Аdmin" (with a Cyrillic А) can't pass for others
+func singleScript(name string) bool {
+	scripts := map[string]bool{}
+	for _, r := range name {
+		for script, table := range unicode.Scripts {
+			if script != "Common" && script != "Inherited" && unicode.Is(table, r) {
+				scripts[script] = true
+				break
+			}
+		}
+	}
+
+	if len(scripts) <= 1 {
+		return true
+	}
+
+	for _, set := range nameScriptSets {
+		allowed := 0
+		for _, script := range set {
+			if scripts[script] {
+				allowed++
+			}
+		}
+		if allowed == len(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
 func MonitorChannel() {
 	// TODO: See if there's a way to take in a generic channel and see how close it is to being full
 }
@@ -249,9 +334,13 @@ func compress(data []byte) []byte {
 	return b.Bytes()
 }
 
+// WatchableReadWriter passes on everything read from and written to rw to its
+// watchers too, as it happens. Errors writing to watchers are ignored.
 type WatchableReadWriter struct {
-	rw       io.ReadWriter
-	watchers []io.ReadWriter
+	rw        io.ReadWriter
+	lock      sync.RWMutex
+	watchers  []io.Writer
+	hideInput bool
 }
 
 func NewWatchableReadWriter(rw io.ReadWriter) *WatchableReadWriter {
@@ -263,35 +352,56 @@ func NewWatchableReadWriter(rw io.ReadWriter) *WatchableReadWriter {
 func (w *WatchableReadWriter) Read(p []byte) (int, error) {
 	n, err := w.rw.Read(p)
 
-	for _, watcher := range w.watchers {
-		watcher.Write(p[:n])
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if !w.hideInput {
+		for _, watcher := range w.watchers {
+			watcher.Write(p[:n])
+		}
 	}
 
 	return n, err
 }
 
 func (w *WatchableReadWriter) Write(p []byte) (int, error) {
+	w.lock.RLock()
 	for _, watcher := range w.watchers {
 		watcher.Write(p)
 	}
+	w.lock.RUnlock()
 
 	return w.rw.Write(p)
 }
 
-func (w *WatchableReadWriter) AddWatcher(rw io.ReadWriter) {
+func (w *WatchableReadWriter) AddWatcher(rw io.Writer) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	w.watchers = append(w.watchers, rw)
 }
 
-func (w *WatchableReadWriter) RemoveWatcher(rw io.ReadWriter) {
+func (w *WatchableReadWriter) RemoveWatcher(rw io.Writer) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
 	for i, watcher := range w.watchers {
 		if watcher == rw {
-			// TODO: Potential memory leak. See http://code.google.com/p/go-wiki/wiki/SliceTricks
-			w.watchers = append(w.watchers[:i], w.watchers[i+1:]...)
+			w.watchers = append(w.watchers[:i:i], w.watchers[i+1:]...)
 			return
 		}
 	}
 }
 
+// HideInput stops what is read being passed on to the watchers while hide is
+// true, for passwords
+func (w *WatchableReadWriter) HideInput(hide bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.hideInput = hide
+}
+
 // Case-insensitive string comparison
 func Compare(str1, str2 string) bool {
 	return strings.ToLower(str1) == strings.ToLower(str2)
@@ -345,11 +455,12 @@ func DirectionToExitString(direction types.Direction) string {
 	textColor := color.White
 
 	colorize := func(letters string, text string) string {
-		return fmt.Sprintf("%s%s%s%s",
+		return color.Link(fmt.Sprintf("%s%s%s%s",
 			color.Colorize(bracketColor, "["),
 			color.Colorize(letterColor, letters),
 			color.Colorize(bracketColor, "]"),
-			color.Colorize(textColor, text))
+			color.Colorize(textColor, text)),
+			strings.ToLower(letters), "Go "+strings.ToLower(direction.ToString()))
 	}
 
 	switch direction {
@@ -381,9 +492,7 @@ func DirectionToExitString(direction types.Direction) string {
 }
 
 func Paginate(list []string, width, height int) []string {
-	itemLength := func(item string) int {
-		return len(color.StripColors(item))
-	}
+	itemLength := DisplayWidth
 
 	columns := [][]string{}
 	widths := []int{}
@@ -524,17 +633,17 @@ func RemoveLast(input string, check string) string {
 	if len(check) == 0 {
 		return input
 	}
-	if len(input) > 0 && input[len(input)-1] == check[0] {
-		input = input[:len(input)-1]
+	last, size := utf8.DecodeLastRuneInString(input)
+	first, _ := utf8.DecodeRuneInString(check)
+	if size > 0 && last == first {
+		input = input[:len(input)-size]
 	}
 	return input
 }
 
 func RemoveLastChar(input string) string {
-	if len(input) > 0 {
-		input = input[:len(input)-1]
-	}
-	return input
+	_, size := utf8.DecodeLastRuneInString(input)
+	return input[:len(input)-size]
 }
 
 func RemoveStringArray(input string, check string) string {
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"errors"
 	"github.com/yamamushi/kmud-2020/color"
 	"io"
@@ -25,6 +26,50 @@ func Test_WriteLine(t *testing.T) {
 	}
 }
 
+type depthWriter struct {
+	testutils.TestWriter
+	depth color.ColorDepth
+}
+
+func (w *depthWriter) ColorDepth() color.ColorDepth {
+	return w.depth
+}
+
+func Test_WriteColorDepth(t *testing.T) {
+	orange := color.Colorize(color.RGB(255, 135, 0), "orange")
+	tests := []struct {
+		text  string
+		depth color.ColorDepth
+		mode  color.ColorMode
+		want  string
+	}{
+		{orange, color.DepthTrueColor, color.ModeLight, "\033[38;2;255;135;0morange\033[0m"},
+		{orange, color.Depth256, color.ModeLight, "\033[38;5;208morange\033[0m"},
+		{orange, color.Depth16, color.ModeLight, "\033[22;33morange\033[0m"},
+		{orange, color.Depth16, color.ModeNone, "orange"},
+		{color.Colorize(color.Xterm(196), "red"), color.Depth256, color.ModeLight, "\033[38;5;196mred\033[0m"},
+		{color.Colorize(color.Xterm(196), "red"), color.Depth16, color.ModeLight, "\033[01;31mred\033[0m"},
+		{color.Colorize(color.Xterm(2), "green"), color.Depth16, color.ModeLight, "\033[22;32mgreen\033[0m"},
+		{color.Colorize(color.Background(color.Xterm(17)), "sea"), color.Depth256, color.ModeLight, "\033[48;5;17msea\033[0m"},
+		{color.Colorize(color.Background(color.RGB(0, 0, 175)), "sea"), color.Depth16, color.ModeLight, "\033[44msea\033[0m"},
+		{color.Colorize(color.Background(color.RGB(250, 250, 250)), "snow"), color.Depth16, color.ModeLight, "\033[107msnow\033[0m"},
+		{color.Colorize(color.Red, "red"), color.DepthTrueColor, color.ModeLight, "\033[01;31mred\033[0m"},
+		{"@(300) @[256]", color.DepthTrueColor, color.ModeLight, "@(300) @[256]"},
+	}
+
+	for _, test := range tests {
+		writer := &depthWriter{depth: test.depth}
+		Write(writer, test.text, test.mode)
+		if writer.Wrote != test.want {
+			t.Errorf("Write(%q) at %v == %q, want %q", test.text, test.depth, writer.Wrote, test.want)
+		}
+	}
+
+	if stripped := color.StripColors(orange + color.Colorize(color.Background(color.Xterm(3)), "!")); stripped != "orange!" {
+		t.Errorf("StripColors() == %q, want %q", stripped, "orange!")
+	}
+}
+
 func Test_Simplify(t *testing.T) {
 	tests := []struct {
 		s, want string
@@ -57,6 +102,8 @@ func Test_GetRawUserInput(t *testing.T) {
 		{"\tTeSt4\t", "\tTeSt4\t"},
 		{"x", ""},
 		{"X", ""},
+		{"say \033[4z<send href=\"quit\">hi", "say [4z<send href=\"quit\">hi"},
+		{"\x00<b>bold\u009b", "<b>bold"},
 	}
 
 	for _, test := range tests {
@@ -124,6 +171,8 @@ func Test_FormatName(t *testing.T) {
 		{"foo bar", "Foo Bar"},
 		{"foO   bAr", "Foo Bar"},
 		{"foo \n  bar", "Foo Bar"},
+		{"éLODIE", "Élodie"},
+		{"ØYSTEIN", "Øystein"},
 	}
 
 	for _, test := range tests {
@@ -151,6 +200,22 @@ func Test_ValidateName(t *testing.T) {
 		{"aslsidjfljll", true},
 		{"1slsidjfljll", false},
 		{"aslsidjfljl3", true},
+		{"Élodie", true},
+		{"Ｅlodie", true},
+		{"Zoë", true},
+		{"Zoe\u0308", true},
+		{"éééééééééééé", true},
+		{"ééééééééééééé", false},
+		{"Zo ë", false},
+		{"\u0308oe", false},
+		{"Zoë😀", false},
+		{"Аdmin", false},
+		{"Ρaul", false},
+		{"Дмитрий", true},
+		{"Ἀχιλλεύς", true},
+		{"山田たろう", true},
+		{"Kenji山田", true},
+		{"Kenjiたろうь", false},
 	}
 
 	for _, test := range tests {
@@ -198,6 +263,9 @@ func Test_Argify(t *testing.T) {
 		{"test one two", "test", "one two"},
 		{"this is a somewhat longer test that should also work",
 			"this", "is a somewhat longer test that should also work"},
+		{"  Look  at", "look", "at"},
+		{"İstanbul pier", "istanbul", "pier"},
+		{"say héllo wörld", "say", "héllo wörld"},
 	}
 
 	for _, test := range tests {
@@ -209,6 +277,71 @@ func Test_Argify(t *testing.T) {
 	}
 }
 
+func Test_DisplayWidth(t *testing.T) {
+	tests := []struct {
+		input string
+		width int
+	}{
+		{"", 0},
+		{"look", 4},
+		{"héllo", 5},
+		{"he\u0301llo", 5},
+		{"日本語", 6},
+		{"ｆｕｌｌ", 8},
+		{color.Colorize(color.Red, "zoë"), 3},
+	}
+
+	for _, test := range tests {
+		if width := DisplayWidth(test.input); width != test.width {
+			t.Errorf("DisplayWidth(%q) == %v, want %v", test.input, width, test.width)
+		}
+	}
+}
+
+func Test_Transliterate(t *testing.T) {
+	tests := []struct {
+		input, output string
+	}{
+		{"plain", "plain"},
+		{"Élodie's café", "Elodie's cafe"},
+		{"Straße — “quoted”…", "Strasse - \"quoted\"..."},
+		{"Øystein Ærø", "Oystein AEro"},
+		{"日本", "??"},
+	}
+
+	for _, test := range tests {
+		if output := Transliterate(test.input); output != test.output {
+			t.Errorf("Transliterate(%q) == %q, want %q", test.input, output, test.output)
+		}
+	}
+}
+
+func Test_Paginate(t *testing.T) {
+	pages := Paginate([]string{"日本", "ab", "cd", "éf"}, 12, 2)
+	want := "日本  cd  \r\nab    éf  \r\n"
+
+	if len(pages) != 1 || pages[0] != want {
+		t.Errorf("Paginate() == %q, want [%q]", pages, want)
+	}
+}
+
+func Test_RemoveLastChar(t *testing.T) {
+	tests := []struct {
+		input, output string
+	}{
+		{"", ""},
+		{"ab", "a"},
+		{"café", "caf"},
+		{"日本", "日"},
+	}
+
+	for _, test := range tests {
+		if output := RemoveLastChar(test.input); output != test.output {
+			t.Errorf("RemoveLastChar(%q) == %q, want %q", test.input, output, test.output)
+		}
+	}
+}
+
 func Test_TrimUpperRows(t *testing.T) {
 	emptyRow1 := "                                                                           "
 	emptyRow2 := " "
@@ -467,3 +600,44 @@ func Test_Bound(t *testing.T) {
 		}
 	}
 }
+
+func Test_WatchableReadWriter(t *testing.T) {
+	var input, output, watcher bytes.Buffer
+	input.WriteString("look\n")
+
+	watchable := NewWatchableReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{&input, &output})
+	watchable.AddWatcher(&watcher)
+
+	watchable.Write([]byte("> "))
+	buffer := make([]byte, 16)
+	n, _ := watchable.Read(buffer)
+
+	if got := string(buffer[:n]); got != "look\n" {
+		t.Errorf("Read() == %q, want %q", got, "look\n")
+	}
+	if watcher.String() != "> look\n" {
+		t.Errorf("Watcher saw %q, want %q", watcher.String(), "> look\n")
+	}
+
+	watcher.Reset()
+	input.WriteString("secret\n")
+	watchable.HideInput(true)
+	watchable.Write([]byte("Password: "))
+	watchable.Read(buffer)
+	watchable.HideInput(false)
+
+	if watcher.String() != "Password: " {
+		t.Errorf("Watcher saw %q while input was hidden, want %q", watcher.String(), "Password: ")
+	}
+
+	watcher.Reset()
+	watchable.RemoveWatcher(&watcher)
+	watchable.Write([]byte("gone"))
+
+	if watcher.Len() != 0 {
+		t.Errorf("Removed watcher saw %q", watcher.String())
+	}
+}